@@ -0,0 +1,405 @@
+package apiplexy
+
+import (
+	"crypto/subtle"
+	"encoding/json"
+	"fmt"
+	"github.com/dgrijalva/jwt-go"
+	"github.com/garyburd/redigo/redis"
+	"github.com/gorilla/mux"
+	"net"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+)
+
+type adminAPI struct {
+	signingKey []byte
+	token      string
+	m          AdminBackendPlugin
+	a          *apiplex
+}
+
+// The admin view of a user, including the bits that are hidden from the
+// user themselves.
+type adminUser struct {
+	Email   string                 `json:"email"`
+	Name    string                 `json:"name"`
+	Active  bool                   `json:"active"`
+	Admin   bool                   `json:"admin"`
+	Profile map[string]interface{} `json:"profile,omitempty"`
+	Keys    []*Key                 `json:"keys,omitempty"`
+}
+
+type adminKey struct {
+	Key   *Key   `json:"key"`
+	Owner string `json:"owner"`
+}
+
+type quotaCounter struct {
+	Used    int `json:"used"`
+	Max     int `json:"max"`
+	ResetIn int `json:"reset_in"`
+}
+
+type quotaUsage struct {
+	KeyID   string                  `json:"key_id"`
+	Quota   string                  `json:"quota"`
+	Minutes int                     `json:"minutes"`
+	Key     *quotaCounter           `json:"key,omitempty"`
+	IPs     map[string]quotaCounter `json:"ips"`
+}
+
+// pathVar returns a decoded path variable. The router matches on the encoded
+// path, so that key IDs containing slashes (like base64 ones) can be passed
+// URL-escaped.
+func pathVar(req *http.Request, name string) string {
+	v := mux.Vars(req)[name]
+	if unescaped, err := url.PathUnescape(v); err == nil {
+		return unescaped
+	}
+	return v
+}
+
+func (a *adminAPI) toAdminUser(u *User) *adminUser {
+	return &adminUser{
+		Email:   u.Email,
+		Name:    u.Name,
+		Active:  u.Active,
+		Admin:   a.m.IsAdmin(u.Email),
+		Profile: u.Profile,
+	}
+}
+
+func (a *adminAPI) listUsers(res http.ResponseWriter, req *http.Request) {
+	offset, _ := strconv.Atoi(req.URL.Query().Get("offset"))
+	limit, _ := strconv.Atoi(req.URL.Query().Get("limit"))
+	if offset < 0 {
+		offset = 0
+	}
+	if limit <= 0 || limit > 500 {
+		limit = 50
+	}
+	users, err := a.m.ListUsers(offset, limit)
+	if err != nil {
+		abort(res, 500, "Could not list users: %s", err.Error())
+		return
+	}
+	result := make([]*adminUser, len(users))
+	for i, u := range users {
+		result[i] = a.toAdminUser(u)
+	}
+	finish(res, result)
+}
+
+func (a *adminAPI) getUser(res http.ResponseWriter, req *http.Request) {
+	email := pathVar(req, "email")
+	u := a.m.GetUser(email)
+	if u == nil {
+		abort(res, 404, "No user %s.", email)
+		return
+	}
+	keys, err := a.m.GetAllKeys(email)
+	if err != nil {
+		abort(res, 500, "Could not list keys: %s", err.Error())
+		return
+	}
+	au := a.toAdminUser(u)
+	au.Keys = keys
+	finish(res, au)
+}
+
+func (a *adminAPI) setUserActive(active bool) func(http.ResponseWriter, *http.Request) {
+	return func(res http.ResponseWriter, req *http.Request) {
+		email := pathVar(req, "email")
+		if a.m.GetUser(email) == nil {
+			abort(res, 404, "No user %s.", email)
+			return
+		}
+		var err error
+		if active {
+			err = a.m.ActivateUser(email)
+		} else {
+			err = a.m.DeactivateUser(email)
+		}
+		if err != nil {
+			abort(res, 500, "Could not update user: %s", err.Error())
+			return
+		}
+		if keys, err := a.m.GetAllKeys(email); err == nil {
+			ids := make([]string, len(keys))
+			for i, k := range keys {
+				ids[i] = k.ID
+			}
+			a.a.forgetKeys(ids...)
+		}
+		finish(res, a.toAdminUser(a.m.GetUser(email)))
+	}
+}
+
+func (a *adminAPI) setAdmin(res http.ResponseWriter, req *http.Request) {
+	email := pathVar(req, "email")
+	r := struct {
+		Admin *bool `json:"admin"`
+	}{}
+	if json.NewDecoder(req.Body).Decode(&r) != nil || r.Admin == nil {
+		abort(res, 400, "Specify admin: true or false.")
+		return
+	}
+	if a.m.GetUser(email) == nil {
+		abort(res, 404, "No user %s.", email)
+		return
+	}
+	if err := a.m.SetAdmin(email, *r.Admin); err != nil {
+		abort(res, 500, "Could not update user: %s", err.Error())
+		return
+	}
+	finish(res, a.toAdminUser(a.m.GetUser(email)))
+}
+
+func (a *adminAPI) getKey(res http.ResponseWriter, req *http.Request) {
+	keyID := pathVar(req, "id")
+	key, owner, err := a.m.FindKey(keyID)
+	if err != nil {
+		abort(res, 500, "Could not find key: %s", err.Error())
+		return
+	}
+	if key == nil {
+		abort(res, 404, "No key %s.", keyID)
+		return
+	}
+	finish(res, &adminKey{Key: key, Owner: owner})
+}
+
+func (a *adminAPI) setKeyQuota(res http.ResponseWriter, req *http.Request) {
+	keyID := pathVar(req, "id")
+	r := struct {
+		Quota string `json:"quota"`
+	}{}
+	if json.NewDecoder(req.Body).Decode(&r) != nil || r.Quota == "" {
+		abort(res, 400, "Specify a quota.")
+		return
+	}
+	if _, ok := a.a.quotas[r.Quota]; !ok || r.Quota == "keyless" {
+		abort(res, 400, "There is no quota named '%s'.", r.Quota)
+		return
+	}
+	key, owner, err := a.m.FindKey(keyID)
+	if err != nil {
+		abort(res, 500, "Could not find key: %s", err.Error())
+		return
+	}
+	if key == nil {
+		abort(res, 404, "No key %s.", keyID)
+		return
+	}
+	if err := a.m.SetKeyQuota(keyID, r.Quota); err != nil {
+		abort(res, 500, "Could not update key: %s", err.Error())
+		return
+	}
+	a.a.forgetKeys(keyID)
+	key.Quota = r.Quota
+	finish(res, &adminKey{Key: key, Owner: owner})
+}
+
+func (a *adminAPI) revokeKey(res http.ResponseWriter, req *http.Request) {
+	keyID := pathVar(req, "id")
+	key, _, err := a.m.FindKey(keyID)
+	if err != nil {
+		abort(res, 500, "Could not find key: %s", err.Error())
+		return
+	}
+	if key == nil {
+		abort(res, 404, "No key %s.", keyID)
+		return
+	}
+	if err := a.m.RevokeKey(keyID); err != nil {
+		abort(res, 500, "Could not revoke key: %s", err.Error())
+		return
+	}
+	a.a.forgetKeys(keyID)
+	msg := struct {
+		Revoked string `json:"revoked"`
+	}{Revoked: keyID}
+	finish(res, &msg)
+}
+
+// usageContext returns a context that quotaFor understands for a key ID (or
+// "keyless").
+func (a *adminAPI) usageContext(keyID string) (*APIContext, error) {
+	if keyID == "keyless" {
+		return &APIContext{Keyless: true}, nil
+	}
+	key, _, err := a.m.FindKey(keyID)
+	if err != nil || key == nil {
+		return nil, err
+	}
+	return &APIContext{Key: key}, nil
+}
+
+func scanKeys(rd redis.Conn, pattern string) ([]string, error) {
+	keys := []string{}
+	cursor := 0
+	for {
+		values, err := redis.Values(rd.Do("SCAN", cursor, "MATCH", pattern, "COUNT", 100))
+		if err != nil {
+			return nil, err
+		}
+		var batch []string
+		if _, err := redis.Scan(values, &cursor, &batch); err != nil {
+			return nil, err
+		}
+		keys = append(keys, batch...)
+		if cursor == 0 {
+			return keys, nil
+		}
+	}
+}
+
+var globEscaper = strings.NewReplacer(`\`, `\\`, "*", `\*`, "?", `\?`, "[", `\[`, "]", `\]`)
+
+// ipCounterKeys finds the per-IP quota counters of a key. Key IDs are escaped
+// before they go into the SCAN pattern, and only counters that end in an IP
+// address are kept, so IDs containing glob characters or colons never pick
+// up the counters of other keys.
+func ipCounterKeys(rd redis.Conn, keyID string) ([]string, error) {
+	prefix := "quota:ip:" + keyID + ":"
+	rkeys, err := scanKeys(rd, globEscaper.Replace(prefix)+"*")
+	if err != nil {
+		return nil, err
+	}
+	counters := []string{}
+	for _, rkey := range rkeys {
+		if net.ParseIP(strings.TrimPrefix(rkey, prefix)) != nil {
+			counters = append(counters, rkey)
+		}
+	}
+	return counters, nil
+}
+
+func (a *adminAPI) getUsage(res http.ResponseWriter, req *http.Request) {
+	keyID := pathVar(req, "id")
+	ctx, err := a.usageContext(keyID)
+	if err != nil {
+		abort(res, 500, "Could not determine usage: %s", err.Error())
+		return
+	}
+	if ctx == nil {
+		abort(res, 404, "No key %s.", keyID)
+		return
+	}
+	quota, quotaName, _ := a.a.quotaFor(ctx)
+	usage := quotaUsage{KeyID: keyID, Quota: quotaName, Minutes: quota.Minutes, IPs: make(map[string]quotaCounter)}
+
+	rd := a.a.redis.Get()
+	defer rd.Close()
+	counter := func(rkey string, max int) quotaCounter {
+		used, _ := redis.Int(rd.Do("GET", rkey))
+		ttl, _ := redis.Int(rd.Do("TTL", rkey))
+		if ttl < 0 {
+			ttl = 0
+		}
+		return quotaCounter{Used: used, Max: max, ResetIn: ttl}
+	}
+	if quota.MaxKey > 0 {
+		c := counter("quota:key:"+keyID, quota.MaxKey)
+		usage.Key = &c
+	}
+	prefix := "quota:ip:" + keyID + ":"
+	ipKeys, err := ipCounterKeys(rd, keyID)
+	if err != nil {
+		abort(res, 500, "Could not determine usage: %s", err.Error())
+		return
+	}
+	for _, rkey := range ipKeys {
+		usage.IPs[strings.TrimPrefix(rkey, prefix)] = counter(rkey, quota.MaxIP)
+	}
+	finish(res, &usage)
+}
+
+func (a *adminAPI) resetUsage(res http.ResponseWriter, req *http.Request) {
+	keyID := pathVar(req, "id")
+	rd := a.a.redis.Get()
+	defer rd.Close()
+	rkeys, err := ipCounterKeys(rd, keyID)
+	if err != nil {
+		abort(res, 500, "Could not reset usage: %s", err.Error())
+		return
+	}
+	rkeys = append(rkeys, "quota:key:"+keyID)
+	args := make([]interface{}, len(rkeys))
+	for i, k := range rkeys {
+		args[i] = k
+	}
+	rd.Do("DEL", args...)
+	msg := struct {
+		Reset string `json:"reset"`
+	}{Reset: keyID}
+	finish(res, &msg)
+}
+
+// auth lets a request through if it carries either the configured admin token,
+// or a portal login token belonging to an admin user:
+//
+//  Authorization: Bearer <admin token or portal token>
+func (a *adminAPI) auth(inner func(http.ResponseWriter, *http.Request)) func(http.ResponseWriter, *http.Request) {
+	return func(res http.ResponseWriter, req *http.Request) {
+		bearer := strings.TrimSpace(strings.TrimPrefix(req.Header.Get("Authorization"), "Bearer "))
+		if bearer == "" {
+			abort(res, 403, "Access denied: please authenticate using the admin token or an admin's token.")
+			return
+		}
+		if a.token != "" && subtle.ConstantTimeCompare([]byte(bearer), []byte(a.token)) == 1 {
+			inner(res, req)
+			return
+		}
+		token, err := jwt.Parse(bearer, func(token *jwt.Token) (interface{}, error) {
+			if token.Method != jwt.SigningMethodHS256 {
+				return nil, fmt.Errorf("Token signed with an incorrect method: %v", token.Header["alg"])
+			}
+			return a.signingKey, nil
+		})
+		if err != nil {
+			abort(res, 403, "Access denied: %s -- please authenticate using a valid token.", err.Error())
+			return
+		}
+		email, ok := token.Claims["email"].(string)
+		if !ok || !a.m.IsAdmin(email) {
+			abort(res, 403, "Access denied: you are not an administrator.")
+			return
+		}
+		inner(res, req)
+	}
+}
+
+func (ap *apiplex) BuildAdminAPI(prefix string, adminToken string) (*mux.Router, error) {
+	if ap.usermgmt == nil {
+		return nil, fmt.Errorf("Cannot create admin API. There is no backend plugin that supports full user management.")
+	}
+	m, ok := ap.usermgmt.(AdminBackendPlugin)
+	if !ok {
+		return nil, fmt.Errorf("Cannot create admin API. The user management backend doesn't support admin functions.")
+	}
+	a := &adminAPI{
+		signingKey: []byte(ap.signingKey),
+		token:      adminToken,
+		m:          m,
+		a:          ap,
+	}
+
+	r := mux.NewRouter().UseEncodedPath().PathPrefix(prefix).Subrouter()
+
+	r.HandleFunc("/users", a.auth(a.listUsers)).Methods("GET")
+	r.HandleFunc("/users/{email}", a.auth(a.getUser)).Methods("GET")
+	r.HandleFunc("/users/{email}/activate", a.auth(a.setUserActive(true))).Methods("POST")
+	r.HandleFunc("/users/{email}/deactivate", a.auth(a.setUserActive(false))).Methods("POST")
+	r.HandleFunc("/users/{email}/admin", a.auth(a.setAdmin)).Methods("POST").Headers("Content-Type", "application/json")
+	r.HandleFunc("/keys/{id}", a.auth(a.getKey)).Methods("GET")
+	r.HandleFunc("/keys/{id}/quota", a.auth(a.setKeyQuota)).Methods("POST").Headers("Content-Type", "application/json")
+	r.HandleFunc("/keys/{id}/revoke", a.auth(a.revokeKey)).Methods("POST")
+	r.HandleFunc("/usage/{id}", a.auth(a.getUsage)).Methods("GET")
+	r.HandleFunc("/usage/{id}", a.auth(a.resetUsage)).Methods("DELETE")
+
+	return r, nil
+}
@@ -2,12 +2,22 @@ package main
 
 // Import apiplexy plugins in a separate block (just because it looks nicer). TEST
 import (
+	_ "github.com/12foo/apiplexy/auth/apikey"
+	_ "github.com/12foo/apiplexy/auth/basic"
 	_ "github.com/12foo/apiplexy/auth/hmac"
+	_ "github.com/12foo/apiplexy/auth/introspection"
+	_ "github.com/12foo/apiplexy/auth/jwt"
+	_ "github.com/12foo/apiplexy/auth/oauth2"
 	_ "github.com/12foo/apiplexy/backend/sql"
+	_ "github.com/12foo/apiplexy/cost"
+	_ "github.com/12foo/apiplexy/external"
 	_ "github.com/12foo/apiplexy/logging"
+	_ "github.com/12foo/apiplexy/openapi"
+	_ "github.com/12foo/apiplexy/script"
 )
 
 import (
+	"context"
 	"fmt"
 	"github.com/12foo/apiplexy"
 	"github.com/codegangsta/cli"
@@ -16,9 +26,12 @@ import (
 	"io/ioutil"
 	"net/http"
 	"os"
+	"os/signal"
 	"sort"
 	"strconv"
+	"syscall"
 	"text/tabwriter"
+	"time"
 )
 
 func listPlugins(c *cli.Context) {
@@ -70,21 +83,28 @@ func generateConfig(c *cli.Context) {
 	os.Stdout.Write(yml)
 }
 
-func start(c *cli.Context) {
-	configPath := c.String("config")
+func readConfig(configPath string) (*apiplexy.ApiplexConfig, error) {
 	yml, err := ioutil.ReadFile(os.ExpandEnv(configPath))
 	if err != nil {
-		fmt.Fprintf(os.Stderr, "Couldn't read config file: %s\n", err.Error())
-		os.Exit(1)
+		return nil, fmt.Errorf("Couldn't read config file: %s", err.Error())
 	}
 	config := apiplexy.ApiplexConfig{}
 	err = yaml.Unmarshal(yml, &config)
 	if err != nil {
-		fmt.Fprintf(os.Stderr, "Couldn't parse configuration: %s\n", err.Error())
+		return nil, fmt.Errorf("Couldn't parse configuration: %s", err.Error())
+	}
+	return &config, nil
+}
+
+func start(c *cli.Context) {
+	configPath := c.String("config")
+	config, err := readConfig(configPath)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "%s\n", err.Error())
 		os.Exit(1)
 	}
 
-	ap, err := apiplexy.New(config)
+	ap, err := apiplexy.New(*config)
 	if err != nil {
 		fmt.Fprintf(os.Stderr, "Couldn't initialize API proxy. %s\n", err.Error())
 		os.Exit(2)
@@ -94,8 +114,39 @@ func start(c *cli.Context) {
 		Addr:    "0.0.0.0:" + strconv.Itoa(config.Serve.Port),
 		Handler: ap,
 	}
+
+	// SIGHUP reloads the configuration, SIGINT/SIGTERM shut down gracefully
+	signals := make(chan os.Signal, 1)
+	signal.Notify(signals, syscall.SIGHUP, syscall.SIGINT, syscall.SIGTERM)
+	go func() {
+		for sig := range signals {
+			if sig == syscall.SIGHUP {
+				newConfig, err := readConfig(configPath)
+				if err == nil {
+					err = ap.Reload(*newConfig)
+				}
+				if err != nil {
+					fmt.Fprintf(os.Stderr, "Reload failed, keeping current configuration. %s\n", err.Error())
+				} else {
+					fmt.Printf("Configuration reloaded.\n")
+				}
+				continue
+			}
+			fmt.Printf("Shutting down.\n")
+			ctx, cancel := context.WithTimeout(context.Background(), 30*time.Second)
+			server.Shutdown(ctx)
+			cancel()
+			return
+		}
+	}()
+
 	fmt.Printf("Running server on port %d.\n", config.Serve.Port)
-	server.ListenAndServe()
+	if err := server.ListenAndServe(); err != nil && err != http.ErrServerClosed {
+		fmt.Fprintf(os.Stderr, "%s\n", err.Error())
+	}
+	if err := ap.Close(); err != nil {
+		fmt.Fprintf(os.Stderr, "%s\n", err.Error())
+	}
 }
 
 func main() {
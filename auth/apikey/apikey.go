@@ -0,0 +1,153 @@
+package apikey
+
+import (
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/base64"
+	"encoding/hex"
+	"fmt"
+	"github.com/12foo/apiplexy"
+	"net/http"
+	"strings"
+)
+
+type apikeyConfig struct {
+	Header     string `config:"header" default:"X-API-Key"`
+	Scheme     string `config:"scheme"`
+	QueryParam string `config:"query_param"`
+	Strip      bool   `config:"strip" default:"true"`
+	Prefix     string `config:"prefix"`
+}
+
+// APIKeyPlugin authenticates requests by a static key, sent in a header or a
+// query parameter. Keys are random 256-bit values. Only their SHA-256 hash is
+// used as the key ID, so backends (and the auth cache) never see plaintext
+// keys; the plaintext is handed to the user once, when the key is generated.
+type APIKeyPlugin struct {
+	config *apikeyConfig
+}
+
+var availableTypes = []apiplexy.KeyType{
+	{Name: "APIKey", Description: "A static key, sent with every request in a header or query parameter."},
+}
+
+// HashKey returns the ID under which a plaintext API key is stored.
+func HashKey(plaintext string) string {
+	h := sha256.Sum256([]byte(plaintext))
+	return hex.EncodeToString(h[:])
+}
+
+func (p *APIKeyPlugin) AvailableTypes() []apiplexy.KeyType {
+	return availableTypes
+}
+
+func (p *APIKeyPlugin) Generate(keyType string) (key apiplexy.Key, err error) {
+	if keyType != "APIKey" {
+		return apiplexy.Key{}, fmt.Errorf("Unknown key type: %s", keyType)
+	}
+	b := make([]byte, 32)
+	if _, err := rand.Read(b); err != nil {
+		return apiplexy.Key{}, err
+	}
+	plaintext := p.config.Prefix + base64.RawURLEncoding.EncodeToString(b)
+	return apiplexy.Key{
+		ID:    HashKey(plaintext),
+		Type:  "APIKey",
+		Token: plaintext,
+	}, nil
+}
+
+// fromHeader returns the plaintext key from the configured header, if the
+// header is there (and uses the configured scheme).
+func (p *APIKeyPlugin) fromHeader(req *http.Request) string {
+	if p.config.Header == "" {
+		return ""
+	}
+	v := strings.TrimSpace(req.Header.Get(p.config.Header))
+	if p.config.Scheme == "" {
+		return v
+	}
+	prefix := p.config.Scheme + " "
+	if len(v) <= len(prefix) || !strings.EqualFold(v[:len(prefix)], prefix) {
+		return ""
+	}
+	return strings.TrimSpace(v[len(prefix):])
+}
+
+// find returns the plaintext key from the request, if there is one.
+func (p *APIKeyPlugin) find(req *http.Request) string {
+	if v := p.fromHeader(req); v != "" {
+		return v
+	}
+	if p.config.QueryParam != "" {
+		return req.URL.Query().Get(p.config.QueryParam)
+	}
+	return ""
+}
+
+func (p *APIKeyPlugin) Detect(req *http.Request, ctx *apiplexy.APIContext) (maybeKey string, keyType string, bits map[string]interface{}, err error) {
+	plaintext := p.find(req)
+	if plaintext == "" {
+		return "", "", nil, nil
+	}
+	return HashKey(plaintext), "APIKey", nil, nil
+}
+
+// Validate accepts any key the backends found by its hash. The key is removed
+// from the request, so it isn't passed on to the upstream.
+func (p *APIKeyPlugin) Validate(key *apiplexy.Key, req *http.Request, ctx *apiplexy.APIContext, bits map[string]interface{}) (isValid bool, err error) {
+	if key.Type != "APIKey" {
+		return false, nil
+	}
+	if p.config.Strip {
+		if p.fromHeader(req) != "" {
+			req.Header.Del(p.config.Header)
+		}
+		if p.config.QueryParam != "" {
+			query := req.URL.Query()
+			if _, ok := query[p.config.QueryParam]; ok {
+				query.Del(p.config.QueryParam)
+				req.URL.RawQuery = query.Encode()
+			}
+		}
+	}
+	return true, nil
+}
+
+// VerifySecret lets clients exchange their key's ID and plaintext key for an
+// OAuth2 access token.
+func (p *APIKeyPlugin) VerifySecret(key *apiplexy.Key, secret string) bool {
+	return key.Type == "APIKey" && subtle.ConstantTimeCompare([]byte(HashKey(secret)), []byte(key.ID)) == 1
+}
+
+func (p *APIKeyPlugin) ConfigStruct() interface{} {
+	return &apikeyConfig{}
+}
+
+func (p *APIKeyPlugin) ConfigureTyped(config interface{}) error {
+	c := config.(*apikeyConfig)
+	if c.Header == "" && c.QueryParam == "" {
+		return fmt.Errorf("Set a header or a query_param to look for API keys in.")
+	}
+	p.config = c
+	return nil
+}
+
+func (p *APIKeyPlugin) DefaultConfig() map[string]interface{} {
+	return apiplexy.TypedDefaultConfig(p)
+}
+
+func (p *APIKeyPlugin) Configure(config map[string]interface{}) error {
+	return apiplexy.TypedConfigure(p, config)
+}
+
+func init() {
+	// _ = apiplexy.SecretVerifyingAuthPlugin(&APIKeyPlugin{})
+	apiplexy.RegisterPlugin(
+		"apikey",
+		"Authenticate requests by a static API key in a header or query parameter.",
+		"https://github.com/12foo/apiplexy/tree/master/auth/apikey",
+		APIKeyPlugin{},
+	)
+}
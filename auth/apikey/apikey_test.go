@@ -0,0 +1,98 @@
+package apikey
+
+import (
+	"github.com/12foo/apiplexy"
+	. "github.com/smartystreets/goconvey/convey"
+	"net/http"
+	"testing"
+)
+
+func configured(config map[string]interface{}) (*APIKeyPlugin, error) {
+	p := &APIKeyPlugin{}
+	return p, p.Configure(config)
+}
+
+func TestConfigure(t *testing.T) {
+	Convey("Plugin should configure with its default configuration", t, func() {
+		p := &APIKeyPlugin{}
+		So(p.Configure(p.DefaultConfig()), ShouldBeNil)
+		So(p.config.Header, ShouldEqual, "X-API-Key")
+	})
+
+	Convey("Plugin should need somewhere to look for keys", t, func() {
+		_, err := configured(map[string]interface{}{"header": ""})
+		So(err, ShouldNotBeNil)
+	})
+}
+
+func TestGeneration(t *testing.T) {
+	Convey("Generated keys should be random, and stored only as a hash", t, func() {
+		p, _ := configured(map[string]interface{}{"prefix": "apx_"})
+		k1, err := p.Generate("APIKey")
+		So(err, ShouldBeNil)
+		k2, _ := p.Generate("APIKey")
+		So(k1.Token, ShouldStartWith, "apx_")
+		So(len(k1.Token), ShouldBeGreaterThan, 40)
+		So(k1.Token, ShouldNotEqual, k2.Token)
+		So(k1.ID, ShouldEqual, HashKey(k1.Token))
+		So(k1.ID, ShouldNotContainSubstring, k1.Token)
+		So(p.VerifySecret(&k1, k1.Token), ShouldBeTrue)
+		So(p.VerifySecret(&k1, k2.Token), ShouldBeFalse)
+
+		_, err = p.Generate("HMAC")
+		So(err, ShouldNotBeNil)
+	})
+}
+
+func TestDetection(t *testing.T) {
+	ctx := apiplexy.APIContext{}
+
+	Convey("Keys should be detected in the configured header and stripped", t, func() {
+		p, _ := configured(nil)
+		key, _ := p.Generate("APIKey")
+		req, _ := http.NewRequest("GET", "http://example.com/things", nil)
+		req.Header.Set("X-API-Key", key.Token)
+
+		kid, ktype, bits, err := p.Detect(req, &ctx)
+		So(err, ShouldBeNil)
+		So(kid, ShouldEqual, key.ID)
+		So(ktype, ShouldEqual, "APIKey")
+
+		stored := apiplexy.Key{ID: key.ID, Type: "APIKey"}
+		valid, err := p.Validate(&stored, req, &ctx, bits)
+		So(err, ShouldBeNil)
+		So(valid, ShouldBeTrue)
+		So(req.Header.Get("X-API-Key"), ShouldBeBlank)
+	})
+
+	Convey("Keys should be detected as bearer tokens", t, func() {
+		p, _ := configured(map[string]interface{}{"header": "Authorization", "scheme": "Bearer"})
+		req, _ := http.NewRequest("GET", "http://example.com/things", nil)
+		req.Header.Set("Authorization", "bearer s3cret")
+		kid, _, _, _ := p.Detect(req, &ctx)
+		So(kid, ShouldEqual, HashKey("s3cret"))
+
+		req.Header.Set("Authorization", "Basic s3cret")
+		kid, _, _, _ = p.Detect(req, &ctx)
+		So(kid, ShouldBeBlank)
+	})
+
+	Convey("Keys should be detected in the query and stripped", t, func() {
+		p, _ := configured(map[string]interface{}{"query_param": "api_key"})
+		req, _ := http.NewRequest("GET", "http://example.com/things?api_key=s3cret&page=2", nil)
+		kid, _, bits, _ := p.Detect(req, &ctx)
+		So(kid, ShouldEqual, HashKey("s3cret"))
+
+		stored := apiplexy.Key{ID: kid, Type: "APIKey"}
+		p.Validate(&stored, req, &ctx, bits)
+		So(req.URL.RawQuery, ShouldEqual, "page=2")
+	})
+
+	Convey("Requests without a key should be ignored", t, func() {
+		p, _ := configured(nil)
+		req, _ := http.NewRequest("GET", "http://example.com/things", nil)
+		kid, _, _, err := p.Detect(req, &ctx)
+		So(err, ShouldBeNil)
+		So(kid, ShouldBeBlank)
+	})
+}
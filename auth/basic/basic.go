@@ -0,0 +1,172 @@
+package basic
+
+import (
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"fmt"
+	"github.com/12foo/apiplexy"
+	"github.com/dchest/uniuri"
+	"golang.org/x/crypto/bcrypt"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+)
+
+type basicConfig struct {
+	Cost          int           `config:"cost" default:"10" min:"4" max:"31"`
+	Strip         bool          `config:"strip" default:"true"`
+	CacheVerified bool          `config:"cache_verified" default:"true"`
+	CacheSize     int           `config:"cache_size" default:"10000" min:"1"`
+	CacheTTL      time.Duration `config:"cache_ttl" default:"5m" min:"1s"`
+}
+
+// BasicAuthPlugin authenticates requests by HTTP Basic auth, for clients that
+// can't do anything else. The username is the key ID, and the password is the
+// key's secret. Backends only store a bcrypt hash of the secret; the plaintext
+// is handed to the user once, when the key is generated.
+type BasicAuthPlugin struct {
+	config *basicConfig
+	// fingerprints of credentials that have passed bcrypt before, and until
+	// when they are remembered
+	mu       sync.Mutex
+	verified map[[sha256.Size]byte]time.Time
+}
+
+var availableTypes = []apiplexy.KeyType{
+	{Name: "BASIC", Description: "A key ID and secret, sent with every request as HTTP Basic auth."},
+}
+
+func (p *BasicAuthPlugin) AvailableTypes() []apiplexy.KeyType {
+	return availableTypes
+}
+
+func (p *BasicAuthPlugin) Generate(keyType string) (key apiplexy.Key, err error) {
+	if keyType != "BASIC" {
+		return apiplexy.Key{}, fmt.Errorf("Unknown key type: %s", keyType)
+	}
+	b := make([]byte, 32)
+	if _, err := rand.Read(b); err != nil {
+		return apiplexy.Key{}, err
+	}
+	secret := base64.RawURLEncoding.EncodeToString(b)
+	hash, err := bcrypt.GenerateFromPassword([]byte(secret), p.config.Cost)
+	if err != nil {
+		return apiplexy.Key{}, err
+	}
+	return apiplexy.Key{
+		ID:    uniuri.NewLen(24),
+		Type:  "BASIC",
+		Data:  map[string]interface{}{"secret_hash": string(hash)},
+		Token: secret,
+	}, nil
+}
+
+func (p *BasicAuthPlugin) Detect(req *http.Request, ctx *apiplexy.APIContext) (maybeKey string, keyType string, bits map[string]interface{}, err error) {
+	id, secret, ok := req.BasicAuth()
+	if !ok || id == "" {
+		return "", "", nil, nil
+	}
+	return id, "BASIC", map[string]interface{}{"secret": secret}, nil
+}
+
+// VerifySecret compares a secret with the key's bcrypt hash, which takes
+// constant time. As bcrypt is slow on purpose, credentials that have passed
+// are remembered for a while (by a SHA-256 fingerprint) if cache_verified is
+// on.
+func (p *BasicAuthPlugin) VerifySecret(key *apiplexy.Key, secret string) bool {
+	hash, _ := key.Data["secret_hash"].(string)
+	if key.Type != "BASIC" || hash == "" || secret == "" {
+		return false
+	}
+	fingerprint := sha256.Sum256([]byte(hash + "\x00" + secret))
+	if p.config.CacheVerified {
+		if p.remembered(fingerprint) {
+			return true
+		}
+	}
+	if bcrypt.CompareHashAndPassword([]byte(hash), []byte(secret)) != nil {
+		return false
+	}
+	if p.config.CacheVerified {
+		p.remember(fingerprint)
+	}
+	return true
+}
+
+func (p *BasicAuthPlugin) remembered(fingerprint [sha256.Size]byte) bool {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	expires, ok := p.verified[fingerprint]
+	if ok && !time.Now().Before(expires) {
+		delete(p.verified, fingerprint)
+		return false
+	}
+	return ok
+}
+
+// remember holds on to verified credentials for cache_ttl. Once cache_size
+// credentials are remembered, expired ones are dropped to make room, and if
+// that isn't enough, arbitrary others.
+func (p *BasicAuthPlugin) remember(fingerprint [sha256.Size]byte) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	now := time.Now()
+	if len(p.verified) >= p.config.CacheSize {
+		for f, expires := range p.verified {
+			if !now.Before(expires) {
+				delete(p.verified, f)
+			}
+		}
+	}
+	for f := range p.verified {
+		if len(p.verified) < p.config.CacheSize {
+			break
+		}
+		delete(p.verified, f)
+	}
+	p.verified[fingerprint] = now.Add(p.config.CacheTTL)
+}
+
+func (p *BasicAuthPlugin) Validate(key *apiplexy.Key, req *http.Request, ctx *apiplexy.APIContext, bits map[string]interface{}) (isValid bool, err error) {
+	secret, _ := bits["secret"].(string)
+	if !p.VerifySecret(key, secret) {
+		return false, nil
+	}
+	if p.config.Strip {
+		auth := req.Header.Get("Authorization")
+		if len(auth) >= 6 && strings.EqualFold(auth[:6], "Basic ") {
+			req.Header.Del("Authorization")
+		}
+	}
+	return true, nil
+}
+
+func (p *BasicAuthPlugin) ConfigStruct() interface{} {
+	return &basicConfig{}
+}
+
+func (p *BasicAuthPlugin) ConfigureTyped(config interface{}) error {
+	p.config = config.(*basicConfig)
+	p.verified = make(map[[sha256.Size]byte]time.Time)
+	return nil
+}
+
+func (p *BasicAuthPlugin) DefaultConfig() map[string]interface{} {
+	return apiplexy.TypedDefaultConfig(p)
+}
+
+func (p *BasicAuthPlugin) Configure(config map[string]interface{}) error {
+	return apiplexy.TypedConfigure(p, config)
+}
+
+func init() {
+	// _ = apiplexy.SecretVerifyingAuthPlugin(&BasicAuthPlugin{})
+	apiplexy.RegisterPlugin(
+		"basic",
+		"Authenticate requests by HTTP Basic auth, with bcrypt-hashed key secrets.",
+		"https://github.com/12foo/apiplexy/tree/master/auth/basic",
+		BasicAuthPlugin{},
+	)
+}
@@ -0,0 +1,113 @@
+package basic
+
+import (
+	"crypto/sha256"
+	"github.com/12foo/apiplexy"
+	. "github.com/smartystreets/goconvey/convey"
+	"net/http"
+	"testing"
+	"time"
+)
+
+func configured(config map[string]interface{}) *BasicAuthPlugin {
+	p := &BasicAuthPlugin{}
+	if config == nil {
+		config = map[string]interface{}{}
+	}
+	// keep the tests fast
+	config["cost"] = 4
+	if err := p.Configure(config); err != nil {
+		panic(err)
+	}
+	return p
+}
+
+func TestConfigure(t *testing.T) {
+	Convey("Plugin should configure with its default configuration", t, func() {
+		p := &BasicAuthPlugin{}
+		So(p.Configure(p.DefaultConfig()), ShouldBeNil)
+		So(p.config.Cost, ShouldEqual, 10)
+	})
+}
+
+func TestGeneration(t *testing.T) {
+	Convey("Generated keys should only store a hash of their secret", t, func() {
+		p := configured(nil)
+		key, err := p.Generate("BASIC")
+		So(err, ShouldBeNil)
+		So(key.ID, ShouldNotBeBlank)
+		So(len(key.Token), ShouldBeGreaterThan, 40)
+		So(key.Data["secret_hash"], ShouldStartWith, "$2a$04$")
+		So(key.Data["secret_hash"], ShouldNotContainSubstring, key.Token)
+
+		_, err = p.Generate("HMAC")
+		So(err, ShouldNotBeNil)
+	})
+}
+
+func TestValidation(t *testing.T) {
+	ctx := apiplexy.APIContext{}
+
+	for _, cache := range []bool{false, true} {
+		p := configured(map[string]interface{}{"cache_verified": cache})
+		key, _ := p.Generate("BASIC")
+
+		Convey("Basic auth with the key ID and secret should validate, and be stripped", t, func() {
+			for i := 0; i < 2; i++ {
+				req, _ := http.NewRequest("GET", "http://example.com/things", nil)
+				req.SetBasicAuth(key.ID, key.Token)
+				kid, ktype, bits, err := p.Detect(req, &ctx)
+				So(err, ShouldBeNil)
+				So(kid, ShouldEqual, key.ID)
+				So(ktype, ShouldEqual, "BASIC")
+
+				valid, err := p.Validate(&key, req, &ctx, bits)
+				So(err, ShouldBeNil)
+				So(valid, ShouldBeTrue)
+				So(req.Header.Get("Authorization"), ShouldBeBlank)
+			}
+		})
+
+		Convey("A wrong secret should not validate", t, func() {
+			req, _ := http.NewRequest("GET", "http://example.com/things", nil)
+			req.SetBasicAuth(key.ID, "wrong-secret")
+			_, _, bits, _ := p.Detect(req, &ctx)
+			valid, err := p.Validate(&key, req, &ctx, bits)
+			So(err, ShouldBeNil)
+			So(valid, ShouldBeFalse)
+			So(p.VerifySecret(&key, ""), ShouldBeFalse)
+			So(p.VerifySecret(&apiplexy.Key{Type: "BASIC"}, key.Token), ShouldBeFalse)
+		})
+	}
+
+	Convey("Requests without basic auth should be ignored", t, func() {
+		p := configured(nil)
+		req, _ := http.NewRequest("GET", "http://example.com/things", nil)
+		req.Header.Set("Authorization", "Bearer abc")
+		kid, _, _, err := p.Detect(req, &ctx)
+		So(err, ShouldBeNil)
+		So(kid, ShouldBeBlank)
+	})
+}
+
+func TestVerifiedCache(t *testing.T) {
+	Convey("Verified credentials should only be remembered up to cache_size", t, func() {
+		p := configured(map[string]interface{}{"cache_size": 2})
+		for i := 0; i < 5; i++ {
+			key, _ := p.Generate("BASIC")
+			So(p.VerifySecret(&key, key.Token), ShouldBeTrue)
+			So(len(p.verified), ShouldBeLessThanOrEqualTo, 2)
+		}
+	})
+
+	Convey("Verified credentials should be forgotten after cache_ttl", t, func() {
+		p := configured(nil)
+		key, _ := p.Generate("BASIC")
+		So(p.VerifySecret(&key, key.Token), ShouldBeTrue)
+		fingerprint := sha256.Sum256([]byte(key.Data["secret_hash"].(string) + "\x00" + key.Token))
+		So(p.remembered(fingerprint), ShouldBeTrue)
+		p.verified[fingerprint] = time.Now().Add(-time.Second)
+		So(p.remembered(fingerprint), ShouldBeFalse)
+		So(p.verified, ShouldBeEmpty)
+	})
+}
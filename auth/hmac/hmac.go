@@ -1,21 +1,60 @@
 package hmac
 
 import (
+	"bytes"
 	"crypto/hmac"
 	"crypto/sha1"
+	"crypto/sha256"
+	"crypto/sha512"
 	"encoding/base64"
 	"fmt"
 	"github.com/12foo/apiplexy"
 	"github.com/satori/go.uuid"
+	"hash"
+	"io/ioutil"
 	"net/http"
 	"strings"
+	"time"
 )
 
+type hmacConfig struct {
+	Algorithms       []string      `config:"algorithms" default:"hmac-sha256,hmac-sha512" enum:"hmac-sha1,hmac-sha256,hmac-sha512"`
+	RequiredHeaders  []string      `config:"required_headers" default:"(request-target),date"`
+	RequireDigest    bool          `config:"require_digest" default:"true"`
+	ClockSkew        time.Duration `config:"clock_skew" default:"5m" min:"0s"`
+	ReplayProtection bool          `config:"replay_protection" default:"false"`
+}
+
+// HMACAuthPlugin authenticates requests signed according to the HTTP
+// Signatures scheme (draft-cavage-http-signatures), using a secret shared
+// between apiplexy and the key's owner:
+//
+//  Authorization: Signature keyId="...",algorithm="hmac-sha256",headers="(request-target) date digest",signature="..."
+//
+// The signature is computed over the headers listed in the headers parameter.
+// If the request has a body, its Digest header must be signed too, and must
+// match the body.
+//
+// Signatures without a headers parameter are checked the way apiplexy always
+// did: over the bare value of the Date header (or the draft's "date: ..."),
+// with hmac-sha1 unless the algorithm parameter says otherwise.
 type HMACAuthPlugin struct {
+	config *hmacConfig
+}
+
+var hashes = map[string]func() hash.Hash{
+	"hmac-sha1":   sha1.New,
+	"hmac-sha256": sha256.New,
+	"hmac-sha512": sha512.New,
+}
+
+var digests = map[string]func() hash.Hash{
+	"sha-256": sha256.New,
+	"sha-512": sha512.New,
 }
 
 var availableTypes = []apiplexy.KeyType{
-	{Name: "HMAC", Description: "HMAC-based request signing using the HTTP Date header."},
+	{Name: "HMAC", Description: "HMAC-based request signing (HTTP Signatures)."},
 }
 
 func (auth *HMACAuthPlugin) AvailableTypes() []apiplexy.KeyType {
@@ -27,7 +66,7 @@ func (auth *HMACAuthPlugin) Generate(keyType string) (key apiplexy.Key, err erro
 		return apiplexy.Key{}, fmt.Errorf("Unknown key type: %s", keyType)
 	}
 	data := map[string]interface{}{
-		"secret": base64.StdEncoding.EncodeToString(uuid.NewV4().Bytes()),
+		"secret": newSecret(),
 	}
 	k := apiplexy.Key{
 		ID:   base64.StdEncoding.EncodeToString(uuid.NewV4().Bytes()),
@@ -37,6 +76,25 @@ func (auth *HMACAuthPlugin) Generate(keyType string) (key apiplexy.Key, err erro
 	return k, nil
 }
 
+func newSecret() string {
+	return base64.StdEncoding.EncodeToString(uuid.NewV4().Bytes())
+}
+
+// secrets returns the key's current secret, and the previous one while it is
+// still within its grace period after a rotation.
+func secrets(key *apiplexy.Key) []string {
+	s := []string{}
+	if secret, _ := key.Data["secret"].(string); secret != "" {
+		s = append(s, secret)
+	}
+	previous, _ := key.Data["previous_secret"].(string)
+	until, _ := key.Data["previous_secret_expires"].(float64)
+	if previous != "" && time.Now().Before(time.Unix(int64(until), 0)) {
+		s = append(s, previous)
+	}
+	return s
+}
+
 func (auth *HMACAuthPlugin) Detect(req *http.Request, ctx *apiplexy.APIContext) (maybeKey string, keyType string, bits map[string]interface{}, err error) {
 	if !strings.HasPrefix(req.Header.Get("Authorization"), "Signature ") {
 		return "", "", nil, nil
@@ -44,10 +102,11 @@ func (auth *HMACAuthPlugin) Detect(req *http.Request, ctx *apiplexy.APIContext)
 	sigParts := strings.Split(strings.TrimPrefix(req.Header.Get("Authorization"), "Signature "), ",")
 	sig := make(map[string]interface{}, len(sigParts))
 	for _, part := range sigParts {
-		p := strings.SplitN(part, "=", 2)
-		p[1] = strings.TrimLeft(p[1], "\" ")
-		p[1] = strings.TrimRight(p[1], "\" ")
-		sig[p[0]] = p[1]
+		p := strings.SplitN(strings.TrimSpace(part), "=", 2)
+		if len(p) != 2 {
+			continue
+		}
+		sig[p[0]] = strings.Trim(p[1], "\" ")
 	}
 	if sig["keyId"] == nil || sig["signature"] == nil {
 		return "", "", nil, nil
@@ -55,27 +114,252 @@ func (auth *HMACAuthPlugin) Detect(req *http.Request, ctx *apiplexy.APIContext)
 	return sig["keyId"].(string), "HMAC", sig, nil
 }
 
+// signingString builds the string to sign from the listed headers, in order.
+// The request target is taken from the request line as the client sent it, as
+// req.URL would escape the path its own way.
+func signingString(req *http.Request, headers []string) (string, error) {
+	lines := make([]string, len(headers))
+	for i, h := range headers {
+		var value string
+		switch h {
+		case "(request-target)":
+			target := req.RequestURI
+			if target == "" {
+				target = req.URL.RequestURI()
+			}
+			value = strings.ToLower(req.Method) + " " + target
+		case "host":
+			value = req.Host
+		default:
+			values, ok := req.Header[http.CanonicalHeaderKey(h)]
+			if !ok {
+				return "", fmt.Errorf("The signed header '%s' is missing from the request.", h)
+			}
+			value = strings.Join(values, ", ")
+		}
+		lines[i] = h + ": " + strings.TrimSpace(value)
+	}
+	return strings.Join(lines, "\n"), nil
+}
+
+func (auth *HMACAuthPlugin) checkDate(req *http.Request) error {
+	if auth.config.ClockSkew <= 0 {
+		return nil
+	}
+	date, err := http.ParseTime(req.Header.Get("Date"))
+	if err != nil {
+		return apiplexy.Abort(403, "Access denied. Signed requests need a valid Date header.")
+	}
+	skew := time.Since(date)
+	if skew < 0 {
+		skew = -skew
+	}
+	if skew > auth.config.ClockSkew {
+		return apiplexy.Abort(403, fmt.Sprintf("Access denied. The request's Date is more than %s off.", auth.config.ClockSkew))
+	}
+	return nil
+}
+
+// checkDigest verifies the Digest header (e.g. "SHA-256=<base64>") against
+// the request body. Every digest in the header that apiplexy knows must match.
+func (auth *HMACAuthPlugin) checkDigest(req *http.Request, headers []string) error {
+	var body []byte
+	if req.Body != nil {
+		b, err := ioutil.ReadAll(req.Body)
+		if err != nil {
+			return err
+		}
+		req.Body.Close()
+		req.Body = ioutil.NopCloser(bytes.NewReader(b))
+		body = b
+	}
+	header := req.Header.Get("Digest")
+	if header == "" {
+		if len(body) > 0 && auth.config.RequireDigest {
+			return apiplexy.Abort(403, "Access denied. Requests with a body need a signed Digest header.")
+		}
+		return nil
+	}
+	if auth.config.RequireDigest && !containsString(headers, "digest") {
+		return apiplexy.Abort(403, "Access denied. The Digest header must be signed.")
+	}
+	checked := false
+	for _, d := range strings.Split(header, ",") {
+		p := strings.SplitN(strings.TrimSpace(d), "=", 2)
+		if len(p) != 2 {
+			continue
+		}
+		newHash, ok := digests[strings.ToLower(p[0])]
+		if !ok {
+			continue
+		}
+		h := newHash()
+		h.Write(body)
+		expected, err := base64.StdEncoding.DecodeString(p[1])
+		if err != nil || !hmac.Equal(h.Sum(nil), expected) {
+			return apiplexy.Abort(403, "Access denied. The Digest header does not match the request body.")
+		}
+		checked = true
+	}
+	if !checked {
+		return apiplexy.Abort(403, "Access denied. The Digest header must contain a SHA-256 or SHA-512 digest.")
+	}
+	return nil
+}
+
 func (auth *HMACAuthPlugin) Validate(key *apiplexy.Key, req *http.Request, ctx *apiplexy.APIContext, bits map[string]interface{}) (isValid bool, err error) {
-	mac := hmac.New(sha1.New, []byte(key.Data["secret"].(string)))
-	mac.Write([]byte(req.Header.Get("Date")))
-	sig, _ := base64.StdEncoding.DecodeString(bits["signature"].(string))
-	return hmac.Equal(mac.Sum(nil), sig), nil
+	keySecrets := secrets(key)
+	if len(keySecrets) == 0 {
+		return false, nil
+	}
+
+	algorithm, _ := bits["algorithm"].(string)
+	algorithm = strings.ToLower(algorithm)
+	if algorithm == "" {
+		algorithm = "hmac-sha1"
+	}
+	newHash, ok := hashes[algorithm]
+	if !ok || !containsString(auth.config.Algorithms, algorithm) {
+		return false, apiplexy.Abort(403, fmt.Sprintf("Access denied. Signature algorithm '%s' is not supported. Use one of: %s.", algorithm, strings.Join(auth.config.Algorithms, ", ")))
+	}
+
+	headers := []string{"date"}
+	h, _ := bits["headers"].(string)
+	legacy := h == ""
+	if !legacy {
+		headers = strings.Fields(strings.ToLower(h))
+	}
+	for _, required := range auth.config.RequiredHeaders {
+		if !containsString(headers, strings.ToLower(required)) {
+			return false, apiplexy.Abort(403, fmt.Sprintf("Access denied. The signature must cover '%s'.", required))
+		}
+	}
+
+	if err := auth.checkDate(req); err != nil {
+		return false, err
+	}
+	if err := auth.checkDigest(req, headers); err != nil {
+		return false, err
+	}
+
+	signings := []string{}
+	if legacy {
+		signings = append(signings, req.Header.Get("Date"))
+	}
+	signing, err := signingString(req, headers)
+	if err == nil {
+		signings = append(signings, signing)
+	} else if !legacy {
+		return false, apiplexy.Abort(403, "Access denied. "+err.Error())
+	}
+	sig, err := base64.StdEncoding.DecodeString(bits["signature"].(string))
+	if err != nil {
+		return false, nil
+	}
+	for _, secret := range keySecrets {
+		for _, signing := range signings {
+			mac := hmac.New(newHash, []byte(secret))
+			mac.Write([]byte(signing))
+			if hmac.Equal(mac.Sum(nil), sig) {
+				return true, nil
+			}
+		}
+	}
+	return false, nil
 }
 
-func (auth *HMACAuthPlugin) DefaultConfig() map[string]interface{} {
-	// TODO make location of HMAC signature configurable
+// Nonce makes every signature single-use if replay protection is on. A
+// signature stays valid while its Date is within the clock skew, which can be
+// off in either direction, so it is remembered for twice that long.
+func (auth *HMACAuthPlugin) Nonce(req *http.Request, bits map[string]interface{}) (string, time.Duration) {
+	if !auth.config.ReplayProtection {
+		return "", 0
+	}
+	sig, _ := bits["signature"].(string)
+	return sig, 2 * auth.config.ClockSkew
+}
+
+// VerifySecret lets clients exchange their key's ID and secret for an OAuth2
+// access token, instead of signing every request.
+func (auth *HMACAuthPlugin) VerifySecret(key *apiplexy.Key, secret string) bool {
+	if key.Type != "HMAC" {
+		return false
+	}
+	for _, stored := range secrets(key) {
+		if hmac.Equal([]byte(stored), []byte(secret)) {
+			return true
+		}
+	}
+	return false
+}
+
+// Rotate gives the key a new secret. The previous secret stays valid until
+// the grace period is over, so clients can switch over without downtime.
+func (auth *HMACAuthPlugin) Rotate(key *apiplexy.Key, grace time.Duration) error {
+	if key.Type != "HMAC" {
+		return fmt.Errorf("Unknown key type: %s", key.Type)
+	}
+	if key.Data == nil {
+		key.Data = make(map[string]interface{})
+	}
+	if previous, _ := key.Data["secret"].(string); previous != "" && grace > 0 {
+		key.Data["previous_secret"] = previous
+		// stored as a number, like it comes back from the backend's JSON
+		key.Data["previous_secret_expires"] = float64(time.Now().Add(grace).Unix())
+	} else {
+		delete(key.Data, "previous_secret")
+		delete(key.Data, "previous_secret_expires")
+	}
+	key.Data["secret"] = newSecret()
 	return nil
 }
 
-func (auth *HMACAuthPlugin) Configure(config map[string]interface{}) error {
+func containsString(list []string, s string) bool {
+	for _, item := range list {
+		if item == s {
+			return true
+		}
+	}
+	return false
+}
+
+func (auth *HMACAuthPlugin) ConfigStruct() interface{} {
+	return &hmacConfig{}
+}
+
+func (auth *HMACAuthPlugin) ConfigureTyped(config interface{}) error {
+	c := config.(*hmacConfig)
+	if c.ReplayProtection && c.ClockSkew <= 0 {
+		return fmt.Errorf("Replay protection needs a clock_skew, so signatures expire.")
+	}
+	signsDate := false
+	for i, h := range c.RequiredHeaders {
+		c.RequiredHeaders[i] = strings.ToLower(h)
+		signsDate = signsDate || c.RequiredHeaders[i] == "date"
+	}
+	// an unsigned Date could simply be updated on a captured request
+	if c.ClockSkew > 0 && !signsDate {
+		return fmt.Errorf("A clock_skew needs 'date' in required_headers, so clients can't change the Date.")
+	}
+	auth.config = c
 	return nil
 }
 
+func (auth *HMACAuthPlugin) DefaultConfig() map[string]interface{} {
+	return apiplexy.TypedDefaultConfig(auth)
+}
+
+func (auth *HMACAuthPlugin) Configure(config map[string]interface{}) error {
+	return apiplexy.TypedConfigure(auth, config)
+}
+
 func init() {
-	// _ = apiplexy.AuthPlugin(&HMACAuthPlugin{})
+	// _ = apiplexy.SingleUseAuthPlugin(&HMACAuthPlugin{})
+	// _ = apiplexy.SecretVerifyingAuthPlugin(&HMACAuthPlugin{})
+	// _ = apiplexy.RotatingAuthPlugin(&HMACAuthPlugin{})
 	apiplexy.RegisterPlugin(
 		"hmac",
-		"Authenticate requests via HMAC.",
+		"Authenticate requests signed with HTTP Signatures (HMAC).",
 		"https://github.com/12foo/apiplexy/tree/master/auth/hmac",
 		HMACAuthPlugin{},
 	)
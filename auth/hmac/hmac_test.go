@@ -1,19 +1,49 @@
 package hmac
 
 import (
+	"bufio"
 	"bytes"
 	ghmac "crypto/hmac"
 	"crypto/sha1"
+	"crypto/sha256"
+	"crypto/sha512"
 	"encoding/base64"
 	"fmt"
 	"github.com/12foo/apiplexy"
 	. "github.com/smartystreets/goconvey/convey"
+	"hash"
 	"net/http"
+	"strings"
 	"testing"
+	"time"
 )
 
 var keys = make(map[string]apiplexy.Key)
 
+func configured() *HMACAuthPlugin {
+	p := &HMACAuthPlugin{}
+	if err := p.Configure(p.DefaultConfig()); err != nil {
+		panic(err)
+	}
+	return p
+}
+
+// legacyConfigured accepts clients of the original signature format, which
+// didn't send a Date at all.
+func legacyConfigured() *HMACAuthPlugin {
+	p := &HMACAuthPlugin{}
+	err := p.Configure(map[string]interface{}{
+		"algorithms":       []interface{}{"hmac-sha1"},
+		"required_headers": []interface{}{"date"},
+		"require_digest":   false,
+		"clock_skew":       "0s",
+	})
+	if err != nil {
+		panic(err)
+	}
+	return p
+}
+
 func TestConfigure(t *testing.T) {
 	Convey("Plugin should not panic when configuring with default configuration", t, func() {
 		So(func() {
@@ -35,6 +65,20 @@ func TestGeneration(t *testing.T) {
 	})
 }
 
+// sign signs a request the way a client would: over the given headers, with
+// a Digest of the body if there is one.
+func sign(req *http.Request, body []byte, key apiplexy.Key, algorithm string, newHash func() hash.Hash, headers string) {
+	if len(body) > 0 {
+		d := sha256.Sum256(body)
+		req.Header.Set("Digest", "SHA-256="+base64.StdEncoding.EncodeToString(d[:]))
+	}
+	signing, _ := signingString(req, strings.Fields(headers))
+	mac := ghmac.New(newHash, []byte(key.Data["secret"].(string)))
+	mac.Write([]byte(signing))
+	sig := base64.StdEncoding.EncodeToString(mac.Sum(nil))
+	req.Header.Set("Authorization", fmt.Sprintf("Signature keyId=\"%s\",algorithm=\"%s\",headers=\"%s\",signature=\"%s\"", key.ID, algorithm, headers, sig))
+}
+
 func dummyRequest(ktype string) *http.Request {
 	req, _ := http.NewRequest("GET", "http://dummy-request.com", bytes.NewReader([]byte{}))
 	key := keys[ktype]
@@ -49,7 +93,7 @@ func dummyRequest(ktype string) *http.Request {
 }
 
 func TestValidation(t *testing.T) {
-	hmac := HMACAuthPlugin{}
+	hmac := legacyConfigured()
 	ctx := apiplexy.APIContext{}
 
 	for _, kt := range hmac.AvailableTypes() {
@@ -70,3 +114,228 @@ func TestValidation(t *testing.T) {
 		})
 	}
 }
+
+func TestSignatures(t *testing.T) {
+	hmac := configured()
+	ctx := apiplexy.APIContext{}
+	key := keys["HMAC"]
+
+	validate := func(req *http.Request) (bool, error) {
+		_, _, bits, _ := hmac.Detect(req, &ctx)
+		return hmac.Validate(&key, req, &ctx, bits)
+	}
+	newRequest := func(method, body string) *http.Request {
+		req, _ := http.NewRequest(method, "http://dummy-request.com/some/path?q=1", bytes.NewReader([]byte(body)))
+		req.Header.Set("Date", time.Now().UTC().Format(http.TimeFormat))
+		return req
+	}
+
+	Convey("Signed bodies should be valid", t, func() {
+		body := `{"hello":"world"}`
+		req := newRequest("POST", body)
+		sign(req, []byte(body), key, "hmac-sha256", sha256.New, "(request-target) date digest")
+		valid, err := validate(req)
+		So(err, ShouldBeNil)
+		So(valid, ShouldBeTrue)
+	})
+
+	Convey("Signatures in the original format should be rejected by default", t, func() {
+		req := dummyRequest("HMAC")
+		_, err := validate(req)
+		So(err, ShouldNotBeNil)
+	})
+
+	Convey("Signatures over the request target and date should be valid", t, func() {
+		req := newRequest("GET", "")
+		sign(req, nil, key, "hmac-sha256", sha256.New, "(request-target) date")
+		valid, err := validate(req)
+		So(err, ShouldBeNil)
+		So(valid, ShouldBeTrue)
+	})
+
+	Convey("hmac-sha512 signatures should be valid", t, func() {
+		req := newRequest("GET", "")
+		sign(req, nil, key, "hmac-sha512", sha512.New, "(request-target) host date")
+		valid, err := validate(req)
+		So(err, ShouldBeNil)
+		So(valid, ShouldBeTrue)
+	})
+
+	Convey("The request target should be signed as it was sent", t, func() {
+		raw := "GET /some/a|b?q=1 HTTP/1.1\r\nHost: dummy-request.com\r\nDate: " + time.Now().UTC().Format(http.TimeFormat) + "\r\n\r\n"
+		req, err := http.ReadRequest(bufio.NewReader(strings.NewReader(raw)))
+		So(err, ShouldBeNil)
+		So(req.URL.RequestURI(), ShouldNotEqual, "/some/a|b?q=1")
+		signing := "(request-target): get /some/a|b?q=1\ndate: " + req.Header.Get("Date")
+		mac := ghmac.New(sha256.New, []byte(key.Data["secret"].(string)))
+		mac.Write([]byte(signing))
+		req.Header.Set("Authorization", fmt.Sprintf("Signature keyId=\"%s\",algorithm=\"hmac-sha256\",headers=\"(request-target) date\",signature=\"%s\"", key.ID, base64.StdEncoding.EncodeToString(mac.Sum(nil))))
+		valid, err := validate(req)
+		So(err, ShouldBeNil)
+		So(valid, ShouldBeTrue)
+	})
+
+	Convey("A different request target should invalidate the signature", t, func() {
+		req := newRequest("GET", "")
+		sign(req, nil, key, "hmac-sha256", sha256.New, "(request-target) date")
+		req.URL.Path = "/other/path"
+		valid, err := validate(req)
+		So(err, ShouldBeNil)
+		So(valid, ShouldBeFalse)
+	})
+
+	Convey("Signatures must cover the required headers", t, func() {
+		req := newRequest("GET", "")
+		sign(req, nil, key, "hmac-sha256", sha256.New, "date")
+		_, err := validate(req)
+		So(err, ShouldNotBeNil)
+	})
+
+	Convey("SHA-1 should be rejected unless configured", t, func() {
+		req := newRequest("GET", "")
+		sign(req, nil, key, "hmac-sha1", sha1.New, "(request-target) date")
+		_, err := validate(req)
+		So(err, ShouldNotBeNil)
+	})
+
+	Convey("Requests outside the clock skew window should be rejected", t, func() {
+		req := newRequest("GET", "")
+		req.Header.Set("Date", time.Now().Add(-10*time.Minute).UTC().Format(http.TimeFormat))
+		sign(req, nil, key, "hmac-sha256", sha256.New, "(request-target) date")
+		_, err := validate(req)
+		So(err, ShouldNotBeNil)
+	})
+
+	Convey("Bodies must match their signed digest", t, func() {
+		req := newRequest("POST", `{"amount":1}`)
+		sign(req, []byte(`{"amount":1000}`), key, "hmac-sha256", sha256.New, "(request-target) date digest")
+		_, err := validate(req)
+		So(err, ShouldNotBeNil)
+	})
+
+	Convey("Bodies without a digest should be rejected", t, func() {
+		req := newRequest("POST", `{"amount":1}`)
+		sign(req, nil, key, "hmac-sha256", sha256.New, "(request-target) date")
+		_, err := validate(req)
+		So(err, ShouldNotBeNil)
+	})
+
+	Convey("The body should still be readable after validation", t, func() {
+		req := newRequest("POST", `{"amount":1}`)
+		sign(req, []byte(`{"amount":1}`), key, "hmac-sha256", sha256.New, "(request-target) date digest")
+		valid, err := validate(req)
+		So(err, ShouldBeNil)
+		So(valid, ShouldBeTrue)
+		b := new(bytes.Buffer)
+		b.ReadFrom(req.Body)
+		So(b.String(), ShouldEqual, `{"amount":1}`)
+	})
+}
+
+func TestLegacySignatures(t *testing.T) {
+	hmac := legacyConfigured()
+	ctx := apiplexy.APIContext{}
+	key := keys["HMAC"]
+
+	Convey("Original signatures without an algorithm should be taken as hmac-sha1", t, func() {
+		req, _ := http.NewRequest("GET", "http://dummy-request.com/some/path", nil)
+		req.Header.Set("Date", time.Now().UTC().Format(http.TimeFormat))
+		mac := ghmac.New(sha1.New, []byte(key.Data["secret"].(string)))
+		mac.Write([]byte(req.Header.Get("Date")))
+		req.Header.Set("Authorization", fmt.Sprintf("Signature keyId=\"%s\",signature=\"%s\"", key.ID, base64.StdEncoding.EncodeToString(mac.Sum(nil))))
+		_, _, bits, _ := hmac.Detect(req, &ctx)
+		valid, err := hmac.Validate(&key, req, &ctx, bits)
+		So(err, ShouldBeNil)
+		So(valid, ShouldBeTrue)
+
+		req.Header.Set("Date", time.Now().Add(time.Hour).UTC().Format(http.TimeFormat))
+		valid, _ = hmac.Validate(&key, req, &ctx, bits)
+		So(valid, ShouldBeFalse)
+	})
+}
+
+func TestSecretVerification(t *testing.T) {
+	Convey("Keys should only verify with their own secret", t, func() {
+		hmac := configured()
+		key := keys["HMAC"]
+		So(hmac.VerifySecret(&key, key.Data["secret"].(string)), ShouldBeTrue)
+		So(hmac.VerifySecret(&key, "not-the-secret"), ShouldBeFalse)
+		So(hmac.VerifySecret(&apiplexy.Key{Type: "HMAC"}, ""), ShouldBeFalse)
+	})
+}
+
+func TestRotation(t *testing.T) {
+	hmac := configured()
+	ctx := apiplexy.APIContext{}
+
+	signedWith := func(key apiplexy.Key) (*http.Request, map[string]interface{}) {
+		req, _ := http.NewRequest("GET", "http://dummy-request.com/some/path", nil)
+		req.Header.Set("Date", time.Now().UTC().Format(http.TimeFormat))
+		sign(req, nil, key, "hmac-sha256", sha256.New, "(request-target) date")
+		_, _, bits, _ := hmac.Detect(req, &ctx)
+		return req, bits
+	}
+
+	Convey("Both secrets should work during the grace period", t, func() {
+		key, _ := hmac.Generate("HMAC")
+		old := key
+		old.Data = map[string]interface{}{"secret": key.Data["secret"]}
+		So(hmac.Rotate(&key, time.Hour), ShouldBeNil)
+		So(key.Data["secret"], ShouldNotEqual, old.Data["secret"])
+		So(key.Data["previous_secret"], ShouldEqual, old.Data["secret"])
+
+		req, bits := signedWith(key)
+		valid, err := hmac.Validate(&key, req, &ctx, bits)
+		So(err, ShouldBeNil)
+		So(valid, ShouldBeTrue)
+		req, bits = signedWith(old)
+		valid, err = hmac.Validate(&key, req, &ctx, bits)
+		So(err, ShouldBeNil)
+		So(valid, ShouldBeTrue)
+		So(hmac.VerifySecret(&key, old.Data["secret"].(string)), ShouldBeTrue)
+	})
+
+	Convey("The previous secret should stop working after the grace period", t, func() {
+		key, _ := hmac.Generate("HMAC")
+		old := key
+		old.Data = map[string]interface{}{"secret": key.Data["secret"]}
+		hmac.Rotate(&key, time.Hour)
+		key.Data["previous_secret_expires"] = float64(time.Now().Add(-time.Minute).Unix())
+
+		req, bits := signedWith(old)
+		valid, _ := hmac.Validate(&key, req, &ctx, bits)
+		So(valid, ShouldBeFalse)
+		So(hmac.VerifySecret(&key, old.Data["secret"].(string)), ShouldBeFalse)
+
+		// without a grace period, the previous secret is dropped right away
+		hmac.Rotate(&key, 0)
+		So(key.Data, ShouldNotContainKey, "previous_secret")
+	})
+}
+
+func TestReplayProtection(t *testing.T) {
+	Convey("Signatures should only be single-use with replay protection on", t, func() {
+		hmac := configured()
+		bits := map[string]interface{}{"signature": "abc"}
+		nonce, _ := hmac.Nonce(nil, bits)
+		So(nonce, ShouldBeBlank)
+
+		hmac.config.ReplayProtection = true
+		nonce, ttl := hmac.Nonce(nil, bits)
+		So(nonce, ShouldEqual, "abc")
+		So(ttl, ShouldEqual, 10*time.Minute)
+	})
+
+	Convey("Replay protection should need a clock skew window", t, func() {
+		hmac := &HMACAuthPlugin{}
+		err := hmac.Configure(map[string]interface{}{"replay_protection": true, "clock_skew": "0s"})
+		So(err, ShouldNotBeNil)
+	})
+
+	Convey("A clock skew window should need a signed Date", t, func() {
+		hmac := &HMACAuthPlugin{}
+		So(hmac.Configure(map[string]interface{}{"required_headers": []interface{}{"(request-target)"}}), ShouldNotBeNil)
+		So(hmac.Configure(map[string]interface{}{"required_headers": []interface{}{"(request-target)", "Date"}}), ShouldBeNil)
+		So(hmac.Configure(map[string]interface{}{"required_headers": []interface{}{"(request-target)"}, "clock_skew": "0s"}), ShouldBeNil)
+	})
+}
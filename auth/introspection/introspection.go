@@ -0,0 +1,190 @@
+package introspection
+
+import (
+	"encoding/json"
+	"fmt"
+	"github.com/12foo/apiplexy"
+	"log"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+)
+
+type introspectionConfig struct {
+	Endpoint         string        `config:"endpoint" required:"true"`
+	ClientID         string        `config:"client_id"`
+	ClientSecret     string        `config:"client_secret"`
+	TokenTypeHint    string        `config:"token_type_hint" default:"access_token"`
+	Timeout          time.Duration `config:"timeout" default:"5s" min:"1ms"`
+	IDField          string        `config:"id_field" default:"client_id"`
+	QuotaField       string        `config:"quota_field"`
+	RealmField       string        `config:"realm_field"`
+	DataFields       []string      `config:"data_fields"`
+	CacheTTL         time.Duration `config:"cache_ttl" default:"0s" min:"0s"`
+	NegativeCacheTTL time.Duration `config:"negative_cache_ttl" default:"1m" min:"0s"`
+}
+
+// IntrospectionAuthPlugin authenticates requests by opaque OAuth2 access
+// tokens, which it checks with the authorization server's token introspection
+// endpoint (RFC 7662). The gateway caches the answers in Redis, so a token is
+// only introspected once until it expires.
+type IntrospectionAuthPlugin struct {
+	config *introspectionConfig
+	client *http.Client
+}
+
+var availableTypes = []apiplexy.KeyType{
+	{Name: "OAuth2", Description: "Bearer OAuth2 access tokens, issued by an external authorization server."},
+}
+
+func (p *IntrospectionAuthPlugin) AvailableTypes() []apiplexy.KeyType {
+	return availableTypes
+}
+
+func (p *IntrospectionAuthPlugin) Generate(keyType string) (key apiplexy.Key, err error) {
+	return apiplexy.Key{}, fmt.Errorf("OAuth2 tokens are issued by your authorization server, not by apiplexy.")
+}
+
+func (p *IntrospectionAuthPlugin) Detect(req *http.Request, ctx *apiplexy.APIContext) (maybeKey string, keyType string, bits map[string]interface{}, err error) {
+	auth := req.Header.Get("Authorization")
+	if len(auth) < 7 || !strings.EqualFold(auth[:7], "Bearer ") {
+		return "", "", nil, nil
+	}
+	token := strings.TrimSpace(auth[7:])
+	if token == "" {
+		return "", "", nil, nil
+	}
+	return token, "OAuth2", make(map[string]interface{}), nil
+}
+
+// introspect asks the authorization server about a token.
+func (p *IntrospectionAuthPlugin) introspect(token string) (map[string]interface{}, error) {
+	form := url.Values{"token": {token}}
+	if p.config.TokenTypeHint != "" {
+		form.Set("token_type_hint", p.config.TokenTypeHint)
+	}
+	req, err := http.NewRequest("POST", p.config.Endpoint, strings.NewReader(form.Encode()))
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	req.Header.Set("Accept", "application/json")
+	if p.config.ClientID != "" {
+		req.SetBasicAuth(url.QueryEscape(p.config.ClientID), url.QueryEscape(p.config.ClientSecret))
+	}
+	res, err := p.client.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer res.Body.Close()
+	if res.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("Introspection endpoint returned %s.", res.Status)
+	}
+	info := make(map[string]interface{})
+	if err := json.NewDecoder(res.Body).Decode(&info); err != nil {
+		return nil, err
+	}
+	return info, nil
+}
+
+// Resolve introspects the token and maps the answer onto a key: the client ID
+// (or whatever id_field names) becomes the key ID, the scope becomes the key's
+// scopes, and the client ID, scope and configured data fields go into the
+// key's data.
+func (p *IntrospectionAuthPlugin) Resolve(maybeKey string, keyType string, bits map[string]interface{}) (*apiplexy.Key, error) {
+	info, err := p.introspect(maybeKey)
+	if err != nil {
+		log.Printf("Could not introspect token at %s: %s\n", p.config.Endpoint, err.Error())
+		return nil, apiplexy.Abort(502, "Could not verify the access token with the authorization server.")
+	}
+	if active, _ := info["active"].(bool); !active {
+		return nil, nil
+	}
+	if exp, ok := info["exp"].(float64); ok {
+		expires := time.Unix(int64(exp), 0)
+		if !expires.After(time.Now()) {
+			return nil, nil
+		}
+		bits["expires"] = expires
+	}
+	id, _ := info[p.config.IDField].(string)
+	if id == "" {
+		return nil, nil
+	}
+	key := apiplexy.Key{
+		ID:   id,
+		Type: "OAuth2",
+		Data: make(map[string]interface{}),
+	}
+	for _, f := range append([]string{"client_id", "scope"}, p.config.DataFields...) {
+		if v, ok := info[f]; ok {
+			key.Data[f] = v
+		}
+	}
+	if scope, ok := info["scope"].(string); ok {
+		key.Scopes = strings.Fields(scope)
+	}
+	if p.config.QuotaField != "" {
+		key.Quota, _ = info[p.config.QuotaField].(string)
+	}
+	if p.config.RealmField != "" {
+		key.Realm, _ = info[p.config.RealmField].(string)
+	}
+	return &key, nil
+}
+
+// CacheTTL keeps active tokens cached until they expire (or for cache_ttl,
+// whichever is shorter), and inactive ones for negative_cache_ttl.
+func (p *IntrospectionAuthPlugin) CacheTTL(key *apiplexy.Key, bits map[string]interface{}) time.Duration {
+	if key == nil {
+		return p.config.NegativeCacheTTL
+	}
+	expires, ok := bits["expires"].(time.Time)
+	if !ok {
+		return p.config.CacheTTL
+	}
+	ttl := expires.Sub(time.Now())
+	if p.config.CacheTTL > 0 && p.config.CacheTTL < ttl {
+		ttl = p.config.CacheTTL
+	}
+	return ttl
+}
+
+func (p *IntrospectionAuthPlugin) Validate(key *apiplexy.Key, req *http.Request, ctx *apiplexy.APIContext, bits map[string]interface{}) (isValid bool, err error) {
+	return key.Type == "OAuth2", nil
+}
+
+func (p *IntrospectionAuthPlugin) ConfigStruct() interface{} {
+	return &introspectionConfig{}
+}
+
+func (p *IntrospectionAuthPlugin) ConfigureTyped(config interface{}) error {
+	c := config.(*introspectionConfig)
+	if _, err := url.ParseRequestURI(c.Endpoint); err != nil {
+		return fmt.Errorf("Invalid introspection endpoint: %s", err.Error())
+	}
+	p.config = c
+	p.client = &http.Client{Timeout: c.Timeout}
+	return nil
+}
+
+func (p *IntrospectionAuthPlugin) DefaultConfig() map[string]interface{} {
+	d := apiplexy.TypedDefaultConfig(p)
+	d["endpoint"] = "https://your-authorization-server/oauth2/introspect"
+	return d
+}
+
+func (p *IntrospectionAuthPlugin) Configure(config map[string]interface{}) error {
+	return apiplexy.TypedConfigure(p, config)
+}
+
+func init() {
+	// _ = apiplexy.CachingAuthPlugin(&IntrospectionAuthPlugin{})
+	apiplexy.RegisterPlugin(
+		"introspection",
+		"Authenticate requests by OAuth2 access tokens, checked by token introspection (RFC 7662).",
+		"https://github.com/12foo/apiplexy/tree/master/auth/introspection",
+		IntrospectionAuthPlugin{},
+	)
+}
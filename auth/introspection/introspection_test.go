@@ -0,0 +1,126 @@
+package introspection
+
+import (
+	"encoding/json"
+	"github.com/12foo/apiplexy"
+	. "github.com/smartystreets/goconvey/convey"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+// standIn is a local introspection endpoint that knows a few tokens.
+func standIn(tokens map[string]map[string]interface{}) *httptest.Server {
+	return httptest.NewServer(http.HandlerFunc(func(res http.ResponseWriter, req *http.Request) {
+		if id, secret, ok := req.BasicAuth(); !ok || id != "gateway" || secret != "s3cret" {
+			res.WriteHeader(http.StatusUnauthorized)
+			return
+		}
+		if req.Method != "POST" || req.PostFormValue("token_type_hint") != "access_token" {
+			res.WriteHeader(http.StatusBadRequest)
+			return
+		}
+		info, ok := tokens[req.PostFormValue("token")]
+		if !ok {
+			info = map[string]interface{}{"active": false}
+		}
+		res.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(res).Encode(info)
+	}))
+}
+
+func TestIntrospection(t *testing.T) {
+	expires := time.Now().Add(time.Hour).Unix()
+	server := standIn(map[string]map[string]interface{}{
+		"good-token": {
+			"active":    true,
+			"client_id": "partner-app",
+			"scope":     "read write",
+			"exp":       expires,
+			"plan":      "partner",
+			"tenant":    "acme",
+		},
+		"expired-token": {
+			"active":    true,
+			"client_id": "partner-app",
+			"exp":       time.Now().Add(-time.Minute).Unix(),
+		},
+		"revoked-token": {"active": false},
+	})
+	defer server.Close()
+
+	p := &IntrospectionAuthPlugin{}
+	err := p.Configure(map[string]interface{}{
+		"endpoint":      server.URL,
+		"client_id":     "gateway",
+		"client_secret": "s3cret",
+		"quota_field":   "plan",
+		"data_fields":   []interface{}{"tenant"},
+	})
+	ctx := apiplexy.APIContext{}
+
+	resolve := func(token string) (*apiplexy.Key, map[string]interface{}, error) {
+		req, _ := http.NewRequest("GET", "http://example.com/things", nil)
+		req.Header.Set("Authorization", "Bearer "+token)
+		maybeKey, keyType, bits, _ := p.Detect(req, &ctx)
+		key, err := p.Resolve(maybeKey, keyType, bits)
+		return key, bits, err
+	}
+
+	Convey("Plugin should configure with an introspection endpoint", t, func() {
+		So(err, ShouldBeNil)
+		So((&IntrospectionAuthPlugin{}).Configure(map[string]interface{}{"endpoint": "not a url"}), ShouldNotBeNil)
+	})
+
+	Convey("Active tokens should resolve to keys built from the introspection response", t, func() {
+		key, bits, err := resolve("good-token")
+		So(err, ShouldBeNil)
+		So(key, ShouldNotBeNil)
+		So(key.ID, ShouldEqual, "partner-app")
+		So(key.Type, ShouldEqual, "OAuth2")
+		So(key.Quota, ShouldEqual, "partner")
+		So(key.Data["scope"], ShouldEqual, "read write")
+		So(key.Data["tenant"], ShouldEqual, "acme")
+
+		valid, _ := p.Validate(key, nil, &ctx, bits)
+		So(valid, ShouldBeTrue)
+
+		Convey("and should be cached until they expire", func() {
+			ttl := p.CacheTTL(key, bits)
+			So(ttl, ShouldBeGreaterThan, 59*time.Minute)
+			So(ttl, ShouldBeLessThanOrEqualTo, time.Hour)
+
+			p.config.CacheTTL = 5 * time.Minute
+			So(p.CacheTTL(key, bits), ShouldEqual, 5*time.Minute)
+			p.config.CacheTTL = 0
+		})
+	})
+
+	Convey("Inactive and expired tokens should be rejected, and cached as such", t, func() {
+		for _, token := range []string{"revoked-token", "expired-token", "unknown-token"} {
+			key, bits, err := resolve(token)
+			So(err, ShouldBeNil)
+			So(key, ShouldBeNil)
+			So(p.CacheTTL(key, bits), ShouldEqual, time.Minute)
+		}
+	})
+
+	Convey("Failing to reach the introspection endpoint should not reject the token", t, func() {
+		p.config.ClientSecret = "wrong"
+		key, bits, err := resolve("good-token")
+		p.config.ClientSecret = "s3cret"
+		So(key, ShouldBeNil)
+		So(err, ShouldNotBeNil)
+		So(err.(apiplexy.AbortRequest).Status, ShouldEqual, 502)
+		So(bits, ShouldBeEmpty)
+	})
+
+	Convey("Requests without a bearer token should be ignored", t, func() {
+		req, _ := http.NewRequest("GET", "http://example.com/things", nil)
+		req.Header.Set("Authorization", "Basic Zm9vOmJhcg==")
+		maybeKey, _, _, err := p.Detect(req, &ctx)
+		So(err, ShouldBeNil)
+		So(maybeKey, ShouldBeBlank)
+	})
+}
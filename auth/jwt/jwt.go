@@ -0,0 +1,249 @@
+package jwt
+
+import (
+	"context"
+	"crypto/ecdsa"
+	"crypto/rsa"
+	"fmt"
+	"github.com/12foo/apiplexy"
+	jwtgo "github.com/dgrijalva/jwt-go"
+	"log"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+)
+
+type jwtConfig struct {
+	JWKS       string        `config:"jwks" required:"true"`
+	Refresh    time.Duration `config:"refresh" default:"1h" min:"0s"`
+	Algorithms []string      `config:"algorithms" default:"RS256,ES256" enum:"RS256,RS384,RS512,ES256,ES384,ES512"`
+	Issuer     string        `config:"issuer"`
+	Audience   string        `config:"audience"`
+	IDClaim    string        `config:"id_claim" default:"sub"`
+	QuotaClaim string        `config:"quota_claim"`
+	RealmClaim string        `config:"realm_claim"`
+	ScopeClaim string        `config:"scope_claim" default:"scope"`
+	DataClaims []string      `config:"data_claims"`
+}
+
+// JWTAuthPlugin authenticates requests by bearer JWTs issued by your own
+// identity provider. Tokens are verified against the provider's public keys
+// (a JWKS file or URL), and the key is built straight from the token's
+// claims, so no backend is involved.
+type JWTAuthPlugin struct {
+	config *jwtConfig
+	mu     sync.RWMutex
+	keys   map[string]interface{}
+}
+
+var availableTypes = []apiplexy.KeyType{
+	{Name: "JWT", Description: "Bearer JSON Web Tokens, issued by an external identity provider."},
+}
+
+func (p *JWTAuthPlugin) AvailableTypes() []apiplexy.KeyType {
+	return availableTypes
+}
+
+func (p *JWTAuthPlugin) Generate(keyType string) (key apiplexy.Key, err error) {
+	return apiplexy.Key{}, fmt.Errorf("JWTs are issued by your identity provider, not by apiplexy.")
+}
+
+func (p *JWTAuthPlugin) Detect(req *http.Request, ctx *apiplexy.APIContext) (maybeKey string, keyType string, bits map[string]interface{}, err error) {
+	auth := req.Header.Get("Authorization")
+	if len(auth) < 7 || !strings.EqualFold(auth[:7], "Bearer ") {
+		return "", "", nil, nil
+	}
+	token := strings.TrimSpace(auth[7:])
+	if strings.Count(token, ".") != 2 {
+		return "", "", nil, nil
+	}
+	return token, "JWT", nil, nil
+}
+
+// keyFunc picks the verification key for a token by its key ID, making sure
+// the token's algorithm is allowed and fits the key.
+func (p *JWTAuthPlugin) keyFunc(token *jwtgo.Token) (interface{}, error) {
+	alg := token.Method.Alg()
+	if !contains(p.config.Algorithms, alg) {
+		return nil, fmt.Errorf("Signing algorithm %s is not allowed.", alg)
+	}
+	kid, _ := token.Header["kid"].(string)
+	p.mu.RLock()
+	key, ok := p.keys[kid]
+	if !ok && kid == "" && len(p.keys) == 1 {
+		for _, k := range p.keys {
+			key, ok = k, true
+		}
+	}
+	p.mu.RUnlock()
+	if !ok {
+		return nil, fmt.Errorf("Unknown signing key '%s'.", kid)
+	}
+	switch token.Method.(type) {
+	case *jwtgo.SigningMethodRSA:
+		if _, ok := key.(*rsa.PublicKey); !ok {
+			return nil, fmt.Errorf("Key '%s' is not an RSA key.", kid)
+		}
+	case *jwtgo.SigningMethodECDSA:
+		if _, ok := key.(*ecdsa.PublicKey); !ok {
+			return nil, fmt.Errorf("Key '%s' is not an EC key.", kid)
+		}
+	default:
+		return nil, fmt.Errorf("Signing algorithm %s is not supported.", alg)
+	}
+	return key, nil
+}
+
+// scopes reads a scope claim, either a space-separated string (as in OAuth2)
+// or a list.
+func scopes(claim interface{}) []string {
+	switch c := claim.(type) {
+	case string:
+		return strings.Fields(c)
+	case []interface{}:
+		s := []string{}
+		for _, v := range c {
+			if scope, ok := v.(string); ok {
+				s = append(s, scope)
+			}
+		}
+		return s
+	}
+	return nil
+}
+
+func hasAudience(aud interface{}, audience string) bool {
+	switch a := aud.(type) {
+	case string:
+		return a == audience
+	case []interface{}:
+		for _, v := range a {
+			if s, ok := v.(string); ok && s == audience {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// Resolve verifies the token (signature, exp, nbf, iss and aud) and maps its
+// claims onto a key.
+func (p *JWTAuthPlugin) Resolve(maybeKey string, keyType string, bits map[string]interface{}) (*apiplexy.Key, error) {
+	token, err := jwtgo.Parse(maybeKey, p.keyFunc)
+	if err != nil || !token.Valid {
+		return nil, nil
+	}
+	if p.config.Issuer != "" {
+		if iss, _ := token.Claims["iss"].(string); iss != p.config.Issuer {
+			return nil, nil
+		}
+	}
+	if p.config.Audience != "" && !hasAudience(token.Claims["aud"], p.config.Audience) {
+		return nil, nil
+	}
+	id, _ := token.Claims[p.config.IDClaim].(string)
+	if id == "" {
+		return nil, nil
+	}
+	key := apiplexy.Key{
+		ID:   id,
+		Type: "JWT",
+		Data: make(map[string]interface{}),
+	}
+	if p.config.QuotaClaim != "" {
+		key.Quota, _ = token.Claims[p.config.QuotaClaim].(string)
+	}
+	if p.config.RealmClaim != "" {
+		key.Realm, _ = token.Claims[p.config.RealmClaim].(string)
+	}
+	if p.config.ScopeClaim != "" {
+		key.Scopes = scopes(token.Claims[p.config.ScopeClaim])
+	}
+	for _, c := range p.config.DataClaims {
+		if v, ok := token.Claims[c]; ok {
+			key.Data[c] = v
+		}
+	}
+	return &key, nil
+}
+
+func (p *JWTAuthPlugin) Validate(key *apiplexy.Key, req *http.Request, ctx *apiplexy.APIContext, bits map[string]interface{}) (isValid bool, err error) {
+	return key.Type == "JWT", nil
+}
+
+func (p *JWTAuthPlugin) refresh() error {
+	keys, err := loadJWKS(p.config.JWKS)
+	if err != nil {
+		return err
+	}
+	p.mu.Lock()
+	p.keys = keys
+	p.mu.Unlock()
+	return nil
+}
+
+// Start refreshes the signing keys periodically, so the identity provider can
+// rotate them. If a refresh fails, the previous keys stay in use.
+func (p *JWTAuthPlugin) Start(ctx context.Context) error {
+	if p.config.Refresh <= 0 {
+		return nil
+	}
+	go func() {
+		ticker := time.NewTicker(p.config.Refresh)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-ctx.Done():
+				return
+			case <-ticker.C:
+				if err := p.refresh(); err != nil {
+					log.Printf("Could not refresh JWKS from %s: %s\n", p.config.JWKS, err.Error())
+				}
+			}
+		}
+	}()
+	return nil
+}
+
+func contains(list []string, s string) bool {
+	for _, item := range list {
+		if item == s {
+			return true
+		}
+	}
+	return false
+}
+
+func (p *JWTAuthPlugin) ConfigStruct() interface{} {
+	return &jwtConfig{}
+}
+
+func (p *JWTAuthPlugin) ConfigureTyped(config interface{}) error {
+	p.config = config.(*jwtConfig)
+	if err := p.refresh(); err != nil {
+		return fmt.Errorf("Could not load JWKS from %s: %s", p.config.JWKS, err.Error())
+	}
+	return nil
+}
+
+func (p *JWTAuthPlugin) DefaultConfig() map[string]interface{} {
+	d := apiplexy.TypedDefaultConfig(p)
+	d["jwks"] = "https://your-identity-provider/.well-known/jwks.json"
+	return d
+}
+
+func (p *JWTAuthPlugin) Configure(config map[string]interface{}) error {
+	return apiplexy.TypedConfigure(p, config)
+}
+
+func init() {
+	// _ = apiplexy.ResolvingAuthPlugin(&JWTAuthPlugin{})
+	// _ = apiplexy.StartablePlugin(&JWTAuthPlugin{})
+	apiplexy.RegisterPlugin(
+		"jwt",
+		"Authenticate requests by bearer JWTs, verified against a JWKS.",
+		"https://github.com/12foo/apiplexy/tree/master/auth/jwt",
+		JWTAuthPlugin{},
+	)
+}
@@ -0,0 +1,198 @@
+package jwt
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/rsa"
+	"encoding/base64"
+	"encoding/json"
+	"github.com/12foo/apiplexy"
+	jwtgo "github.com/dgrijalva/jwt-go"
+	. "github.com/smartystreets/goconvey/convey"
+	"io/ioutil"
+	"math/big"
+	"net/http"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+var (
+	rsaKey, _ = rsa.GenerateKey(rand.Reader, 2048)
+	ecKey, _  = ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+)
+
+func b64(b []byte) string {
+	return base64.RawURLEncoding.EncodeToString(b)
+}
+
+func rsaJWK(kid string, k *rsa.PrivateKey) map[string]string {
+	return map[string]string{
+		"kty": "RSA", "kid": kid, "use": "sig",
+		"n": b64(k.N.Bytes()), "e": b64(big.NewInt(int64(k.E)).Bytes()),
+	}
+}
+
+func ecJWK(kid string, k *ecdsa.PrivateKey) map[string]string {
+	return map[string]string{
+		"kty": "EC", "kid": kid, "crv": "P-256",
+		"x": b64(k.X.Bytes()), "y": b64(k.Y.Bytes()),
+	}
+}
+
+func writeJWKS(path string, keys ...map[string]string) {
+	b, _ := json.Marshal(map[string]interface{}{"keys": keys})
+	if err := ioutil.WriteFile(path, b, 0600); err != nil {
+		panic(err)
+	}
+}
+
+func sign(method jwtgo.SigningMethod, kid string, key interface{}, claims map[string]interface{}) string {
+	token := jwtgo.New(method)
+	if kid != "" {
+		token.Header["kid"] = kid
+	}
+	for c, v := range claims {
+		token.Claims[c] = v
+	}
+	s, err := token.SignedString(key)
+	if err != nil {
+		panic(err)
+	}
+	return s
+}
+
+func validClaims() map[string]interface{} {
+	return map[string]interface{}{
+		"sub":   "user-1",
+		"iss":   "https://idp.example.com/",
+		"aud":   []interface{}{"other-api", "my-api"},
+		"exp":   time.Now().Add(time.Hour).Unix(),
+		"plan":  "premium",
+		"email": "user@example.com",
+	}
+}
+
+func TestJWT(t *testing.T) {
+	dir, _ := ioutil.TempDir("", "apiplexy-jwt")
+	defer os.RemoveAll(dir)
+	jwksFile := filepath.Join(dir, "jwks.json")
+	writeJWKS(jwksFile, rsaJWK("rsa-1", rsaKey), ecJWK("ec-1", ecKey))
+
+	p := &JWTAuthPlugin{}
+	err := p.Configure(map[string]interface{}{
+		"jwks":        jwksFile,
+		"issuer":      "https://idp.example.com/",
+		"audience":    "my-api",
+		"quota_claim": "plan",
+		"data_claims": []interface{}{"email"},
+	})
+	ctx := apiplexy.APIContext{}
+
+	resolve := func(token string) *apiplexy.Key {
+		req, _ := http.NewRequest("GET", "http://example.com/things", nil)
+		req.Header.Set("Authorization", "Bearer "+token)
+		maybeKey, keyType, bits, _ := p.Detect(req, &ctx)
+		if maybeKey == "" {
+			return nil
+		}
+		key, _ := p.Resolve(maybeKey, keyType, bits)
+		return key
+	}
+	withClaim := func(claim string, v interface{}) map[string]interface{} {
+		c := validClaims()
+		if v == nil {
+			delete(c, claim)
+		} else {
+			c[claim] = v
+		}
+		return c
+	}
+
+	Convey("Plugin should configure with a local JWKS file", t, func() {
+		So(err, ShouldBeNil)
+		So(p.keys, ShouldContainKey, "rsa-1")
+		So(p.keys, ShouldContainKey, "ec-1")
+	})
+
+	Convey("Valid tokens should resolve to keys built from their claims", t, func() {
+		key := resolve(sign(jwtgo.SigningMethodRS256, "rsa-1", rsaKey, validClaims()))
+		So(key, ShouldNotBeNil)
+		So(key.ID, ShouldEqual, "user-1")
+		So(key.Type, ShouldEqual, "JWT")
+		So(key.Quota, ShouldEqual, "premium")
+		So(key.Data["email"], ShouldEqual, "user@example.com")
+
+		valid, err := p.Validate(key, nil, &ctx, nil)
+		So(err, ShouldBeNil)
+		So(valid, ShouldBeTrue)
+
+		key = resolve(sign(jwtgo.SigningMethodES256, "ec-1", ecKey, validClaims()))
+		So(key, ShouldNotBeNil)
+	})
+
+	Convey("Scopes should be read from a space-separated string or a list", t, func() {
+		key := resolve(sign(jwtgo.SigningMethodRS256, "rsa-1", rsaKey, withClaim("scope", "read write")))
+		So(key.Scopes, ShouldResemble, []string{"read", "write"})
+		key = resolve(sign(jwtgo.SigningMethodRS256, "rsa-1", rsaKey, withClaim("scope", []interface{}{"read", "write"})))
+		So(key.Scopes, ShouldResemble, []string{"read", "write"})
+		So(resolve(sign(jwtgo.SigningMethodRS256, "rsa-1", rsaKey, validClaims())).Scopes, ShouldBeEmpty)
+	})
+
+	Convey("Tokens outside their validity period should be rejected", t, func() {
+		So(resolve(sign(jwtgo.SigningMethodRS256, "rsa-1", rsaKey, withClaim("exp", time.Now().Add(-time.Minute).Unix()))), ShouldBeNil)
+		So(resolve(sign(jwtgo.SigningMethodRS256, "rsa-1", rsaKey, withClaim("nbf", time.Now().Add(time.Hour).Unix()))), ShouldBeNil)
+	})
+
+	Convey("Tokens for a different issuer or audience should be rejected", t, func() {
+		So(resolve(sign(jwtgo.SigningMethodRS256, "rsa-1", rsaKey, withClaim("iss", "https://evil.example.com/"))), ShouldBeNil)
+		So(resolve(sign(jwtgo.SigningMethodRS256, "rsa-1", rsaKey, withClaim("aud", "other-api"))), ShouldBeNil)
+		So(resolve(sign(jwtgo.SigningMethodRS256, "rsa-1", rsaKey, withClaim("aud", nil))), ShouldBeNil)
+	})
+
+	Convey("Tokens without a subject should be rejected", t, func() {
+		So(resolve(sign(jwtgo.SigningMethodRS256, "rsa-1", rsaKey, withClaim("sub", nil))), ShouldBeNil)
+	})
+
+	Convey("Tokens signed by unknown keys should be rejected", t, func() {
+		other, _ := rsa.GenerateKey(rand.Reader, 2048)
+		So(resolve(sign(jwtgo.SigningMethodRS256, "rsa-1", other, validClaims())), ShouldBeNil)
+		So(resolve(sign(jwtgo.SigningMethodRS256, "rsa-2", rsaKey, validClaims())), ShouldBeNil)
+	})
+
+	Convey("Tokens should only be accepted with the allowed algorithms", t, func() {
+		So(resolve(sign(jwtgo.SigningMethodRS512, "rsa-1", rsaKey, validClaims())), ShouldBeNil)
+		// a token "signed" with the public key as an HMAC secret
+		pub := []byte(rsaJWK("rsa-1", rsaKey)["n"])
+		So(resolve(sign(jwtgo.SigningMethodHS256, "rsa-1", pub, validClaims())), ShouldBeNil)
+		// an RSA algorithm with an EC key
+		So(resolve(sign(jwtgo.SigningMethodRS256, "ec-1", rsaKey, validClaims())), ShouldBeNil)
+	})
+
+	Convey("Requests without a bearer JWT should be ignored", t, func() {
+		req, _ := http.NewRequest("GET", "http://example.com/things", nil)
+		req.Header.Set("Authorization", "Bearer not-a-jwt")
+		maybeKey, _, _, err := p.Detect(req, &ctx)
+		So(err, ShouldBeNil)
+		So(maybeKey, ShouldBeBlank)
+	})
+
+	Convey("Rotated keys should be picked up on refresh", t, func() {
+		rotated, _ := rsa.GenerateKey(rand.Reader, 2048)
+		writeJWKS(jwksFile, rsaJWK("rsa-2", rotated))
+		So(p.refresh(), ShouldBeNil)
+		So(resolve(sign(jwtgo.SigningMethodRS256, "rsa-2", rotated, validClaims())), ShouldNotBeNil)
+		So(resolve(sign(jwtgo.SigningMethodRS256, "rsa-1", rsaKey, validClaims())), ShouldBeNil)
+
+		ioutil.WriteFile(jwksFile, []byte("garbage"), 0600)
+		So(p.refresh(), ShouldNotBeNil)
+		So(resolve(sign(jwtgo.SigningMethodRS256, "rsa-2", rotated, validClaims())), ShouldNotBeNil)
+	})
+
+	Convey("Plugin should not configure without a usable JWKS", t, func() {
+		p := &JWTAuthPlugin{}
+		So(p.Configure(map[string]interface{}{"jwks": filepath.Join(dir, "missing.json")}), ShouldNotBeNil)
+	})
+}
@@ -0,0 +1,144 @@
+package oauth2
+
+import (
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"github.com/12foo/apiplexy"
+	"github.com/dchest/uniuri"
+	"github.com/dgrijalva/jwt-go"
+	"net/http"
+	"strings"
+)
+
+type oauth2Config struct {
+	SigningKey string `config:"signing_key" required:"true"`
+	Issuer     string `config:"issuer" default:"apiplexy"`
+}
+
+// OAuth2AuthPlugin accepts the access tokens handed out by apiplexy's own
+// OAuth2 token endpoint. The tokens are signed by the gateway and carry
+// everything needed to build the key (ID, quota, realm, networks and scopes),
+// so no backend is involved.
+type OAuth2AuthPlugin struct {
+	config *oauth2Config
+}
+
+var availableTypes = []apiplexy.KeyType{
+	{Name: "AccessToken", Description: "Short-lived bearer tokens from the OAuth2 token endpoint, in exchange for another key."},
+}
+
+func (p *OAuth2AuthPlugin) AvailableTypes() []apiplexy.KeyType {
+	return availableTypes
+}
+
+func (p *OAuth2AuthPlugin) Generate(keyType string) (key apiplexy.Key, err error) {
+	return apiplexy.Key{}, fmt.Errorf("Access tokens are requested from the OAuth2 token endpoint.")
+}
+
+// issuer returns the (unverified) issuer of a JWT.
+func issuer(token string) string {
+	parts := strings.Split(token, ".")
+	if len(parts) != 3 {
+		return ""
+	}
+	b, err := base64.RawURLEncoding.DecodeString(strings.TrimRight(parts[1], "="))
+	if err != nil {
+		return ""
+	}
+	claims := struct {
+		Iss string `json:"iss"`
+	}{}
+	json.Unmarshal(b, &claims)
+	return claims.Iss
+}
+
+// Detect only claims bearer tokens from our own issuer, so other bearer token
+// plugins still get to see the rest.
+func (p *OAuth2AuthPlugin) Detect(req *http.Request, ctx *apiplexy.APIContext) (maybeKey string, keyType string, bits map[string]interface{}, err error) {
+	auth := req.Header.Get("Authorization")
+	if len(auth) < 7 || !strings.EqualFold(auth[:7], "Bearer ") {
+		return "", "", nil, nil
+	}
+	token := strings.TrimSpace(auth[7:])
+	if issuer(token) != p.config.Issuer {
+		return "", "", nil, nil
+	}
+	return token, "AccessToken", nil, nil
+}
+
+func (p *OAuth2AuthPlugin) Resolve(maybeKey string, keyType string, bits map[string]interface{}) (*apiplexy.Key, error) {
+	token, err := jwt.Parse(maybeKey, func(token *jwt.Token) (interface{}, error) {
+		if token.Method != jwt.SigningMethodHS256 {
+			return nil, fmt.Errorf("Unexpected signing method.")
+		}
+		return []byte(p.config.SigningKey), nil
+	})
+	if err != nil || !token.Valid {
+		return nil, nil
+	}
+	if iss, _ := token.Claims["iss"].(string); iss != p.config.Issuer {
+		return nil, nil
+	}
+	id, _ := token.Claims["sub"].(string)
+	if id == "" {
+		return nil, nil
+	}
+	key := apiplexy.Key{
+		ID:   id,
+		Type: "AccessToken",
+		Data: make(map[string]interface{}),
+	}
+	key.Quota, _ = token.Claims["quota"].(string)
+	key.Realm, _ = token.Claims["realm"].(string)
+	if scope, ok := token.Claims["scope"].(string); ok {
+		key.Scopes = strings.Fields(scope)
+	}
+	if allow, ok := token.Claims["allow_ips"].(string); ok {
+		key.AllowIPs = strings.Fields(allow)
+	}
+	if deny, ok := token.Claims["deny_ips"].(string); ok {
+		key.DenyIPs = strings.Fields(deny)
+	}
+	if kt, ok := token.Claims["key_type"].(string); ok {
+		key.Data["key_type"] = kt
+	}
+	return &key, nil
+}
+
+func (p *OAuth2AuthPlugin) Validate(key *apiplexy.Key, req *http.Request, ctx *apiplexy.APIContext, bits map[string]interface{}) (isValid bool, err error) {
+	return key.Type == "AccessToken", nil
+}
+
+func (p *OAuth2AuthPlugin) ConfigStruct() interface{} {
+	return &oauth2Config{}
+}
+
+func (p *OAuth2AuthPlugin) ConfigureTyped(config interface{}) error {
+	c := config.(*oauth2Config)
+	if len(c.SigningKey) < 32 {
+		return fmt.Errorf("The signing key must be at least 32 characters long.")
+	}
+	p.config = c
+	return nil
+}
+
+func (p *OAuth2AuthPlugin) DefaultConfig() map[string]interface{} {
+	d := apiplexy.TypedDefaultConfig(p)
+	d["signing_key"] = uniuri.NewLen(64)
+	return d
+}
+
+func (p *OAuth2AuthPlugin) Configure(config map[string]interface{}) error {
+	return apiplexy.TypedConfigure(p, config)
+}
+
+func init() {
+	// _ = apiplexy.ResolvingAuthPlugin(&OAuth2AuthPlugin{})
+	apiplexy.RegisterPlugin(
+		"oauth2",
+		"Authenticate requests by access tokens from apiplexy's OAuth2 token endpoint.",
+		"https://github.com/12foo/apiplexy/tree/master/auth/oauth2",
+		OAuth2AuthPlugin{},
+	)
+}
@@ -0,0 +1,89 @@
+package oauth2
+
+import (
+	"github.com/12foo/apiplexy"
+	"github.com/dgrijalva/jwt-go"
+	. "github.com/smartystreets/goconvey/convey"
+	"net/http"
+	"testing"
+	"time"
+)
+
+const signingKey = "0123456789abcdef0123456789abcdef"
+
+func accessToken(method jwt.SigningMethod, key interface{}, claims map[string]interface{}) string {
+	token := jwt.New(method)
+	token.Claims["iss"] = "apiplexy"
+	token.Claims["sub"] = "key-1"
+	token.Claims["exp"] = time.Now().Add(time.Hour).Unix()
+	token.Claims["key_type"] = "HMAC"
+	token.Claims["quota"] = "premium"
+	for c, v := range claims {
+		token.Claims[c] = v
+	}
+	s, _ := token.SignedString(key)
+	return s
+}
+
+func TestOAuth2(t *testing.T) {
+	p := &OAuth2AuthPlugin{}
+	err := p.Configure(map[string]interface{}{"signing_key": signingKey})
+	ctx := apiplexy.APIContext{}
+
+	resolve := func(token string) *apiplexy.Key {
+		req, _ := http.NewRequest("GET", "http://example.com/things", nil)
+		req.Header.Set("Authorization", "Bearer "+token)
+		maybeKey, keyType, bits, _ := p.Detect(req, &ctx)
+		if maybeKey == "" {
+			return nil
+		}
+		key, _ := p.Resolve(maybeKey, keyType, bits)
+		return key
+	}
+
+	Convey("Plugin should configure with its default configuration", t, func() {
+		So(err, ShouldBeNil)
+		d := &OAuth2AuthPlugin{}
+		So(d.Configure(d.DefaultConfig()), ShouldBeNil)
+		So(d.Configure(map[string]interface{}{"signing_key": "too-short"}), ShouldNotBeNil)
+	})
+
+	Convey("Access tokens should resolve to the key they were issued for", t, func() {
+		key := resolve(accessToken(jwt.SigningMethodHS256, []byte(signingKey), nil))
+		So(key, ShouldNotBeNil)
+		So(key.ID, ShouldEqual, "key-1")
+		So(key.Type, ShouldEqual, "AccessToken")
+		So(key.Quota, ShouldEqual, "premium")
+		So(key.Data["key_type"], ShouldEqual, "HMAC")
+		So(key.Scopes, ShouldBeEmpty)
+
+		key = resolve(accessToken(jwt.SigningMethodHS256, []byte(signingKey), map[string]interface{}{"scope": "orders:read orders:write"}))
+		So(key.Scopes, ShouldResemble, []string{"orders:read", "orders:write"})
+
+		key = resolve(accessToken(jwt.SigningMethodHS256, []byte(signingKey), map[string]interface{}{"allow_ips": "198.51.100.0/24 2001:db8::/32", "deny_ips": "198.51.100.7"}))
+		So(key.AllowIPs, ShouldResemble, []string{"198.51.100.0/24", "2001:db8::/32"})
+		So(key.DenyIPs, ShouldResemble, []string{"198.51.100.7"})
+
+		valid, err := p.Validate(key, nil, &ctx, nil)
+		So(err, ShouldBeNil)
+		So(valid, ShouldBeTrue)
+	})
+
+	Convey("Expired or forged access tokens should be rejected", t, func() {
+		So(resolve(accessToken(jwt.SigningMethodHS256, []byte(signingKey), map[string]interface{}{"exp": time.Now().Add(-time.Minute).Unix()})), ShouldBeNil)
+		So(resolve(accessToken(jwt.SigningMethodHS256, []byte("another-key-another-key-another-key"), nil)), ShouldBeNil)
+		So(resolve(accessToken(jwt.SigningMethodHS512, []byte(signingKey), nil)), ShouldBeNil)
+	})
+
+	Convey("Bearer tokens from other issuers should be left to other plugins", t, func() {
+		req, _ := http.NewRequest("GET", "http://example.com/things", nil)
+		req.Header.Set("Authorization", "Bearer "+accessToken(jwt.SigningMethodHS256, []byte(signingKey), map[string]interface{}{"iss": "someone-else"}))
+		maybeKey, _, _, err := p.Detect(req, &ctx)
+		So(err, ShouldBeNil)
+		So(maybeKey, ShouldBeBlank)
+
+		req.Header.Set("Authorization", "Bearer opaque-token")
+		maybeKey, _, _, _ = p.Detect(req, &ctx)
+		So(maybeKey, ShouldBeBlank)
+	})
+}
@@ -2,22 +2,42 @@ package backend
 
 import (
 	"bytes"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
 	"encoding/json"
 	"fmt"
 	"github.com/12foo/apiplexy"
+	_ "github.com/12foo/apiplexy/auth/apikey"
+	_ "github.com/12foo/apiplexy/auth/basic"
 	_ "github.com/12foo/apiplexy/auth/hmac"
+	_ "github.com/12foo/apiplexy/auth/introspection"
+	_ "github.com/12foo/apiplexy/auth/jwt"
+	_ "github.com/12foo/apiplexy/auth/oauth2"
 	_ "github.com/12foo/apiplexy/backend/sql"
+	jwtgo "github.com/dgrijalva/jwt-go"
 	"github.com/garyburd/redigo/redis"
 	. "github.com/smartystreets/goconvey/convey"
+	coltracepb "go.opentelemetry.io/proto/otlp/collector/trace/v1"
+	tracepb "go.opentelemetry.io/proto/otlp/trace/v1"
+	"google.golang.org/protobuf/proto"
 	"gopkg.in/yaml.v2"
 	"io"
+	"io/ioutil"
 	"log"
+	"math/big"
 	"net/http"
 	"net/http/httptest"
+	"net/url"
 	"os"
 	"strconv"
 	"strings"
+	"sync/atomic"
 	"testing"
+	"time"
 )
 
 const yaml_config = `redis:
@@ -34,14 +54,60 @@ quotas:
     max_ip: 5
 serve:
   port: 5000
-  api: /
+  api: /api/
   upstreams:
   - http://your-actual-api:8000/
   portal_api: /portal/api/
   signing_key: test-signing-key
+  health: /health
+  admin_api: /admin/api/
+  admin_token: test-admin-token
+probes:
+  liveness: /healthz
+  readiness: /readyz
+oauth2:
+  token_endpoint: /oauth2/token
+  signing_key: test-oauth2-signing-key-0123456789
+  lifetime: 10m
+realms:
+  cors: true
+  origins: ["*.example.com"]
+  max_age: 10m
+keys:
+  cache_ttl: 5m
+scopes:
+  catalog:
+    orders:read: Read your orders.
+    orders:write: Place and cancel orders.
+  routes:
+  - paths: [/orders/**]
+    scopes: [orders:read]
+  - paths: [/orders/**]
+    methods: [POST]
+    scopes: [orders:write]
+metrics:
+  path: /metrics
+  routes:
+  - /
 plugins:
   auth:
   - plugin: hmac
+    config:
+      replay_protection: true
+  - plugin: apikey
+  - plugin: basic
+    config:
+      cost: 4
+  - plugin: oauth2
+    config:
+      signing_key: test-oauth2-signing-key-0123456789
+  - plugin: jwt
+    config:
+      jwks: e2e-jwks.json
+      issuer: https://idp.example.com/
+  - plugin: introspection
+    config:
+      endpoint: http://127.0.0.1:1/set-in-TestMain
   backend:
   - plugin: sql-full
     config:
@@ -49,8 +115,18 @@ plugins:
       create_tables: true
       driver: sqlite3`
 
-var ap *http.ServeMux
+var ap *apiplexy.Gateway
 var rd redis.Conn
+var mockAPIURL string
+
+// signs the JWTs accepted by the jwt plugin
+var jwtSigningKey *rsa.PrivateKey
+
+// number of tokens the stand-in authorization server has introspected
+var introspections int64
+
+// traceparent header of the last request the mock API received
+var upstreamTraceparent atomic.Value
 
 func toBody(n interface{}) io.Reader {
 	b, _ := json.Marshal(n)
@@ -71,18 +147,50 @@ func shouldHaveStatus(actual interface{}, expected ...interface{}) string {
 func TestMain(m *testing.M) {
 	// set up a mock API that apiplexy proxies to
 	mockAPI := httptest.NewServer(http.HandlerFunc(func(res http.ResponseWriter, req *http.Request) {
+		upstreamTraceparent.Store(req.Header.Get("traceparent"))
 		res.WriteHeader(http.StatusOK)
 		res.Write([]byte("API-OK"))
 	}))
 	defer mockAPI.Close()
 	log.Printf("Launched mock API at %s.\n", mockAPI.URL)
+	mockAPIURL = mockAPI.URL + "/"
+
+	// set up a stand-in authorization server for the introspection plugin
+	authServer := httptest.NewServer(http.HandlerFunc(func(res http.ResponseWriter, req *http.Request) {
+		atomic.AddInt64(&introspections, 1)
+		info := map[string]interface{}{"active": false}
+		if req.PostFormValue("token") == "opaque-token" {
+			info = map[string]interface{}{
+				"active":    true,
+				"client_id": "partner-app",
+				"exp":       time.Now().Add(time.Hour).Unix(),
+			}
+		}
+		json.NewEncoder(res).Encode(info)
+	}))
+	defer authServer.Close()
 
 	// set up apiplexy
 	config := apiplexy.ApiplexConfig{}
 	if err := yaml.Unmarshal([]byte(yaml_config), &config); err != nil {
 		log.Fatalln(err)
 	}
-	config.Serve.Upstreams[0] = mockAPI.URL
+	config.Serve.Upstreams[0] = mockAPIURL
+
+	// publish a JWKS for the jwt plugin
+	jwtSigningKey, _ = rsa.GenerateKey(rand.Reader, 2048)
+	jwks, _ := json.Marshal(map[string]interface{}{"keys": []map[string]string{{
+		"kty": "RSA",
+		"kid": "e2e",
+		"n":   base64.RawURLEncoding.EncodeToString(jwtSigningKey.N.Bytes()),
+		"e":   base64.RawURLEncoding.EncodeToString(big.NewInt(int64(jwtSigningKey.E)).Bytes()),
+	}}})
+	ioutil.WriteFile("e2e-jwks.json", jwks, 0600)
+	for _, p := range config.Plugins.Auth {
+		if p.Plugin == "introspection" {
+			p.Config["endpoint"] = authServer.URL
+		}
+	}
 	a, err := apiplexy.New(config)
 	if err != nil {
 		log.Fatalln(err)
@@ -97,6 +205,8 @@ func TestMain(m *testing.M) {
 
 	// after testing, clean out database for future tests
 	r.Do("FLUSHDB")
+	ap.Close()
+	os.Remove("e2e-jwks.json")
 
 	os.Exit(result)
 }
@@ -105,7 +215,7 @@ func TestKeyless(t *testing.T) {
 	Convey("Keyless access should work within limits", t, func() {
 		for i := 1; i <= 5; i++ {
 			r := httptest.NewRecorder()
-			keylessRequest, _ := http.NewRequest("GET", "/", nil)
+			keylessRequest, _ := http.NewRequest("GET", "/api/", nil)
 			ap.ServeHTTP(r, keylessRequest)
 			So(r, shouldHaveStatus, 200)
 			So(r.Body.String(), ShouldEqual, "API-OK")
@@ -114,7 +224,7 @@ func TestKeyless(t *testing.T) {
 
 	Convey("Keyless access should deny if over limit", t, func() {
 		r := httptest.NewRecorder()
-		keylessRequest, _ := http.NewRequest("GET", "/", nil)
+		keylessRequest, _ := http.NewRequest("GET", "/api/", nil)
 		ap.ServeHTTP(r, keylessRequest)
 		So(r, shouldHaveStatus, 403)
 		So(r.Body.String(), ShouldNotEqual, "API-OK")
@@ -233,3 +343,1257 @@ func TestPortalAPI(t *testing.T) {
 	})
 
 }
+
+func TestHealth(t *testing.T) {
+	Convey("Health endpoint should report all plugins as healthy", t, func() {
+		req, _ := http.NewRequest("GET", "/health", nil)
+		res := httptest.NewRecorder()
+		ap.ServeHTTP(res, req)
+		So(res, shouldHaveStatus, 200)
+		report := struct {
+			Status  string
+			Plugins map[string]string
+		}{}
+		json.Unmarshal(res.Body.Bytes(), &report)
+		So(report.Status, ShouldEqual, "ok")
+		So(report.Plugins["backend/sql-full"], ShouldEqual, "ok")
+	})
+
+	Convey("A health endpoint inside the API path should be rejected", t, func() {
+		config := apiplexy.ApiplexConfig{}
+		yaml.Unmarshal([]byte(yaml_config), &config)
+		config.Serve.Health = "/api/health"
+		_, err := apiplexy.New(config)
+		So(err, ShouldNotBeNil)
+		So(err.Error(), ShouldContainSubstring, "inside the API path")
+	})
+}
+
+func TestReload(t *testing.T) {
+	Convey("Reloading should swap in the new configuration, or keep the old one", t, func() {
+		config := apiplexy.ApiplexConfig{}
+		yaml.Unmarshal([]byte(yaml_config), &config)
+		config.Serve.Upstreams[0] = mockAPIURL
+		gw, err := apiplexy.New(config)
+		So(err, ShouldBeNil)
+		defer gw.Close()
+
+		status := func(path string) int {
+			req, _ := http.NewRequest("GET", path, nil)
+			res := httptest.NewRecorder()
+			gw.ServeHTTP(res, req)
+			return res.Code
+		}
+		So(status("/health"), ShouldEqual, 200)
+
+		config.Serve.Health = "/status"
+		So(gw.Reload(config), ShouldBeNil)
+		So(status("/status"), ShouldEqual, 200)
+		So(status("/health"), ShouldEqual, 404)
+
+		broken := config
+		broken.Probes.Checks = []string{"database"}
+		So(gw.Reload(broken), ShouldNotBeNil)
+		So(status("/status"), ShouldEqual, 200)
+	})
+}
+
+func TestProbes(t *testing.T) {
+	probe := func(gw *apiplexy.Gateway, path string) (*httptest.ResponseRecorder, map[string]string) {
+		req, _ := http.NewRequest("GET", path, nil)
+		res := httptest.NewRecorder()
+		gw.ServeHTTP(res, req)
+		report := struct {
+			Status     string
+			Components map[string]string
+		}{}
+		json.Unmarshal(res.Body.Bytes(), &report)
+		return res, report.Components
+	}
+
+	Convey("Liveness should respond without credentials", t, func() {
+		res, _ := probe(ap, "/healthz")
+		So(res, shouldHaveStatus, 200)
+	})
+
+	Convey("Readiness should report Redis, backends and upstreams", t, func() {
+		res, components := probe(ap, "/readyz")
+		So(res, shouldHaveStatus, 200)
+		So(components["redis"], ShouldEqual, "ok")
+		So(components["backend/sql-full"], ShouldEqual, "ok")
+		So(components["upstream/"+mockAPIURL], ShouldEqual, "ok")
+	})
+
+	Convey("Readiness should fail if an upstream is down", t, func() {
+		down := httptest.NewServer(http.NotFoundHandler())
+		down.Close()
+		config := apiplexy.ApiplexConfig{}
+		yaml.Unmarshal([]byte(yaml_config), &config)
+		config.Serve.Upstreams[0] = down.URL
+		config.Probes.Checks = []string{"upstreams"}
+		gw, err := apiplexy.New(config)
+		So(err, ShouldBeNil)
+		defer gw.Close()
+
+		res, components := probe(gw, "/readyz")
+		So(res, shouldHaveStatus, 503)
+		So(components, ShouldHaveLength, 1)
+		So(components["upstream/"+down.URL], ShouldNotEqual, "ok")
+	})
+
+	Convey("Unknown readiness checks should be rejected", t, func() {
+		config := apiplexy.ApiplexConfig{}
+		yaml.Unmarshal([]byte(yaml_config), &config)
+		config.Probes.Checks = []string{"database"}
+		_, err := apiplexy.New(config)
+		So(err, ShouldNotBeNil)
+	})
+
+	Convey("Probes inside the API path should be rejected", t, func() {
+		config := apiplexy.ApiplexConfig{}
+		yaml.Unmarshal([]byte(yaml_config), &config)
+		config.Probes.Readiness = "/api/readyz"
+		_, err := apiplexy.New(config)
+		So(err, ShouldNotBeNil)
+		So(err.Error(), ShouldContainSubstring, "inside the API path")
+	})
+}
+
+func TestMetrics(t *testing.T) {
+	Convey("Metrics endpoint should report handled requests", t, func() {
+		req, _ := http.NewRequest("GET", "/metrics", nil)
+		res := httptest.NewRecorder()
+		ap.ServeHTTP(res, req)
+		So(res, shouldHaveStatus, 200)
+		body := res.Body.String()
+		So(body, ShouldContainSubstring, `apiplexy_requests_total{method="GET",route="/",status="200"`)
+		So(body, ShouldContainSubstring, `apiplexy_quota_rejections_total{limit="ip",quota="keyless"} 1`)
+		So(body, ShouldContainSubstring, `apiplexy_requests_total{method="GET",route="/",status="403"`)
+		So(body, ShouldContainSubstring, "apiplexy_redis_pool_active_connections")
+	})
+
+	Convey("Metrics inside the API path should be rejected", t, func() {
+		config := apiplexy.ApiplexConfig{}
+		yaml.Unmarshal([]byte(yaml_config), &config)
+		config.Metrics.Path = "/api/metrics"
+		_, err := apiplexy.New(config)
+		So(err, ShouldNotBeNil)
+		So(err.Error(), ShouldContainSubstring, "inside the API path")
+	})
+}
+
+func TestTracing(t *testing.T) {
+	// a mock OTLP collector
+	spans := make(chan *tracepb.Span, 100)
+	collector := httptest.NewServer(http.HandlerFunc(func(res http.ResponseWriter, req *http.Request) {
+		body, _ := ioutil.ReadAll(req.Body)
+		export := coltracepb.ExportTraceServiceRequest{}
+		if err := proto.Unmarshal(body, &export); err == nil {
+			for _, rs := range export.ResourceSpans {
+				for _, ss := range rs.ScopeSpans {
+					for _, span := range ss.Spans {
+						spans <- span
+					}
+				}
+			}
+		}
+		res.Header().Set("Content-Type", "application/x-protobuf")
+		res.WriteHeader(http.StatusOK)
+	}))
+	defer collector.Close()
+
+	config := apiplexy.ApiplexConfig{}
+	yaml.Unmarshal([]byte(yaml_config), &config)
+	config.Serve.Upstreams[0] = mockAPIURL
+	config.Tracing.Endpoint = collector.URL + "/v1/traces"
+	gw, err := apiplexy.New(config)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	Convey("Requests should continue the caller's trace and propagate it upstream", t, func() {
+		req, _ := http.NewRequest("GET", "/api/", nil)
+		req.RemoteAddr = "192.0.2.1:1234"
+		req.Header.Set("traceparent", "00-4bf92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902b7-01")
+		res := httptest.NewRecorder()
+		gw.ServeHTTP(res, req)
+		So(res, shouldHaveStatus, 200)
+		parts := strings.Split(upstreamTraceparent.Load().(string), "-")
+		So(parts, ShouldHaveLength, 4)
+		So(parts[1], ShouldEqual, "4bf92f3577b34da6a3ce929d0e0e4736")
+		So(parts[2], ShouldNotEqual, "00f067aa0ba902b7")
+	})
+
+	Convey("Spans should be exported to the collector", t, func() {
+		// closing the gateway flushes all pending spans
+		So(gw.Close(), ShouldBeNil)
+		close(spans)
+		names := make(map[string]bool)
+		for span := range spans {
+			So(hex.EncodeToString(span.TraceId), ShouldEqual, "4bf92f3577b34da6a3ce929d0e0e4736")
+			names[span.Name] = true
+			if span.Name == "GET /api/" {
+				So(hex.EncodeToString(span.ParentSpanId), ShouldEqual, "00f067aa0ba902b7")
+				attrs := make(map[string]string)
+				for _, kv := range span.Attributes {
+					attrs[kv.Key] = kv.Value.GetStringValue()
+				}
+				So(attrs["apiplexy.quota"], ShouldEqual, "keyless")
+			}
+		}
+		So(names, ShouldContainKey, "GET /api/")
+		So(names, ShouldContainKey, "auth")
+		So(names, ShouldContainKey, "quota")
+		So(names, ShouldContainKey, "upstream")
+	})
+}
+
+func TestReplayProtection(t *testing.T) {
+	signedRequest := func(key apiplexy.Key, date string) *http.Request {
+		req, _ := http.NewRequest("GET", "/api/", nil)
+		req.RemoteAddr = "192.0.2.2:1234"
+		req.Header.Set("Date", date)
+		mac := hmac.New(sha256.New, []byte(key.Data["secret"].(string)))
+		mac.Write([]byte("(request-target): get /api/\ndate: " + date))
+		req.Header.Set("Authorization", fmt.Sprintf("Signature keyId=\"%s\",algorithm=\"hmac-sha256\",headers=\"(request-target) date\",signature=\"%s\"",
+			key.ID, base64.StdEncoding.EncodeToString(mac.Sum(nil))))
+		return req
+	}
+
+	Convey("A signed request should only be accepted once", t, func() {
+		req, _ := http.NewRequest("POST", "/portal/api/account/token", toBody(map[string]interface{}{
+			"email":    "test@user.com",
+			"password": "test-password",
+		}))
+		req.Header.Set("Content-Type", "application/json")
+		res := httptest.NewRecorder()
+		ap.ServeHTTP(res, req)
+		ts := struct {
+			Token string
+		}{}
+		json.Unmarshal(res.Body.Bytes(), &ts)
+		req, _ = http.NewRequest("GET", "/portal/api/keys", nil)
+		req.Header.Set("Authorization", "Bearer "+ts.Token)
+		res = httptest.NewRecorder()
+		ap.ServeHTTP(res, req)
+		var keys []apiplexy.Key
+		json.Unmarshal(res.Body.Bytes(), &keys)
+		So(keys, ShouldNotBeEmpty)
+
+		date := time.Now().UTC().Format(http.TimeFormat)
+		res = httptest.NewRecorder()
+		ap.ServeHTTP(res, signedRequest(keys[0], date))
+		So(res, shouldHaveStatus, 200)
+		So(res.Body.String(), ShouldEqual, "API-OK")
+
+		res = httptest.NewRecorder()
+		ap.ServeHTTP(res, signedRequest(keys[0], date))
+		So(res, shouldHaveStatus, 401)
+
+		// a fresh signature is fine again
+		res = httptest.NewRecorder()
+		ap.ServeHTTP(res, signedRequest(keys[0], time.Now().Add(time.Second).UTC().Format(http.TimeFormat)))
+		So(res, shouldHaveStatus, 200)
+	})
+}
+
+func TestAPIKeys(t *testing.T) {
+	Convey("API keys should work with their one-time token and be stored hashed", t, func() {
+		req, _ := http.NewRequest("POST", "/portal/api/account/token", toBody(map[string]interface{}{
+			"email":    "test@user.com",
+			"password": "test-password",
+		}))
+		req.Header.Set("Content-Type", "application/json")
+		res := httptest.NewRecorder()
+		ap.ServeHTTP(res, req)
+		ts := struct {
+			Token string
+		}{}
+		json.Unmarshal(res.Body.Bytes(), &ts)
+
+		req, _ = http.NewRequest("POST", "/portal/api/keys", toBody(map[string]interface{}{"type": "APIKey"}))
+		req.Header.Set("Authorization", "Bearer "+ts.Token)
+		req.Header.Set("Content-Type", "application/json")
+		res = httptest.NewRecorder()
+		ap.ServeHTTP(res, req)
+		So(res, shouldHaveStatus, 200)
+		var created apiplexy.Key
+		json.Unmarshal(res.Body.Bytes(), &created)
+		So(created.Token, ShouldNotBeBlank)
+
+		req, _ = http.NewRequest("GET", "/portal/api/keys", nil)
+		req.Header.Set("Authorization", "Bearer "+ts.Token)
+		res = httptest.NewRecorder()
+		ap.ServeHTTP(res, req)
+		So(res.Body.String(), ShouldContainSubstring, created.ID)
+		So(res.Body.String(), ShouldNotContainSubstring, created.Token)
+
+		req, _ = http.NewRequest("GET", "/api/", nil)
+		req.RemoteAddr = "192.0.2.3:1234"
+		req.Header.Set("X-API-Key", created.Token)
+		res = httptest.NewRecorder()
+		ap.ServeHTTP(res, req)
+		So(res, shouldHaveStatus, 200)
+		So(res.Body.String(), ShouldEqual, "API-OK")
+
+		req, _ = http.NewRequest("GET", "/api/", nil)
+		req.RemoteAddr = "192.0.2.3:1234"
+		req.Header.Set("X-API-Key", "not-a-key")
+		res = httptest.NewRecorder()
+		ap.ServeHTTP(res, req)
+		So(res, shouldHaveStatus, 403)
+
+		// revoke the key again, so the user is left with their HMAC key only
+		req, _ = http.NewRequest("POST", "/admin/api/keys/"+created.ID+"/revoke", nil)
+		req.Header.Set("Authorization", "Bearer test-admin-token")
+		res = httptest.NewRecorder()
+		ap.ServeHTTP(res, req)
+		So(res, shouldHaveStatus, 200)
+	})
+}
+
+func TestJWT(t *testing.T) {
+	Convey("JWTs should be accepted without a backend key", t, func() {
+		token := jwtgo.New(jwtgo.SigningMethodRS256)
+		token.Header["kid"] = "e2e"
+		token.Claims["sub"] = "jwt-user"
+		token.Claims["iss"] = "https://idp.example.com/"
+		token.Claims["exp"] = time.Now().Add(time.Hour).Unix()
+		signed, _ := token.SignedString(jwtSigningKey)
+
+		req, _ := http.NewRequest("GET", "/api/", nil)
+		req.RemoteAddr = "192.0.2.4:1234"
+		req.Header.Set("Authorization", "Bearer "+signed)
+		res := httptest.NewRecorder()
+		ap.ServeHTTP(res, req)
+		So(res, shouldHaveStatus, 200)
+		So(res.Body.String(), ShouldEqual, "API-OK")
+
+		token.Claims["iss"] = "https://evil.example.com/"
+		signed, _ = token.SignedString(jwtSigningKey)
+		req, _ = http.NewRequest("GET", "/api/", nil)
+		req.RemoteAddr = "192.0.2.4:1234"
+		req.Header.Set("Authorization", "Bearer "+signed)
+		res = httptest.NewRecorder()
+		ap.ServeHTTP(res, req)
+		So(res, shouldHaveStatus, 403)
+	})
+}
+
+func TestIntrospection(t *testing.T) {
+	request := func(token string) *httptest.ResponseRecorder {
+		req, _ := http.NewRequest("GET", "/api/", nil)
+		req.RemoteAddr = "192.0.2.5:1234"
+		req.Header.Set("Authorization", "Bearer "+token)
+		res := httptest.NewRecorder()
+		ap.ServeHTTP(res, req)
+		return res
+	}
+
+	Convey("Opaque tokens should be introspected once, then cached", t, func() {
+		before := atomic.LoadInt64(&introspections)
+		So(request("opaque-token"), shouldHaveStatus, 200)
+		So(request("opaque-token"), shouldHaveStatus, 200)
+		So(atomic.LoadInt64(&introspections)-before, ShouldEqual, 1)
+	})
+
+	Convey("Inactive tokens should be rejected, and cached as such", t, func() {
+		before := atomic.LoadInt64(&introspections)
+		So(request("revoked-token"), shouldHaveStatus, 403)
+		So(request("revoked-token"), shouldHaveStatus, 403)
+		So(atomic.LoadInt64(&introspections)-before, ShouldEqual, 1)
+	})
+}
+
+func TestBasicAuth(t *testing.T) {
+	Convey("Portal-generated BASIC keys should work with HTTP Basic auth", t, func() {
+		req, _ := http.NewRequest("POST", "/portal/api/account/token", toBody(map[string]interface{}{
+			"email":    "test@user.com",
+			"password": "test-password",
+		}))
+		req.Header.Set("Content-Type", "application/json")
+		res := httptest.NewRecorder()
+		ap.ServeHTTP(res, req)
+		ts := struct {
+			Token string
+		}{}
+		json.Unmarshal(res.Body.Bytes(), &ts)
+
+		req, _ = http.NewRequest("POST", "/portal/api/keys", toBody(map[string]interface{}{"type": "BASIC"}))
+		req.Header.Set("Authorization", "Bearer "+ts.Token)
+		req.Header.Set("Content-Type", "application/json")
+		res = httptest.NewRecorder()
+		ap.ServeHTTP(res, req)
+		So(res, shouldHaveStatus, 200)
+		var created apiplexy.Key
+		json.Unmarshal(res.Body.Bytes(), &created)
+		So(created.Token, ShouldNotBeBlank)
+
+		req, _ = http.NewRequest("GET", "/api/", nil)
+		req.RemoteAddr = "192.0.2.7:1234"
+		req.SetBasicAuth(created.ID, created.Token)
+		res = httptest.NewRecorder()
+		ap.ServeHTTP(res, req)
+		So(res, shouldHaveStatus, 200)
+		So(res.Body.String(), ShouldEqual, "API-OK")
+
+		req, _ = http.NewRequest("GET", "/api/", nil)
+		req.RemoteAddr = "192.0.2.7:1234"
+		req.SetBasicAuth(created.ID, "wrong-secret")
+		res = httptest.NewRecorder()
+		ap.ServeHTTP(res, req)
+		So(res, shouldHaveStatus, 403)
+
+		// revoke the key again, so the user is left with their HMAC key only
+		req, _ = http.NewRequest("POST", "/admin/api/keys/"+created.ID+"/revoke", nil)
+		req.Header.Set("Authorization", "Bearer test-admin-token")
+		res = httptest.NewRecorder()
+		ap.ServeHTTP(res, req)
+		So(res, shouldHaveStatus, 200)
+	})
+}
+
+func TestRealms(t *testing.T) {
+	Convey("Keys should only work from within their realm", t, func() {
+		req, _ := http.NewRequest("POST", "/portal/api/account/token", toBody(map[string]interface{}{
+			"email":    "test@user.com",
+			"password": "test-password",
+		}))
+		req.Header.Set("Content-Type", "application/json")
+		res := httptest.NewRecorder()
+		ap.ServeHTTP(res, req)
+		ts := struct {
+			Token string
+		}{}
+		json.Unmarshal(res.Body.Bytes(), &ts)
+
+		req, _ = http.NewRequest("POST", "/portal/api/keys", toBody(map[string]interface{}{"type": "APIKey", "realm": "*.example.com, com.example.app"}))
+		req.Header.Set("Authorization", "Bearer "+ts.Token)
+		req.Header.Set("Content-Type", "application/json")
+		res = httptest.NewRecorder()
+		ap.ServeHTTP(res, req)
+		So(res, shouldHaveStatus, 200)
+		var created apiplexy.Key
+		json.Unmarshal(res.Body.Bytes(), &created)
+
+		request := func(header, value string) *httptest.ResponseRecorder {
+			req, _ := http.NewRequest("GET", "/api/", nil)
+			req.RemoteAddr = "192.0.2.8:1234"
+			req.Header.Set("X-API-Key", created.Token)
+			req.Header.Set(header, value)
+			res := httptest.NewRecorder()
+			ap.ServeHTTP(res, req)
+			return res
+		}
+
+		res = request("Origin", "https://app.example.com")
+		So(res, shouldHaveStatus, 200)
+		So(res.Header().Get("Access-Control-Allow-Origin"), ShouldEqual, "https://app.example.com")
+
+		res = request("Origin", "https://evil.com")
+		So(res, shouldHaveStatus, 403)
+		So(res.Header().Get("Access-Control-Allow-Origin"), ShouldBeBlank)
+
+		So(request("X-App-ID", "com.example.app"), shouldHaveStatus, 200)
+		So(request("X-App-ID", "com.evil.app"), shouldHaveStatus, 403)
+
+		// revoke the key again, so the user is left with their HMAC key only
+		req, _ = http.NewRequest("POST", "/admin/api/keys/"+created.ID+"/revoke", nil)
+		req.Header.Set("Authorization", "Bearer test-admin-token")
+		res = httptest.NewRecorder()
+		ap.ServeHTTP(res, req)
+		So(res, shouldHaveStatus, 200)
+	})
+
+	Convey("CORS preflight requests should be answered by apiplexy", t, func() {
+		req, _ := http.NewRequest("OPTIONS", "/api/", nil)
+		req.RemoteAddr = "192.0.2.8:1234"
+		req.Header.Set("Origin", "https://app.example.com")
+		req.Header.Set("Access-Control-Request-Method", "POST")
+		req.Header.Set("Access-Control-Request-Headers", "X-API-Key, Content-Type")
+		res := httptest.NewRecorder()
+		ap.ServeHTTP(res, req)
+		So(res, shouldHaveStatus, 204)
+		So(res.Body.String(), ShouldBeBlank)
+		So(res.Header().Get("Access-Control-Allow-Origin"), ShouldEqual, "https://app.example.com")
+		So(res.Header().Get("Access-Control-Allow-Methods"), ShouldEqual, "POST")
+		So(res.Header().Get("Access-Control-Allow-Headers"), ShouldEqual, "X-API-Key, Content-Type")
+		So(res.Header().Get("Access-Control-Max-Age"), ShouldEqual, "600")
+
+		// a missing key doesn't open the API to every web app
+		req.Header.Set("Origin", "https://evil.com")
+		res = httptest.NewRecorder()
+		ap.ServeHTTP(res, req)
+		So(res, shouldHaveStatus, 403)
+		So(res.Header().Get("Access-Control-Allow-Origin"), ShouldBeBlank)
+
+		req, _ = http.NewRequest("GET", "/api/", nil)
+		req.RemoteAddr = "192.0.2.8:1234"
+		req.Header.Set("Origin", "https://evil.com")
+		res = httptest.NewRecorder()
+		ap.ServeHTTP(res, req)
+		So(res, shouldHaveStatus, 200)
+		So(res.Header().Get("Access-Control-Allow-Origin"), ShouldBeBlank)
+	})
+}
+
+func TestScopes(t *testing.T) {
+	Convey("Keys should only reach routes they have the scopes for", t, func() {
+		req, _ := http.NewRequest("POST", "/portal/api/account/token", toBody(map[string]interface{}{
+			"email":    "test@user.com",
+			"password": "test-password",
+		}))
+		req.Header.Set("Content-Type", "application/json")
+		res := httptest.NewRecorder()
+		ap.ServeHTTP(res, req)
+		ts := struct {
+			Token string
+		}{}
+		json.Unmarshal(res.Body.Bytes(), &ts)
+
+		req, _ = http.NewRequest("GET", "/portal/api/keys/scopes", nil)
+		req.Header.Set("Authorization", "Bearer "+ts.Token)
+		res = httptest.NewRecorder()
+		ap.ServeHTTP(res, req)
+		So(res, shouldHaveStatus, 200)
+		So(res.Body.String(), ShouldContainSubstring, "orders:write")
+
+		req, _ = http.NewRequest("POST", "/portal/api/keys", toBody(map[string]interface{}{"type": "APIKey", "scopes": []string{"orders:delete"}}))
+		req.Header.Set("Authorization", "Bearer "+ts.Token)
+		req.Header.Set("Content-Type", "application/json")
+		res = httptest.NewRecorder()
+		ap.ServeHTTP(res, req)
+		So(res, shouldHaveStatus, 400)
+
+		req, _ = http.NewRequest("POST", "/portal/api/keys", toBody(map[string]interface{}{"type": "APIKey", "scopes": []string{"orders:read"}}))
+		req.Header.Set("Authorization", "Bearer "+ts.Token)
+		req.Header.Set("Content-Type", "application/json")
+		res = httptest.NewRecorder()
+		ap.ServeHTTP(res, req)
+		So(res, shouldHaveStatus, 200)
+		var created apiplexy.Key
+		json.Unmarshal(res.Body.Bytes(), &created)
+		So(created.Scopes, ShouldResemble, []string{"orders:read"})
+
+		request := func(method, path string) *httptest.ResponseRecorder {
+			req, _ := http.NewRequest(method, path, nil)
+			req.RemoteAddr = "192.0.2.9:1234"
+			req.Header.Set("X-API-Key", created.Token)
+			res := httptest.NewRecorder()
+			ap.ServeHTTP(res, req)
+			return res
+		}
+
+		So(request("GET", "/api/orders/42"), shouldHaveStatus, 200)
+		res = request("POST", "/api/orders")
+		So(res, shouldHaveStatus, 403)
+		So(res.Body.String(), ShouldContainSubstring, "orders:write")
+
+		// revoke the key again, so the user is left with their HMAC key only
+		req, _ = http.NewRequest("POST", "/admin/api/keys/"+created.ID+"/revoke", nil)
+		req.Header.Set("Authorization", "Bearer test-admin-token")
+		res = httptest.NewRecorder()
+		ap.ServeHTTP(res, req)
+		So(res, shouldHaveStatus, 200)
+	})
+
+	Convey("Keyless requests should be turned away from routes requiring scopes", t, func() {
+		req, _ := http.NewRequest("GET", "/api/orders", nil)
+		req.RemoteAddr = "192.0.2.9:1234"
+		res := httptest.NewRecorder()
+		ap.ServeHTTP(res, req)
+		So(res, shouldHaveStatus, 403)
+	})
+}
+
+func TestKeyRotation(t *testing.T) {
+	signedRequest := func(keyID, secret, date string) *http.Request {
+		req, _ := http.NewRequest("GET", "/api/", nil)
+		req.RemoteAddr = "192.0.2.10:1234"
+		req.Header.Set("Date", date)
+		mac := hmac.New(sha256.New, []byte(secret))
+		mac.Write([]byte("(request-target): get /api/\ndate: " + date))
+		req.Header.Set("Authorization", fmt.Sprintf("Signature keyId=\"%s\",algorithm=\"hmac-sha256\",headers=\"(request-target) date\",signature=\"%s\"",
+			keyID, base64.StdEncoding.EncodeToString(mac.Sum(nil))))
+		return req
+	}
+	login := func() string {
+		req, _ := http.NewRequest("POST", "/portal/api/account/token", toBody(map[string]interface{}{
+			"email":    "test@user.com",
+			"password": "test-password",
+		}))
+		req.Header.Set("Content-Type", "application/json")
+		res := httptest.NewRecorder()
+		ap.ServeHTTP(res, req)
+		ts := struct {
+			Token string
+		}{}
+		json.Unmarshal(res.Body.Bytes(), &ts)
+		return ts.Token
+	}
+	portalRequest := func(method, path string, body interface{}, token string) *httptest.ResponseRecorder {
+		req, _ := http.NewRequest(method, "/portal/api"+path, nil)
+		if body != nil {
+			req, _ = http.NewRequest(method, "/portal/api"+path, toBody(body))
+			req.Header.Set("Content-Type", "application/json")
+		}
+		req.Header.Set("Authorization", "Bearer "+token)
+		res := httptest.NewRecorder()
+		ap.ServeHTTP(res, req)
+		return res
+	}
+	revoke := func(keyID string) *httptest.ResponseRecorder {
+		req, _ := http.NewRequest("POST", "/admin/api/keys/"+url.PathEscape(keyID)+"/revoke", nil)
+		req.Header.Set("Authorization", "Bearer test-admin-token")
+		res := httptest.NewRecorder()
+		ap.ServeHTTP(res, req)
+		return res
+	}
+
+	Convey("Rotated keys should accept both secrets during the grace period", t, func() {
+		token := login()
+		res := portalRequest("POST", "/keys", map[string]interface{}{"type": "HMAC"}, token)
+		So(res, shouldHaveStatus, 200)
+		var key apiplexy.Key
+		json.Unmarshal(res.Body.Bytes(), &key)
+		oldSecret := key.Data["secret"].(string)
+
+		earlier := time.Now().Add(-time.Second).UTC().Format(http.TimeFormat)
+		res = httptest.NewRecorder()
+		ap.ServeHTTP(res, signedRequest(key.ID, oldSecret, earlier))
+		So(res, shouldHaveStatus, 200)
+
+		So(portalRequest("POST", "/keys/rotate", map[string]interface{}{"key_id": "not-my-key"}, token), shouldHaveStatus, 404)
+		res = portalRequest("POST", "/keys/rotate", map[string]interface{}{"key_id": key.ID}, token)
+		So(res, shouldHaveStatus, 200)
+		var rotated apiplexy.Key
+		json.Unmarshal(res.Body.Bytes(), &rotated)
+		newSecret := rotated.Data["secret"].(string)
+		So(newSecret, ShouldNotEqual, oldSecret)
+
+		now := time.Now().UTC().Format(http.TimeFormat)
+		res = httptest.NewRecorder()
+		ap.ServeHTTP(res, signedRequest(key.ID, newSecret, now))
+		So(res, shouldHaveStatus, 200)
+		res = httptest.NewRecorder()
+		ap.ServeHTTP(res, signedRequest(key.ID, oldSecret, now))
+		So(res, shouldHaveStatus, 200)
+
+		So(revoke(key.ID), shouldHaveStatus, 200)
+	})
+
+	Convey("Keys should stop working once they expire", t, func() {
+		token := login()
+		past := time.Now().Add(-time.Hour)
+		So(portalRequest("POST", "/keys", map[string]interface{}{"type": "APIKey", "expires_at": past}, token), shouldHaveStatus, 400)
+
+		expires := time.Now().Add(time.Second)
+		res := portalRequest("POST", "/keys", map[string]interface{}{"type": "APIKey", "expires_at": expires}, token)
+		So(res, shouldHaveStatus, 200)
+		var key apiplexy.Key
+		json.Unmarshal(res.Body.Bytes(), &key)
+		So(key.ExpiresAt, ShouldNotBeNil)
+
+		res = portalRequest("GET", "/keys/expiring", nil, token)
+		So(res, shouldHaveStatus, 200)
+		So(res.Body.String(), ShouldContainSubstring, key.ID)
+
+		request := func() *httptest.ResponseRecorder {
+			req, _ := http.NewRequest("GET", "/api/", nil)
+			req.RemoteAddr = "192.0.2.10:1234"
+			req.Header.Set("X-API-Key", key.Token)
+			res := httptest.NewRecorder()
+			ap.ServeHTTP(res, req)
+			return res
+		}
+		So(request(), shouldHaveStatus, 200)
+		time.Sleep(time.Until(expires))
+		res = request()
+		So(res, shouldHaveStatus, 403)
+		So(res.Body.String(), ShouldContainSubstring, "expired")
+
+		So(revoke(key.ID), shouldHaveStatus, 200)
+	})
+}
+
+func TestKeyInvalidation(t *testing.T) {
+	Convey("Deleted keys should stop working immediately, on all gateway nodes", t, func() {
+		req, _ := http.NewRequest("POST", "/portal/api/account/token", toBody(map[string]interface{}{
+			"email":    "test@user.com",
+			"password": "test-password",
+		}))
+		req.Header.Set("Content-Type", "application/json")
+		res := httptest.NewRecorder()
+		ap.ServeHTTP(res, req)
+		ts := struct {
+			Token string
+		}{}
+		json.Unmarshal(res.Body.Bytes(), &ts)
+
+		req, _ = http.NewRequest("POST", "/portal/api/keys", toBody(map[string]interface{}{"type": "APIKey"}))
+		req.Header.Set("Authorization", "Bearer "+ts.Token)
+		req.Header.Set("Content-Type", "application/json")
+		res = httptest.NewRecorder()
+		ap.ServeHTTP(res, req)
+		So(res, shouldHaveStatus, 200)
+		var created apiplexy.Key
+		json.Unmarshal(res.Body.Bytes(), &created)
+
+		request := func() *httptest.ResponseRecorder {
+			req, _ := http.NewRequest("GET", "/api/", nil)
+			req.RemoteAddr = "192.0.2.11:1234"
+			req.Header.Set("X-API-Key", created.Token)
+			res := httptest.NewRecorder()
+			ap.ServeHTTP(res, req)
+			return res
+		}
+		So(request(), shouldHaveStatus, 200)
+		ttl, _ := redis.Int(rd.Do("PTTL", "auth_cache:"+created.ID))
+		So(ttl, ShouldBeBetweenOrEqual, 1, 5*60*1000)
+
+		// listen in like another gateway node would
+		sub, err := redis.Dial("tcp", "127.0.0.1:6379", redis.DialReadTimeout(5*time.Second))
+		So(err, ShouldBeNil)
+		defer sub.Close()
+		psc := redis.PubSubConn{Conn: sub}
+		So(psc.Subscribe("auth_invalidate"), ShouldBeNil)
+		_, ok := psc.Receive().(redis.Subscription)
+		So(ok, ShouldBeTrue)
+
+		req, _ = http.NewRequest("POST", "/portal/api/keys/delete", toBody(map[string]interface{}{"key_id": created.ID}))
+		req.Header.Set("Authorization", "Bearer "+ts.Token)
+		req.Header.Set("Content-Type", "application/json")
+		res = httptest.NewRecorder()
+		ap.ServeHTTP(res, req)
+		So(res, shouldHaveStatus, 200)
+
+		msg, ok := psc.Receive().(redis.Message)
+		So(ok, ShouldBeTrue)
+		So(string(msg.Data), ShouldEqual, `["`+created.ID+`"]`)
+		So(request(), shouldHaveStatus, 403)
+	})
+}
+
+func TestLocalKeyCache(t *testing.T) {
+	Convey("Keys cached in memory should be dropped when another node changes them", t, func() {
+		subscribers := func() int {
+			reply, _ := redis.Values(rd.Do("PUBSUB", "NUMSUB", "auth_invalidate"))
+			if len(reply) < 2 {
+				return 0
+			}
+			n, _ := redis.Int(reply[1], nil)
+			return n
+		}
+		before := subscribers()
+
+		config := apiplexy.ApiplexConfig{}
+		yaml.Unmarshal([]byte(yaml_config), &config)
+		config.Serve.Upstreams[0] = mockAPIURL
+		config.Keys.LocalCacheSize = 100
+		config.Keys.LocalCacheTTL = time.Minute
+		gw, err := apiplexy.New(config)
+		So(err, ShouldBeNil)
+		defer gw.Close()
+		for i := 0; i < 100 && subscribers() <= before; i++ {
+			time.Sleep(10 * time.Millisecond)
+		}
+
+		req, _ := http.NewRequest("POST", "/portal/api/account/token", toBody(map[string]interface{}{
+			"email":    "test@user.com",
+			"password": "test-password",
+		}))
+		req.Header.Set("Content-Type", "application/json")
+		res := httptest.NewRecorder()
+		ap.ServeHTTP(res, req)
+		ts := struct {
+			Token string
+		}{}
+		json.Unmarshal(res.Body.Bytes(), &ts)
+
+		req, _ = http.NewRequest("POST", "/portal/api/keys", toBody(map[string]interface{}{"type": "APIKey"}))
+		req.Header.Set("Authorization", "Bearer "+ts.Token)
+		req.Header.Set("Content-Type", "application/json")
+		res = httptest.NewRecorder()
+		ap.ServeHTTP(res, req)
+		So(res, shouldHaveStatus, 200)
+		var created apiplexy.Key
+		json.Unmarshal(res.Body.Bytes(), &created)
+
+		request := func(node http.Handler) *httptest.ResponseRecorder {
+			req, _ := http.NewRequest("GET", "/api/", nil)
+			req.RemoteAddr = "192.0.2.15:1234"
+			req.Header.Set("X-API-Key", created.Token)
+			res := httptest.NewRecorder()
+			node.ServeHTTP(res, req)
+			return res
+		}
+		// the new node has a backend of its own, so it can only know the key
+		// from the shared cache in Redis
+		So(request(ap), shouldHaveStatus, 200)
+		So(request(gw), shouldHaveStatus, 200)
+		So(request(gw), shouldHaveStatus, 200)
+
+		req, _ = http.NewRequest("GET", "/metrics", nil)
+		res = httptest.NewRecorder()
+		gw.ServeHTTP(res, req)
+		body := res.Body.String()
+		So(body, ShouldContainSubstring, `apiplexy_auth_cache_lookups_total{result="hit",tier="local"} 1`)
+		So(body, ShouldContainSubstring, `apiplexy_auth_cache_lookups_total{result="miss",tier="local"} 1`)
+		So(body, ShouldContainSubstring, `apiplexy_auth_cache_lookups_total{result="hit",tier="redis"} 1`)
+		So(body, ShouldContainSubstring, "apiplexy_auth_local_cache_keys 1")
+
+		// revoke the key on the other node
+		req, _ = http.NewRequest("POST", "/portal/api/keys/delete", toBody(map[string]interface{}{"key_id": created.ID}))
+		req.Header.Set("Authorization", "Bearer "+ts.Token)
+		req.Header.Set("Content-Type", "application/json")
+		res = httptest.NewRecorder()
+		ap.ServeHTTP(res, req)
+		So(res, shouldHaveStatus, 200)
+
+		// the announcement arrives on its own time (but well within the quota)
+		res = request(gw)
+		for i := 0; i < 40 && res.Code == 200; i++ {
+			time.Sleep(25 * time.Millisecond)
+			res = request(gw)
+		}
+		So(res, shouldHaveStatus, 403)
+		So(res.Body.String(), ShouldContainSubstring, "does not exist")
+	})
+}
+
+func TestLockout(t *testing.T) {
+	Convey("Unknown keys should be remembered for a while", t, func() {
+		req, _ := http.NewRequest("GET", "/api/", nil)
+		req.RemoteAddr = "192.0.2.12:1234"
+		req.Header.Set("X-API-Key", "not-a-key")
+		res := httptest.NewRecorder()
+		ap.ServeHTTP(res, req)
+		So(res, shouldHaveStatus, 403)
+
+		h := sha256.Sum256([]byte("not-a-key"))
+		cacheKey := "auth_cache:" + hex.EncodeToString(h[:])
+		cached, _ := redis.String(rd.Do("GET", cacheKey))
+		So(cached, ShouldEqual, "null")
+		ttl, _ := redis.Int(rd.Do("PTTL", cacheKey))
+		So(ttl, ShouldBeBetweenOrEqual, 1, 30*1000)
+	})
+
+	Convey("Unknown keys should not be remembered with a negative cache TTL", t, func() {
+		config := apiplexy.ApiplexConfig{}
+		yaml.Unmarshal([]byte(yaml_config), &config)
+		config.Serve.Upstreams[0] = mockAPIURL
+		config.Keys.NegativeCacheTTL = -time.Second
+		gw, err := apiplexy.New(config)
+		So(err, ShouldBeNil)
+		defer gw.Close()
+
+		req, _ := http.NewRequest("GET", "/api/", nil)
+		req.RemoteAddr = "192.0.2.20:1234"
+		req.Header.Set("X-API-Key", "not-a-key-either")
+		res := httptest.NewRecorder()
+		gw.ServeHTTP(res, req)
+		So(res, shouldHaveStatus, 403)
+
+		h := sha256.Sum256([]byte("not-a-key-either"))
+		exists, _ := redis.Bool(rd.Do("EXISTS", "auth_cache:"+hex.EncodeToString(h[:])))
+		So(exists, ShouldBeFalse)
+	})
+
+	Convey("Clients failing to authenticate too often should be locked out", t, func() {
+		config := apiplexy.ApiplexConfig{}
+		yaml.Unmarshal([]byte(yaml_config), &config)
+		config.Serve.Upstreams[0] = mockAPIURL
+		config.Lockout.MaxFailures = 3
+		gw, err := apiplexy.New(config)
+		So(err, ShouldBeNil)
+		defer gw.Close()
+		defer rd.Do("DEL", "auth_failures:192.0.2.13")
+
+		request := func(ip, apiKey string) *httptest.ResponseRecorder {
+			req, _ := http.NewRequest("GET", "/api/", nil)
+			req.RemoteAddr = ip + ":1234"
+			req.Header.Set("X-API-Key", apiKey)
+			res := httptest.NewRecorder()
+			gw.ServeHTTP(res, req)
+			return res
+		}
+		for i := 0; i < 3; i++ {
+			So(request("192.0.2.13", fmt.Sprintf("guess-%d", i)), shouldHaveStatus, 403)
+		}
+		res := request("192.0.2.13", "guess-3")
+		So(res, shouldHaveStatus, 429)
+		So(res.Body.String(), ShouldContainSubstring, "Too many failed authentication attempts")
+		So(request("192.0.2.14", "guess-3"), shouldHaveStatus, 403)
+
+		// keyless requests are not affected
+		req, _ := http.NewRequest("GET", "/api/", nil)
+		req.RemoteAddr = "192.0.2.13:1234"
+		res = httptest.NewRecorder()
+		gw.ServeHTTP(res, req)
+		So(res, shouldHaveStatus, 200)
+		rd.Do("DEL", "auth_failures:192.0.2.14")
+	})
+}
+
+func TestIPRestrictions(t *testing.T) {
+	login := func() string {
+		req, _ := http.NewRequest("POST", "/portal/api/account/token", toBody(map[string]interface{}{
+			"email":    "test@user.com",
+			"password": "test-password",
+		}))
+		req.Header.Set("Content-Type", "application/json")
+		res := httptest.NewRecorder()
+		ap.ServeHTTP(res, req)
+		ts := struct {
+			Token string
+		}{}
+		json.Unmarshal(res.Body.Bytes(), &ts)
+		return ts.Token
+	}
+	portalRequest := func(path string, body interface{}, token string) *httptest.ResponseRecorder {
+		req, _ := http.NewRequest("POST", "/portal/api"+path, toBody(body))
+		req.Header.Set("Content-Type", "application/json")
+		req.Header.Set("Authorization", "Bearer "+token)
+		res := httptest.NewRecorder()
+		ap.ServeHTTP(res, req)
+		return res
+	}
+
+	Convey("Keys should only work from the networks they are limited to", t, func() {
+		token := login()
+		So(portalRequest("/keys", map[string]interface{}{"type": "APIKey", "allow_ips": []string{"nonsense"}}, token), shouldHaveStatus, 400)
+		res := portalRequest("/keys", map[string]interface{}{
+			"type":      "APIKey",
+			"allow_ips": []string{"198.51.100.0/24"},
+			"deny_ips":  []string{"198.51.100.7"},
+		}, token)
+		So(res, shouldHaveStatus, 200)
+		var key apiplexy.Key
+		json.Unmarshal(res.Body.Bytes(), &key)
+		So(key.AllowIPs, ShouldResemble, []string{"198.51.100.0/24"})
+
+		request := func(ip string, header, value string) *httptest.ResponseRecorder {
+			req, _ := http.NewRequest("GET", "/api/", nil)
+			req.RemoteAddr = ip + ":1234"
+			req.Header.Set(header, value)
+			res := httptest.NewRecorder()
+			ap.ServeHTTP(res, req)
+			return res
+		}
+		So(request("198.51.100.1", "X-API-Key", key.Token), shouldHaveStatus, 200)
+		So(request("198.51.100.7", "X-API-Key", key.Token), shouldHaveStatus, 403)
+		res = request("192.0.2.16", "X-API-Key", key.Token)
+		So(res, shouldHaveStatus, 403)
+		So(res.Body.String(), ShouldContainSubstring, "may not be used from 192.0.2.16")
+
+		// access tokens carry the limits along
+		req, _ := http.NewRequest("POST", "/oauth2/token", strings.NewReader(url.Values{
+			"grant_type":    {"client_credentials"},
+			"client_id":     {key.ID},
+			"client_secret": {key.Token},
+		}.Encode()))
+		req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+		res = httptest.NewRecorder()
+		ap.ServeHTTP(res, req)
+		So(res, shouldHaveStatus, 200)
+		tr := struct {
+			AccessToken string `json:"access_token"`
+		}{}
+		json.Unmarshal(res.Body.Bytes(), &tr)
+		So(request("198.51.100.1", "Authorization", "Bearer "+tr.AccessToken), shouldHaveStatus, 200)
+		So(request("192.0.2.16", "Authorization", "Bearer "+tr.AccessToken), shouldHaveStatus, 403)
+
+		So(portalRequest("/keys/ips", map[string]interface{}{"key_id": "not-my-key"}, token), shouldHaveStatus, 404)
+		So(portalRequest("/keys/ips", map[string]interface{}{"key_id": key.ID, "deny_ips": []string{"198.51.100.0/33"}}, token), shouldHaveStatus, 400)
+		res = portalRequest("/keys/ips", map[string]interface{}{"key_id": key.ID, "deny_ips": []string{"198.51.100.0/24"}}, token)
+		So(res, shouldHaveStatus, 200)
+		So(request("192.0.2.16", "X-API-Key", key.Token), shouldHaveStatus, 200)
+		So(request("198.51.100.1", "X-API-Key", key.Token), shouldHaveStatus, 403)
+
+		req, _ = http.NewRequest("POST", "/admin/api/keys/"+url.PathEscape(key.ID)+"/revoke", nil)
+		req.Header.Set("Authorization", "Bearer test-admin-token")
+		res = httptest.NewRecorder()
+		ap.ServeHTTP(res, req)
+		So(res, shouldHaveStatus, 200)
+	})
+
+	Convey("Denied networks should be turned away, even behind trusted proxies", t, func() {
+		config := apiplexy.ApiplexConfig{}
+		yaml.Unmarshal([]byte(yaml_config), &config)
+		config.Serve.Upstreams[0] = mockAPIURL
+		config.Network.TrustedProxies = []string{"192.0.2.17"}
+		config.Network.Deny = []string{"198.51.100.64/26"}
+		gw, err := apiplexy.New(config)
+		So(err, ShouldBeNil)
+		defer gw.Close()
+
+		request := func(ip string, forwardedFor string) *httptest.ResponseRecorder {
+			req, _ := http.NewRequest("GET", "/api/", nil)
+			req.RemoteAddr = ip + ":1234"
+			if forwardedFor != "" {
+				req.Header.Set("X-Forwarded-For", forwardedFor)
+			}
+			res := httptest.NewRecorder()
+			gw.ServeHTTP(res, req)
+			return res
+		}
+		res := request("198.51.100.65", "")
+		So(res, shouldHaveStatus, 403)
+		So(res.Body.String(), ShouldContainSubstring, "Requests from your network are not accepted")
+		So(request("192.0.2.17", "198.51.100.66"), shouldHaveStatus, 403)
+		So(request("192.0.2.17", "198.51.100.2"), shouldHaveStatus, 200)
+		// only trusted proxies get to say who they forward for
+		So(request("192.0.2.18", "198.51.100.66"), shouldHaveStatus, 200)
+
+		// not just from the API, but from everything the gateway serves
+		for _, path := range []string{"/oauth2/token", "/portal/api/account/token", "/admin/api/keys/x"} {
+			req, _ := http.NewRequest("POST", path, nil)
+			req.RemoteAddr = "198.51.100.65:1234"
+			res := httptest.NewRecorder()
+			gw.ServeHTTP(res, req)
+			So(res, shouldHaveStatus, 403)
+			So(res.Body.String(), ShouldContainSubstring, "Requests from your network are not accepted")
+		}
+
+		config.Network.Deny = []string{"nonsense"}
+		_, err = apiplexy.New(config)
+		So(err, ShouldNotBeNil)
+	})
+}
+
+func TestOAuth2(t *testing.T) {
+	Convey("Keys should be exchangeable for access tokens on the token endpoint", t, func() {
+		req, _ := http.NewRequest("POST", "/portal/api/account/token", toBody(map[string]interface{}{
+			"email":    "test@user.com",
+			"password": "test-password",
+		}))
+		req.Header.Set("Content-Type", "application/json")
+		res := httptest.NewRecorder()
+		ap.ServeHTTP(res, req)
+		ts := struct {
+			Token string
+		}{}
+		json.Unmarshal(res.Body.Bytes(), &ts)
+
+		// API keys are exchanged by their ID (the hash) and the plaintext key
+		req, _ = http.NewRequest("POST", "/portal/api/keys", toBody(map[string]interface{}{"type": "APIKey"}))
+		req.Header.Set("Authorization", "Bearer "+ts.Token)
+		req.Header.Set("Content-Type", "application/json")
+		res = httptest.NewRecorder()
+		ap.ServeHTTP(res, req)
+		So(res, shouldHaveStatus, 200)
+		var created apiplexy.Key
+		json.Unmarshal(res.Body.Bytes(), &created)
+		secret := created.Token
+		So(secret, ShouldNotBeBlank)
+
+		requestToken := func(id, secret string) *httptest.ResponseRecorder {
+			form := url.Values{"grant_type": {"client_credentials"}}
+			req, _ := http.NewRequest("POST", "/oauth2/token", strings.NewReader(form.Encode()))
+			req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+			req.SetBasicAuth(url.QueryEscape(id), url.QueryEscape(secret))
+			res := httptest.NewRecorder()
+			ap.ServeHTTP(res, req)
+			return res
+		}
+
+		res = requestToken(created.ID, secret)
+		So(res, shouldHaveStatus, 200)
+		So(res.Header().Get("Cache-Control"), ShouldEqual, "no-store")
+		tr := struct {
+			AccessToken string `json:"access_token"`
+			TokenType   string `json:"token_type"`
+			ExpiresIn   int    `json:"expires_in"`
+		}{}
+		json.Unmarshal(res.Body.Bytes(), &tr)
+		So(tr.TokenType, ShouldEqual, "Bearer")
+		So(tr.ExpiresIn, ShouldEqual, 600)
+
+		req, _ = http.NewRequest("GET", "/api/", nil)
+		req.RemoteAddr = "192.0.2.6:1234"
+		req.Header.Set("Authorization", "Bearer "+tr.AccessToken)
+		res = httptest.NewRecorder()
+		ap.ServeHTTP(res, req)
+		So(res, shouldHaveStatus, 200)
+		So(res.Body.String(), ShouldEqual, "API-OK")
+
+		So(requestToken(created.ID, "wrong-secret"), shouldHaveStatus, 401)
+		So(requestToken("no-such-key", secret), shouldHaveStatus, 401)
+
+		// tokens don't outlive their key, and expired keys get none
+		expires := time.Now().Add(1500 * time.Millisecond)
+		req, _ = http.NewRequest("POST", "/portal/api/keys", toBody(map[string]interface{}{"type": "APIKey", "expires_at": expires}))
+		req.Header.Set("Authorization", "Bearer "+ts.Token)
+		req.Header.Set("Content-Type", "application/json")
+		res = httptest.NewRecorder()
+		ap.ServeHTTP(res, req)
+		So(res, shouldHaveStatus, 200)
+		var expiring apiplexy.Key
+		json.Unmarshal(res.Body.Bytes(), &expiring)
+		res = requestToken(expiring.ID, expiring.Token)
+		So(res, shouldHaveStatus, 200)
+		json.Unmarshal(res.Body.Bytes(), &tr)
+		So(tr.ExpiresIn, ShouldBeBetweenOrEqual, 0, 2)
+		time.Sleep(time.Until(expires))
+		res = requestToken(expiring.ID, expiring.Token)
+		So(res, shouldHaveStatus, 401)
+		So(res.Body.String(), ShouldContainSubstring, "expired")
+		req, _ = http.NewRequest("POST", "/admin/api/keys/"+url.PathEscape(expiring.ID)+"/revoke", nil)
+		req.Header.Set("Authorization", "Bearer test-admin-token")
+		res = httptest.NewRecorder()
+		ap.ServeHTTP(res, req)
+		So(res, shouldHaveStatus, 200)
+
+		req, _ = http.NewRequest("POST", "/oauth2/token", strings.NewReader("grant_type=password"))
+		req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+		res = httptest.NewRecorder()
+		ap.ServeHTTP(res, req)
+		So(res, shouldHaveStatus, 400)
+		So(res.Body.String(), ShouldContainSubstring, "unsupported_grant_type")
+
+		// revoke the key again, so the user is left with their HMAC key only
+		req, _ = http.NewRequest("POST", "/admin/api/keys/"+created.ID+"/revoke", nil)
+		req.Header.Set("Authorization", "Bearer test-admin-token")
+		res = httptest.NewRecorder()
+		ap.ServeHTTP(res, req)
+		So(res, shouldHaveStatus, 200)
+	})
+
+	Convey("Guessing secrets on the token endpoint should lead to a lockout", t, func() {
+		config := apiplexy.ApiplexConfig{}
+		yaml.Unmarshal([]byte(yaml_config), &config)
+		config.Serve.Upstreams[0] = mockAPIURL
+		config.Lockout.MaxFailures = 2
+		gw, err := apiplexy.New(config)
+		So(err, ShouldBeNil)
+		defer gw.Close()
+		defer rd.Do("DEL", "auth_failures:192.0.2.19")
+
+		requestToken := func(id, secret string) *httptest.ResponseRecorder {
+			form := url.Values{"grant_type": {"client_credentials"}, "client_id": {id}, "client_secret": {secret}}
+			req, _ := http.NewRequest("POST", "/oauth2/token", strings.NewReader(form.Encode()))
+			req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+			req.RemoteAddr = "192.0.2.19:1234"
+			res := httptest.NewRecorder()
+			gw.ServeHTTP(res, req)
+			return res
+		}
+		So(requestToken("no-such-key", "guess-1"), shouldHaveStatus, 401)
+		So(requestToken("no-such-key", "guess-2"), shouldHaveStatus, 401)
+		res := requestToken("no-such-key", "guess-3")
+		So(res, shouldHaveStatus, 429)
+		So(res.Body.String(), ShouldContainSubstring, "Too many failed authentication attempts")
+	})
+}
+
+func TestAdminAPI(t *testing.T) {
+	adminRequest := func(method, path string, body interface{}, token string) *httptest.ResponseRecorder {
+		var req *http.Request
+		if body != nil {
+			req, _ = http.NewRequest(method, "/admin/api"+path, toBody(body))
+			req.Header.Set("Content-Type", "application/json")
+		} else {
+			req, _ = http.NewRequest(method, "/admin/api"+path, nil)
+		}
+		if token != "" {
+			req.Header.Set("Authorization", "Bearer "+token)
+		}
+		res := httptest.NewRecorder()
+		ap.ServeHTTP(res, req)
+		return res
+	}
+	login := func() string {
+		req, _ := http.NewRequest("POST", "/portal/api/account/token", toBody(map[string]interface{}{
+			"email":    "test@user.com",
+			"password": "test-password",
+		}))
+		req.Header.Set("Content-Type", "application/json")
+		res := httptest.NewRecorder()
+		ap.ServeHTTP(res, req)
+		ts := struct {
+			Token string
+		}{}
+		json.Unmarshal(res.Body.Bytes(), &ts)
+		return ts.Token
+	}
+
+	Convey("The admin API should require the admin token or an admin user", t, func() {
+		So(adminRequest("GET", "/users", nil, ""), shouldHaveStatus, 403)
+		So(adminRequest("GET", "/users", nil, "wrong-token"), shouldHaveStatus, 403)
+		So(adminRequest("GET", "/users", nil, login()), shouldHaveStatus, 403)
+		So(adminRequest("GET", "/users", nil, "test-admin-token"), shouldHaveStatus, 200)
+	})
+
+	Convey("Admin users should be able to use their portal token", t, func() {
+		So(adminRequest("POST", "/users/test@user.com/admin", map[string]interface{}{"admin": true}, "test-admin-token"), shouldHaveStatus, 200)
+		res := adminRequest("GET", "/users/test@user.com", nil, login())
+		So(res, shouldHaveStatus, 200)
+		u := struct {
+			Admin bool
+			Keys  []apiplexy.Key
+		}{}
+		json.Unmarshal(res.Body.Bytes(), &u)
+		So(u.Admin, ShouldBeTrue)
+		So(len(u.Keys), ShouldEqual, 1)
+	})
+
+	Convey("Operators should be able to change quotas, inspect usage and revoke keys", t, func() {
+		token := login()
+		res := adminRequest("GET", "/users/test@user.com", nil, token)
+		u := struct {
+			Keys []apiplexy.Key
+		}{}
+		json.Unmarshal(res.Body.Bytes(), &u)
+		keyID := u.Keys[0].ID
+		escapedID := url.PathEscape(keyID)
+
+		So(adminRequest("POST", "/keys/"+escapedID+"/quota", map[string]interface{}{"quota": "nonexistent"}, token), shouldHaveStatus, 400)
+		So(adminRequest("POST", "/keys/"+escapedID+"/quota", map[string]interface{}{"quota": "default"}, token), shouldHaveStatus, 200)
+
+		rd.Do("SETEX", "quota:key:"+keyID, 300, 42)
+		res = adminRequest("GET", "/usage/"+escapedID, nil, token)
+		So(res, shouldHaveStatus, 200)
+		usage := struct {
+			Key struct {
+				Used int
+				Max  int
+			}
+		}{}
+		json.Unmarshal(res.Body.Bytes(), &usage)
+		So(usage.Key.Used, ShouldEqual, 42)
+		So(usage.Key.Max, ShouldEqual, 5000)
+		So(adminRequest("DELETE", "/usage/"+escapedID, nil, token), shouldHaveStatus, 200)
+		used, _ := redis.Int(rd.Do("GET", "quota:key:"+keyID))
+		So(used, ShouldEqual, 0)
+
+		So(adminRequest("POST", "/keys/"+escapedID+"/revoke", nil, token), shouldHaveStatus, 200)
+		So(adminRequest("GET", "/keys/"+escapedID, nil, token), shouldHaveStatus, 404)
+	})
+
+	Convey("Resetting usage should only touch the counters of that key", t, func() {
+		token := login()
+		others := []string{"quota:ip:globber:192.0.2.1", "quota:ip:glob*:x:192.0.2.1", "quota:ip:glob:2001:db8::1"}
+		for _, rkey := range append(others, "quota:ip:glob*:192.0.2.1", "quota:ip:glob*:2001:db8::1") {
+			rd.Do("SETEX", rkey, 300, 1)
+		}
+		So(adminRequest("DELETE", "/usage/"+url.PathEscape("glob*"), nil, token), shouldHaveStatus, 200)
+		for _, rkey := range others {
+			exists, _ := redis.Bool(rd.Do("EXISTS", rkey))
+			So(exists, ShouldBeTrue)
+		}
+		for _, rkey := range []string{"quota:ip:glob*:192.0.2.1", "quota:ip:glob*:2001:db8::1"} {
+			exists, _ := redis.Bool(rd.Do("EXISTS", rkey))
+			So(exists, ShouldBeFalse)
+		}
+		for _, rkey := range others {
+			rd.Do("DEL", rkey)
+		}
+	})
+
+	Convey("Deactivated users should no longer be able to log in", t, func() {
+		So(adminRequest("POST", "/users/test@user.com/deactivate", nil, "test-admin-token"), shouldHaveStatus, 200)
+		So(login(), ShouldEqual, "")
+		So(adminRequest("POST", "/users/test@user.com/activate", nil, "test-admin-token"), shouldHaveStatus, 200)
+		So(login(), ShouldNotEqual, "")
+	})
+}
@@ -29,18 +29,28 @@ func (sql *SQLKeyBackend) GetKey(keyId string, keyType string) (*apiplexy.Key, e
 			args[i] = keyType
 		}
 	}
-	row := sql.stmt.QueryRow(args...)
+	rows, err := sql.stmt.Query(args...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	if !rows.Next() {
+		return nil, rows.Err()
+	}
 	k := apiplexy.Key{
 		Type: keyType,
 	}
-	var jsonData string
-	err := row.Scan(&k.ID, &k.Realm, &k.Quota, &jsonData)
-	if err != nil {
-		if err == gosql.ErrNoRows {
-			return nil, nil
-		} else {
-			return nil, err
-		}
+	var jsonData, scopes string
+	fields := []interface{}{&k.ID, &k.Realm, &k.Quota, &jsonData}
+	// an optional fifth column holds the key's scopes
+	if cols, err := rows.Columns(); err == nil && len(cols) > 4 {
+		fields = append(fields, &scopes)
+	}
+	if err := rows.Scan(fields...); err != nil {
+		return nil, err
+	}
+	if scopes != "" {
+		k.Scopes = strings.Fields(scopes)
 	}
 	if err = json.Unmarshal([]byte(jsonData), &k.Data); err != nil {
 		return nil, err
@@ -85,6 +95,20 @@ func (sql *SQLKeyBackend) Configure(config map[string]interface{}) error {
 	return nil
 }
 
+func (sql *SQLKeyBackend) Health() error {
+	return sql.db.Ping()
+}
+
+func (sql *SQLKeyBackend) Close() error {
+	if sql.stmt != nil {
+		sql.stmt.Close()
+	}
+	if sql.db != nil {
+		return sql.db.Close()
+	}
+	return nil
+}
+
 func init() {
 	// _ = apiplexy.BackendPlugin(&SQLKeyBackend{})
 	apiplexy.RegisterPlugin(
@@ -22,17 +22,31 @@ type sqlDBKey struct {
 	Type      string
 	Data      string
 	Quota     string
+	Scopes    string
+	AllowIPs  string `gorm:"column:allow_ips"`
+	DenyIPs   string `gorm:"column:deny_ips"`
 	User      string `sql:"not null;index"`
+	ExpiresAt *time.Time
 	CreatedAt time.Time
 	DeletedAt *time.Time
 }
 
 func (k *sqlDBKey) toKey() *apiplexy.Key {
 	ck := apiplexy.Key{
-		ID:    k.KeyID,
-		Realm: k.Realm,
-		Type:  k.Type,
-		Quota: k.Quota,
+		ID:        k.KeyID,
+		Realm:     k.Realm,
+		Type:      k.Type,
+		Quota:     k.Quota,
+		ExpiresAt: k.ExpiresAt,
+	}
+	if k.Scopes != "" {
+		ck.Scopes = strings.Fields(k.Scopes)
+	}
+	if k.AllowIPs != "" {
+		ck.AllowIPs = strings.Fields(k.AllowIPs)
+	}
+	if k.DenyIPs != "" {
+		ck.DenyIPs = strings.Fields(k.DenyIPs)
 	}
 	json.Unmarshal([]byte(k.Data), &ck.Data)
 	return &ck
@@ -77,6 +91,10 @@ func (sql *SQLDBBackend) GetKey(keyId string, keyType string) (*apiplexy.Key, er
 	if sql.db.Where(sqlDBKey{KeyID: keyId, Type: keyType}).First(&k).RecordNotFound() {
 		return nil, nil
 	}
+	// keys of deactivated users don't work
+	if sql.db.Where(&sqlDBUser{Email: k.User, Active: true}).First(&sqlDBUser{}).RecordNotFound() {
+		return nil, nil
+	}
 	return k.toKey(), nil
 }
 
@@ -167,17 +185,41 @@ func (sql *SQLDBBackend) AddKey(email string, key *apiplexy.Key) error {
 	}
 	bd, _ := json.Marshal(key.Data)
 	k := sqlDBKey{
-		KeyID: key.ID,
-		Realm: key.Realm,
-		Type:  key.Type,
-		Quota: key.Quota,
-		Data:  string(bd[:]),
-		User:  email,
+		KeyID:     key.ID,
+		Realm:     key.Realm,
+		Type:      key.Type,
+		Quota:     key.Quota,
+		Scopes:    strings.Join(key.Scopes, " "),
+		AllowIPs:  strings.Join(key.AllowIPs, " "),
+		DenyIPs:   strings.Join(key.DenyIPs, " "),
+		Data:      string(bd[:]),
+		User:      email,
+		ExpiresAt: key.ExpiresAt,
 	}
 	sql.db.Create(&k)
 	return nil
 }
 
+func (sql *SQLDBBackend) UpdateKey(email string, key *apiplexy.Key) error {
+	k := sqlDBKey{}
+	if sql.db.Where(sqlDBKey{KeyID: key.ID}).First(&k).RecordNotFound() {
+		return fmt.Errorf("Key does not exist.")
+	}
+	if k.User != email {
+		return fmt.Errorf("You are not the owner of this key.")
+	}
+	bd, _ := json.Marshal(key.Data)
+	// a map, so that cleared fields are written too
+	return sql.db.Model(&k).Where(sqlDBKey{KeyID: key.ID}).UpdateColumns(map[string]interface{}{
+		"realm":      key.Realm,
+		"scopes":     strings.Join(key.Scopes, " "),
+		"allow_ips":  strings.Join(key.AllowIPs, " "),
+		"deny_ips":   strings.Join(key.DenyIPs, " "),
+		"data":       string(bd[:]),
+		"expires_at": key.ExpiresAt,
+	}).Error
+}
+
 func (sql *SQLDBBackend) DeleteKey(email string, keyID string) error {
 	k := sqlDBKey{}
 	if sql.db.Where(sqlDBKey{KeyID: keyID}).First(&k).RecordNotFound() {
@@ -202,6 +244,67 @@ func (sql *SQLDBBackend) GetAllKeys(email string) ([]*apiplexy.Key, error) {
 	return cks, nil
 }
 
+func (sql *SQLDBBackend) IsAdmin(email string) bool {
+	u := sqlDBUser{}
+	if sql.db.Where(&sqlDBUser{Email: email, Active: true}).First(&u).RecordNotFound() {
+		return false
+	}
+	return u.Admin
+}
+
+func (sql *SQLDBBackend) SetAdmin(email string, admin bool) error {
+	u := sqlDBUser{}
+	if sql.db.Where(&sqlDBUser{Email: email}).First(&u).RecordNotFound() {
+		return fmt.Errorf("User not found.")
+	}
+	// UpdateColumns skips zero values, so false needs to be set explicitly
+	return sql.db.Model(&u).Where(&sqlDBUser{Email: email}).UpdateColumn("admin", admin).Error
+}
+
+func (sql *SQLDBBackend) ListUsers(offset int, limit int) ([]*apiplexy.User, error) {
+	us := []sqlDBUser{}
+	if err := sql.db.Order("email").Offset(offset).Limit(limit).Find(&us).Error; err != nil {
+		return nil, err
+	}
+	cus := make([]*apiplexy.User, len(us))
+	for i, u := range us {
+		cus[i] = u.toUser()
+	}
+	return cus, nil
+}
+
+func (sql *SQLDBBackend) DeactivateUser(email string) error {
+	u := sqlDBUser{}
+	if sql.db.Where(&sqlDBUser{Email: email}).First(&u).RecordNotFound() {
+		return fmt.Errorf("User not found.")
+	}
+	return sql.db.Model(&u).Where(&sqlDBUser{Email: email}).UpdateColumn("active", false).Error
+}
+
+func (sql *SQLDBBackend) FindKey(keyID string) (*apiplexy.Key, string, error) {
+	k := sqlDBKey{}
+	if sql.db.Where(sqlDBKey{KeyID: keyID}).First(&k).RecordNotFound() {
+		return nil, "", nil
+	}
+	return k.toKey(), k.User, nil
+}
+
+func (sql *SQLDBBackend) SetKeyQuota(keyID string, quota string) error {
+	k := sqlDBKey{}
+	if sql.db.Where(sqlDBKey{KeyID: keyID}).First(&k).RecordNotFound() {
+		return fmt.Errorf("Key does not exist.")
+	}
+	return sql.db.Model(&k).Where(sqlDBKey{KeyID: keyID}).UpdateColumn("quota", quota).Error
+}
+
+func (sql *SQLDBBackend) RevokeKey(keyID string) error {
+	k := sqlDBKey{}
+	if sql.db.Where(sqlDBKey{KeyID: keyID}).First(&k).RecordNotFound() {
+		return fmt.Errorf("Key does not exist.")
+	}
+	return sql.db.Delete(&k).Error
+}
+
 func (sql *SQLDBBackend) DefaultConfig() map[string]interface{} {
 	return map[string]interface{}{
 		"driver":            strings.Join(gosql.Drivers(), "/"),
@@ -231,8 +334,17 @@ func (sql *SQLDBBackend) Configure(config map[string]interface{}) error {
 	return nil
 }
 
+func (sql *SQLDBBackend) Health() error {
+	return sql.db.DB().Ping()
+}
+
+func (sql *SQLDBBackend) Close() error {
+	return sql.db.Close()
+}
+
 func init() {
-	// _ = apiplexy.ManagementBackendPlugin(&SQLDBBackend{})
+	// _ = apiplexy.AdminBackendPlugin(&SQLDBBackend{})
+	// _ = apiplexy.KeyUpdatingBackendPlugin(&SQLDBBackend{})
 	apiplexy.RegisterPlugin(
 		"sql-full",
 		"Use popular SQL databases as backend stores (with full user/key management).",
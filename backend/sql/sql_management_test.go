@@ -8,6 +8,7 @@ import (
 	"os"
 	"strings"
 	"testing"
+	"time"
 )
 
 var plugin apiplexy.ManagementBackendPlugin
@@ -149,6 +150,35 @@ func TestKeyManagement(t *testing.T) {
 		So(k.ID, ShouldEqual, key.ID)
 	})
 
+	Convey("Updating a key should store its new data and expiry", t, func() {
+		expires := time.Now().Add(time.Hour).Truncate(time.Second)
+		updated := key
+		updated.Data = map[string]interface{}{"secret": "new-secret"}
+		updated.ExpiresAt = &expires
+		updater, ok := plugin.(apiplexy.KeyUpdatingBackendPlugin)
+		So(ok, ShouldBeTrue)
+		So(updater.UpdateKey("not-owner@user.com", &updated), ShouldNotBeNil)
+		So(updater.UpdateKey("test@user.com", &updated), ShouldBeNil)
+
+		k, err := plugin.GetKey("mykeyid", "TestKey")
+		So(err, ShouldBeNil)
+		So(k.Data["secret"], ShouldEqual, "new-secret")
+		So(k.ExpiresAt, ShouldNotBeNil)
+		So(k.ExpiresAt.Equal(expires), ShouldBeTrue)
+	})
+
+	Convey("Updating a key should store the networks it may be used from", t, func() {
+		updated := key
+		updated.AllowIPs = []string{"198.51.100.0/24", "2001:db8::/32"}
+		updated.DenyIPs = []string{"198.51.100.7"}
+		So(plugin.(apiplexy.KeyUpdatingBackendPlugin).UpdateKey("test@user.com", &updated), ShouldBeNil)
+
+		k, err := plugin.GetKey("mykeyid", "TestKey")
+		So(err, ShouldBeNil)
+		So(k.AllowIPs, ShouldResemble, updated.AllowIPs)
+		So(k.DenyIPs, ShouldResemble, updated.DenyIPs)
+	})
+
 	Convey("Deleting a key the user does not own should not work", t, func() {
 		So(plugin.DeleteKey("not-owner@user.com", "mykeyid"), ShouldNotBeNil)
 	})
@@ -170,3 +200,61 @@ func TestKeyManagement(t *testing.T) {
 	})
 
 }
+
+func TestAdminFunctions(t *testing.T) {
+	admin := plugin.(apiplexy.AdminBackendPlugin)
+	key := apiplexy.Key{
+		ID:    "adminkeyid",
+		Type:  "TestKey",
+		Quota: "default",
+	}
+	plugin.AddKey("test@user.com", &key)
+
+	Convey("Users should only be admins once made admins", t, func() {
+		So(admin.IsAdmin("test@user.com"), ShouldBeFalse)
+		So(admin.SetAdmin("test@user.com", true), ShouldBeNil)
+		So(admin.IsAdmin("test@user.com"), ShouldBeTrue)
+		So(admin.SetAdmin("test@user.com", false), ShouldBeNil)
+		So(admin.IsAdmin("test@user.com"), ShouldBeFalse)
+	})
+
+	Convey("Listing users should page through all users", t, func() {
+		other := apiplexy.User{Email: "another@user.com", Name: "Another User"}
+		So(plugin.AddUser(other.Email, "password", &other), ShouldBeNil)
+		users, err := admin.ListUsers(0, 10)
+		So(err, ShouldBeNil)
+		So(len(users), ShouldEqual, 2)
+		So(users[0].Email, ShouldEqual, "another@user.com")
+		users, err = admin.ListUsers(1, 10)
+		So(err, ShouldBeNil)
+		So(len(users), ShouldEqual, 1)
+	})
+
+	Convey("Keys should be found by ID alone, and their quota changed", t, func() {
+		k, owner, err := admin.FindKey("adminkeyid")
+		So(err, ShouldBeNil)
+		So(owner, ShouldEqual, "test@user.com")
+		So(k.Quota, ShouldEqual, "default")
+		So(admin.SetKeyQuota("adminkeyid", "premium"), ShouldBeNil)
+		k, _, _ = admin.FindKey("adminkeyid")
+		So(k.Quota, ShouldEqual, "premium")
+	})
+
+	Convey("Keys of deactivated users should stop working", t, func() {
+		So(admin.DeactivateUser("test@user.com"), ShouldBeNil)
+		So(plugin.GetUser("test@user.com").Active, ShouldBeFalse)
+		k, err := plugin.GetKey("adminkeyid", "TestKey")
+		So(err, ShouldBeNil)
+		So(k, ShouldBeNil)
+		So(plugin.ActivateUser("test@user.com"), ShouldBeNil)
+		k, _ = plugin.GetKey("adminkeyid", "TestKey")
+		So(k, ShouldNotBeNil)
+	})
+
+	Convey("Revoked keys should be gone", t, func() {
+		So(admin.RevokeKey("adminkeyid"), ShouldBeNil)
+		k, _, _ := admin.FindKey("adminkeyid")
+		So(k, ShouldBeNil)
+		So(admin.RevokeKey("adminkeyid"), ShouldNotBeNil)
+	})
+}
@@ -1,14 +1,17 @@
 package apiplexy
 
 import (
+	"context"
 	"fmt"
 	"github.com/dchest/uniuri"
 	"github.com/garyburd/redigo/redis"
 	"log"
+	"math"
 	"net/http"
 	"net/url"
 	"reflect"
 	"strconv"
+	"sync"
 	"time"
 )
 
@@ -27,20 +30,34 @@ type APIUpstream struct {
 }
 
 type apiplex struct {
-	signingKey    string
-	upstreams     []APIUpstream
-	apipath       string
-	authCacheMins int
-	quotas        map[string]apiplexQuota
-	allowKeyless  bool
-	redis         *redis.Pool
-	auth          []AuthPlugin
-	backends      []BackendPlugin
-	usermgmt      ManagementBackendPlugin
-	postauth      []PostAuthPlugin
-	preupstream   []PreUpstreamPlugin
-	postupstream  []PostUpstreamPlugin
-	logging       []LoggingPlugin
+	signingKey   string
+	upstreams    []APIUpstream
+	apipath      string
+	quotas       map[string]apiplexQuota
+	allowKeyless bool
+	redis        *redis.Pool
+	auth         []AuthPlugin
+	backends     []BackendPlugin
+	usermgmt     ManagementBackendPlugin
+	postauth     []PostAuthPlugin
+	preupstream  []PreUpstreamPlugin
+	postupstream []PostUpstreamPlugin
+	logging      []LoggingPlugin
+	plugins      []pluginInstance
+	conditions   map[interface{}]*apiplexPluginCondition
+	pluginNames  map[interface{}]string
+	metrics      *apiplexMetrics
+	realms       *apiplexRealms
+	scopes       *apiplexScopes
+	keys         apiplexConfigKeys
+	lockout      apiplexConfigLockout
+	backendSlots chan struct{}
+	keyCache     *keyCache
+	network      *apiplexNetwork
+	tracing      *apiplexTracing
+	handler      http.Handler
+	cancel       context.CancelFunc
+	inflight     sync.WaitGroup
 }
 
 // RegisterPlugin makes your plugin available to apiplexy. You should probably
@@ -88,12 +105,16 @@ func ExampleConfiguration(pluginNames []string) (*ApiplexConfig, error) {
 		},
 		Serve: apiplexConfigServe{
 			Port:       5000,
-			API:        "/",
+			API:        "/api/",
 			Upstreams:  []string{"http://your-actual-api:8000/"},
 			PortalAPI:  "/portal/api/",
 			Portal:     "/portal/",
 			SigningKey: uniuri.NewLen(64),
 		},
+		Probes: apiplexConfigProbes{
+			Liveness:  "/healthz",
+			Readiness: "/readyz",
+		},
 	}
 	plugins := apiplexConfigPlugins{}
 	for _, pname := range pluginNames {
@@ -127,28 +148,97 @@ func ExampleConfiguration(pluginNames []string) (*ApiplexConfig, error) {
 	return &c, nil
 }
 
-func ensureDefaults(target map[string]interface{}, defaults map[string]interface{}) error {
+// coerceNumber converts numeric config values to the numeric type of a default
+// value, so that YAML's ints and floats are interchangeable where that is
+// lossless (e.g. 3 for a default of 2.5, or 10.0 for a default of 5).
+func coerceNumber(value interface{}, defaultType reflect.Type) (interface{}, bool) {
+	f, ok := toFloat(value)
+	if !ok {
+		return nil, false
+	}
+	switch defaultType.Kind() {
+	case reflect.Float32, reflect.Float64:
+		return reflect.ValueOf(f).Convert(defaultType).Interface(), true
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64,
+		reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64:
+		if f != math.Trunc(f) {
+			return nil, false
+		}
+		return reflect.ValueOf(f).Convert(defaultType).Interface(), true
+	}
+	return nil, false
+}
+
+// ensureDefaults fills a map-based plugin configuration with the plugin's
+// defaults (for missing or null keys) and checks that the supplied values
+// type-match the defaults. Nested maps are checked recursively.
+func ensureDefaults(path string, target map[string]interface{}, defaults map[string]interface{}) error {
 	for dk, dv := range defaults {
-		defaultType := reflect.TypeOf(dv)
-		if tv, ok := target[dk]; ok {
-			if reflect.TypeOf(tv) != defaultType {
-				return fmt.Errorf("Field '%s': expected a value of type %T.", dk, dv)
+		fpath := joinPath(path, dk)
+		tv, ok := target[dk]
+		if !ok || tv == nil {
+			target[dk] = dv
+			continue
+		}
+		if dv == nil {
+			continue
+		}
+		if dmap, isMap := normalizeMap(dv); isMap {
+			tmap, isMap := normalizeMap(tv)
+			if !isMap {
+				return fmt.Errorf("Field '%s': expected a map.", fpath)
 			}
-			defaultZero := reflect.New(defaultType)
-			if tv == defaultZero {
-				target[dk] = dv
+			if err := ensureDefaults(fpath, tmap, dmap); err != nil {
+				return err
 			}
-		} else {
-			target[dk] = dv
+			target[dk] = tmap
+			continue
+		}
+		defaultType := reflect.TypeOf(dv)
+		if reflect.TypeOf(tv) == defaultType {
+			continue
 		}
+		if n, ok := coerceNumber(tv, defaultType); ok {
+			target[dk] = n
+			continue
+		}
+		if defaultType.Kind() == reflect.Slice {
+			if _, isList := tv.([]interface{}); isList {
+				continue
+			}
+			return fmt.Errorf("Field '%s': expected a list.", fpath)
+		}
+		return fmt.Errorf("Field '%s': expected a value of type %T.", fpath, dv)
 	}
 	return nil
 }
 
+// configurePlugin feeds the user's configuration to a freshly created plugin.
+// Typed plugins get their config struct decoded and validated; map-based
+// plugins get their defaults filled in and type-checked.
+func configurePlugin(plugin interface{}, config map[string]interface{}) error {
+	if tp, ok := plugin.(TypedConfigPlugin); ok {
+		return TypedConfigure(tp, config)
+	}
+	p := plugin.(ApiplexPlugin)
+	if config == nil {
+		config = make(map[string]interface{})
+	}
+	if err := ensureDefaults("", config, p.DefaultConfig()); err != nil {
+		return err
+	}
+	return p.Configure(config)
+}
+
 // A little black magic here: buildPlugins uses reflection to reify and configure
 // actual working plugins from zero-value references. The plugins are also reflect-
 // typechecked so we don't run into nasty surprises later.
-func buildPlugins(plugins []apiplexPluginConfig, lifecyclePluginType reflect.Type) ([]interface{}, error) {
+//
+// Every built plugin is also recorded (with its stage and name) so the
+// gateway can run the optional lifecycle hooks on it later. Each config entry
+// yields its own plugin instance, so the same plugin can be configured several
+// times, e.g. with different configs and conditions for different routes.
+func (ap *apiplex) buildPlugins(stage string, plugins []apiplexPluginConfig, lifecyclePluginType reflect.Type) ([]interface{}, error) {
 	built := make([]interface{}, len(plugins))
 	for i, config := range plugins {
 		ptype, ok := registeredPlugins[config.Plugin]
@@ -161,16 +251,28 @@ func buildPlugins(plugins []apiplexPluginConfig, lifecyclePluginType reflect.Typ
 			return nil, fmt.Errorf("Plugin '%s' (%s) cannot be loaded as %s.", config.Plugin, ptype.pluginType.Name(), lifecyclePluginType.Name())
 		}
 
-		defConfig := pt.MethodByName("DefaultConfig").Call([]reflect.Value{})[0].Interface().(map[string]interface{})
-		if err := ensureDefaults(config.Config, defConfig); err != nil {
-			return nil, fmt.Errorf("While configuring '%s': %s", config.Plugin, err.Error())
-		}
-		maybeErr := pt.MethodByName("Configure").Call([]reflect.Value{reflect.ValueOf(config.Config)})[0].Interface()
-		if maybeErr != nil {
-			err := maybeErr.(error)
+		if err := configurePlugin(pt.Interface(), config.Config); err != nil {
 			return nil, fmt.Errorf("While configuring '%s': %s", config.Plugin, err.Error())
 		}
 		built[i] = pt.Interface()
+		if config.When != nil {
+			if stage == "auth" || stage == "backend" {
+				return nil, fmt.Errorf("Plugin '%s': conditions ('when') are only supported for postauth, preupstream, postupstream and logging plugins.", config.Plugin)
+			}
+			if err := validateCondition(config.When); err != nil {
+				return nil, fmt.Errorf("While configuring '%s': %s", config.Plugin, err.Error())
+			}
+			ap.conditions[built[i]] = config.When
+		}
+		name := fmt.Sprintf("%s/%s", stage, config.Plugin)
+		for _, other := range plugins[:i] {
+			if other.Plugin == config.Plugin {
+				name = fmt.Sprintf("%s[%d]", name, i)
+				break
+			}
+		}
+		ap.plugins = append(ap.plugins, pluginInstance{name: name, plugin: built[i]})
+		ap.pluginNames[built[i]] = name
 	}
 	return built, nil
 }
@@ -187,7 +289,7 @@ func ensureFinalSlash(s string) string {
 
 // constructs an Apiplex, i.e. an apiplexy struct that can run plugins on
 // requests and proxy them back to one or more upstream backends.
-func buildApiplex(config ApiplexConfig) (*apiplex, error) {
+func buildApiplex(config ApiplexConfig) (built *apiplex, err error) {
 	if config.Serve.API == "" {
 		config.Serve.API = "/"
 	}
@@ -198,10 +300,18 @@ func buildApiplex(config ApiplexConfig) (*apiplex, error) {
 
 	// TODO make everything configurable
 	ap := apiplex{
-		apipath:       ensureFinalSlash(config.Serve.API),
-		authCacheMins: 10,
-		signingKey:    config.Serve.SigningKey,
+		apipath:     ensureFinalSlash(config.Serve.API),
+		signingKey:  config.Serve.SigningKey,
+		conditions:  make(map[interface{}]*apiplexPluginCondition),
+		pluginNames: make(map[interface{}]string),
 	}
+	// plugins that were already built hold on to resources (such as database
+	// connections), so release them if a later step fails
+	defer func() {
+		if err != nil {
+			ap.closePlugins()
+		}
+	}()
 
 	if _, ok := config.Quotas["default"]; !ok {
 		return nil, fmt.Errorf("Your configuration must specify at least a 'default' quota.")
@@ -215,9 +325,43 @@ func buildApiplex(config ApiplexConfig) (*apiplex, error) {
 		ap.allowKeyless = false
 	}
 	ap.quotas = config.Quotas
+	ap.realms = newRealms(config.Realms)
+	if ap.scopes, err = newScopes(config.Scopes); err != nil {
+		return nil, fmt.Errorf("Invalid scope configuration: %s", err.Error())
+	}
+	ap.keys = config.Keys
+	if ap.keys.ExpiryWarning <= 0 {
+		ap.keys.ExpiryWarning = 7 * 24 * time.Hour
+	}
+	if ap.keys.RotationGrace <= 0 {
+		ap.keys.RotationGrace = 24 * time.Hour
+	}
+	if ap.keys.CacheTTL <= 0 {
+		ap.keys.CacheTTL = 10 * time.Minute
+	}
+	if ap.keys.NegativeCacheTTL == 0 {
+		ap.keys.NegativeCacheTTL = 30 * time.Second
+	}
+	if ap.keys.BackendWait <= 0 {
+		ap.keys.BackendWait = time.Second
+	}
+	if ap.keys.BackendConcurrency > 0 {
+		ap.backendSlots = make(chan struct{}, ap.keys.BackendConcurrency)
+	}
+	if ap.keys.LocalCacheTTL <= 0 {
+		ap.keys.LocalCacheTTL = 5 * time.Second
+	}
+	ap.keyCache = newKeyCache(ap.keys.LocalCacheSize, ap.keys.LocalCacheTTL)
+	if ap.network, err = newNetwork(config.Network); err != nil {
+		return nil, fmt.Errorf("Invalid network configuration: %s", err.Error())
+	}
+	ap.lockout = config.Lockout
+	if ap.lockout.Window <= 0 {
+		ap.lockout.Window = 5 * time.Minute
+	}
 
 	// auth plugins
-	auth, err := buildPlugins(config.Plugins.Auth, reflect.TypeOf((*AuthPlugin)(nil)).Elem())
+	auth, err := ap.buildPlugins("auth", config.Plugins.Auth, reflect.TypeOf((*AuthPlugin)(nil)).Elem())
 	if err != nil {
 		return nil, err
 	}
@@ -228,7 +372,7 @@ func buildApiplex(config ApiplexConfig) (*apiplex, error) {
 	}
 
 	// backend plugins
-	backend, err := buildPlugins(config.Plugins.Backend, reflect.TypeOf((*BackendPlugin)(nil)).Elem())
+	backend, err := ap.buildPlugins("backend", config.Plugins.Backend, reflect.TypeOf((*BackendPlugin)(nil)).Elem())
 	if err != nil {
 		return nil, err
 	}
@@ -252,7 +396,7 @@ func buildApiplex(config ApiplexConfig) (*apiplex, error) {
 	}
 
 	// postauth plugins
-	postauth, err := buildPlugins(config.Plugins.PostAuth, reflect.TypeOf((*PostAuthPlugin)(nil)).Elem())
+	postauth, err := ap.buildPlugins("postauth", config.Plugins.PostAuth, reflect.TypeOf((*PostAuthPlugin)(nil)).Elem())
 	if err != nil {
 		return nil, err
 	}
@@ -263,7 +407,7 @@ func buildApiplex(config ApiplexConfig) (*apiplex, error) {
 	}
 
 	// preupstream plugins
-	preupstream, err := buildPlugins(config.Plugins.PreUpstream, reflect.TypeOf((*PreUpstreamPlugin)(nil)).Elem())
+	preupstream, err := ap.buildPlugins("preupstream", config.Plugins.PreUpstream, reflect.TypeOf((*PreUpstreamPlugin)(nil)).Elem())
 	if err != nil {
 		return nil, err
 	}
@@ -274,7 +418,7 @@ func buildApiplex(config ApiplexConfig) (*apiplex, error) {
 	}
 
 	// postupstream plugins
-	postupstream, err := buildPlugins(config.Plugins.PostUpstream, reflect.TypeOf((*PostUpstreamPlugin)(nil)).Elem())
+	postupstream, err := ap.buildPlugins("postupstream", config.Plugins.PostUpstream, reflect.TypeOf((*PostUpstreamPlugin)(nil)).Elem())
 	if err != nil {
 		return nil, err
 	}
@@ -285,7 +429,7 @@ func buildApiplex(config ApiplexConfig) (*apiplex, error) {
 	}
 
 	// logging plugins
-	logging, err := buildPlugins(config.Plugins.Logging, reflect.TypeOf((*LoggingPlugin)(nil)).Elem())
+	logging, err := ap.buildPlugins("logging", config.Plugins.Logging, reflect.TypeOf((*LoggingPlugin)(nil)).Elem())
 	if err != nil {
 		return nil, err
 	}
@@ -331,26 +475,15 @@ func buildApiplex(config ApiplexConfig) (*apiplex, error) {
 		log.Fatalf("Couldn't connect to Redis. %s", err.Error())
 	}
 
-	return &ap, nil
-}
-
-func New(config ApiplexConfig) (*http.ServeMux, error) {
-	ap, err := buildApiplex(config)
-	if err != nil {
-		return nil, err
+	if config.Metrics.Path != "" {
+		if ap.metrics, err = newMetrics(config.Metrics, ap.redis, ap.keyCache); err != nil {
+			return nil, fmt.Errorf("Invalid metrics configuration: %s", err.Error())
+		}
 	}
 
-	mux := http.NewServeMux()
-	mux.HandleFunc(ap.apipath, ap.HandleAPI)
-
-	if config.Serve.PortalAPI != "" {
-		papath := ensureFinalSlash(config.Serve.PortalAPI)
-		portalAPI, err := ap.BuildPortalAPI(config.Serve.PortalAPI)
-		if err != nil {
-			return nil, fmt.Errorf("Could not create Portal API. %s", err.Error())
-		}
-		mux.Handle(papath, portalAPI)
+	if ap.tracing, err = newTracing(config.Tracing); err != nil {
+		return nil, fmt.Errorf("Invalid tracing configuration: %s", err.Error())
 	}
 
-	return mux, nil
+	return &ap, nil
 }
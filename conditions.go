@@ -0,0 +1,126 @@
+package apiplexy
+
+import (
+	"fmt"
+	"net/http"
+	"path"
+	"strings"
+)
+
+// MatchPath matches a request path against a glob pattern. A "*" matches
+// any characters within a single path segment, a "**" segment matches any
+// number of segments (including none). Otherwise, path.Match rules apply.
+// Plugins matching on paths should use this too, so patterns work the same
+// everywhere.
+//
+//  /users/*/keys  matches /users/42/keys
+//  /admin/**      matches /admin, /admin/users and /admin/users/42
+func MatchPath(pattern, p string) bool {
+	return matchSegments(splitPath(pattern), splitPath(p))
+}
+
+// ValidatePathPattern checks that a pattern for MatchPath is well-formed.
+func ValidatePathPattern(pattern string) error {
+	for _, segment := range splitPath(pattern) {
+		if _, err := path.Match(segment, ""); err != nil {
+			return fmt.Errorf("Invalid path pattern '%s'.", pattern)
+		}
+	}
+	return nil
+}
+
+func splitPath(p string) []string {
+	p = strings.Trim(p, "/")
+	if p == "" {
+		return []string{}
+	}
+	return strings.Split(p, "/")
+}
+
+func matchSegments(pattern, segments []string) bool {
+	for len(pattern) > 0 {
+		if pattern[0] == "**" {
+			for i := 0; i <= len(segments); i++ {
+				if matchSegments(pattern[1:], segments[i:]) {
+					return true
+				}
+			}
+			return false
+		}
+		if len(segments) == 0 {
+			return false
+		}
+		if ok, err := path.Match(pattern[0], segments[0]); err != nil || !ok {
+			return false
+		}
+		pattern = pattern[1:]
+		segments = segments[1:]
+	}
+	return len(segments) == 0
+}
+
+func validateCondition(cond *apiplexPluginCondition) error {
+	for _, p := range cond.Paths {
+		if err := ValidatePathPattern(p); err != nil {
+			return err
+		}
+	}
+	for i, m := range cond.Methods {
+		cond.Methods[i] = strings.ToUpper(m)
+	}
+	return nil
+}
+
+func containsString(list []string, s string) bool {
+	for _, item := range list {
+		if item == s {
+			return true
+		}
+	}
+	return false
+}
+
+// matches checks whether a request (after authentication) satisfies the
+// condition. quotaName is the quota the request is charged against.
+func (cond *apiplexPluginCondition) matches(req *http.Request, ctx *APIContext, quotaName string) bool {
+	if cond.Keyless != nil && *cond.Keyless != ctx.Keyless {
+		return false
+	}
+	if len(cond.Methods) > 0 && !containsString(cond.Methods, req.Method) {
+		return false
+	}
+	if len(cond.KeyTypes) > 0 && (ctx.Key == nil || !containsString(cond.KeyTypes, ctx.Key.Type)) {
+		return false
+	}
+	if len(cond.Quotas) > 0 && !containsString(cond.Quotas, quotaName) {
+		return false
+	}
+	if len(cond.Paths) > 0 {
+		found := false
+		for _, p := range cond.Paths {
+			if MatchPath(p, ctx.Path) {
+				found = true
+				break
+			}
+		}
+		if !found {
+			return false
+		}
+	}
+	return true
+}
+
+// applies checks whether a configured plugin should run for a request. Plugins
+// without conditions run on every request.
+func (ap *apiplex) applies(plugin interface{}, req *http.Request, ctx *APIContext) bool {
+	cond, ok := ap.conditions[plugin]
+	if !ok {
+		return true
+	}
+	// keys without a (known) quota are charged against the default one
+	quotaName := "keyless"
+	if ctx.Key != nil {
+		_, quotaName, _ = ap.quotaFor(ctx)
+	}
+	return cond.matches(req, ctx, quotaName)
+}
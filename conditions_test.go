@@ -0,0 +1,64 @@
+package apiplexy
+
+import (
+	. "github.com/smartystreets/goconvey/convey"
+	"net/http"
+	"testing"
+)
+
+func TestPathGlobs(t *testing.T) {
+	Convey("Path globs should match segment-wise", t, func() {
+		So(MatchPath("/users/*/keys", "/users/42/keys"), ShouldBeTrue)
+		So(MatchPath("/users/*/keys", "/users/42/43/keys"), ShouldBeFalse)
+		So(MatchPath("/users/*", "/users"), ShouldBeFalse)
+		So(MatchPath("/search", "/search/"), ShouldBeTrue)
+		So(MatchPath("/v*/items", "/v2/items"), ShouldBeTrue)
+	})
+
+	Convey("A ** segment should match any number of segments", t, func() {
+		So(MatchPath("/admin/**", "/admin"), ShouldBeTrue)
+		So(MatchPath("/admin/**", "/admin/users/42"), ShouldBeTrue)
+		So(MatchPath("/**/export", "/reports/2015/export"), ShouldBeTrue)
+		So(MatchPath("/**/export", "/reports/2015/import"), ShouldBeFalse)
+		So(MatchPath("/**", "/"), ShouldBeTrue)
+	})
+}
+
+func TestConditions(t *testing.T) {
+	keyless := true
+	req, _ := http.NewRequest("POST", "http://dummy-request.com/upload/file", nil)
+	keyed := &APIContext{Path: "/upload/file", Key: &Key{ID: "k", Type: "HMAC", Quota: "premium"}}
+	anonymous := &APIContext{Path: "/upload/file", Keyless: true}
+
+	Convey("All given conditions must match", t, func() {
+		cond := &apiplexPluginCondition{Paths: []string{"/upload/**"}, Methods: []string{"post"}, KeyTypes: []string{"HMAC"}}
+		So(validateCondition(cond), ShouldBeNil)
+		So(cond.matches(req, keyed, "premium"), ShouldBeTrue)
+		So(cond.matches(req, anonymous, "keyless"), ShouldBeFalse)
+
+		cond.Quotas = []string{"default"}
+		So(cond.matches(req, keyed, "premium"), ShouldBeFalse)
+	})
+
+	Convey("Keyless conditions should distinguish keyless and keyed requests", t, func() {
+		cond := &apiplexPluginCondition{Keyless: &keyless, Quotas: []string{"keyless"}}
+		So(cond.matches(req, anonymous, "keyless"), ShouldBeTrue)
+		So(cond.matches(req, keyed, "premium"), ShouldBeFalse)
+	})
+
+	Convey("Quota conditions should match the quota a key is charged against", t, func() {
+		plugin := &struct{ name string }{"plugin"}
+		ap := &apiplex{
+			quotas:     map[string]apiplexQuota{"default": {}, "keyless": {}, "premium": {}},
+			conditions: map[interface{}]*apiplexPluginCondition{plugin: {Quotas: []string{"default"}}},
+		}
+		So(ap.applies(plugin, req, &APIContext{Key: &Key{ID: "k"}}), ShouldBeTrue)
+		So(ap.applies(plugin, req, &APIContext{Key: &Key{ID: "k", Quota: "unknown"}}), ShouldBeTrue)
+		So(ap.applies(plugin, req, keyed), ShouldBeFalse)
+		So(ap.applies(plugin, req, anonymous), ShouldBeFalse)
+	})
+
+	Convey("Invalid path patterns should be rejected", t, func() {
+		So(validateCondition(&apiplexPluginCondition{Paths: []string{"/files/[a-"}}), ShouldNotBeNil)
+	})
+}
@@ -0,0 +1,528 @@
+package apiplexy
+
+import (
+	"fmt"
+	"math"
+	"reflect"
+	"strconv"
+	"strings"
+	"time"
+	"unicode"
+)
+
+// Typed plugin configuration. A plugin implementing TypedConfigPlugin hands
+// the builder a pointer to a config struct, and the builder decodes the user's
+// (YAML-parsed) configuration into it. Fields are described by struct tags:
+//
+//  config:"name"      key in the configuration map (default: snake_cased field name, "-" skips)
+//  default:"value"    value used if the key is missing or null
+//  required:"true"    key must be present and non-empty
+//  enum:"a,b,c"       value must be one of the listed values
+//  min:"0" max:"10"   inclusive range for numbers and durations
+//
+// Supported field types are strings, bools, all int/uint/float kinds,
+// time.Duration (as "5s"-style strings or plain seconds), nested structs
+// (and pointers to them), slices, maps with string keys and interface{}.
+
+var durationType = reflect.TypeOf(time.Duration(0))
+
+// TypedDefaultConfig builds a DefaultConfig map from a typed plugin's config
+// struct tags. Typed plugins can simply return this from DefaultConfig.
+func TypedDefaultConfig(plugin TypedConfigPlugin) map[string]interface{} {
+	t := reflect.TypeOf(plugin.ConfigStruct())
+	for t.Kind() == reflect.Ptr {
+		t = t.Elem()
+	}
+	return structDefaults(t)
+}
+
+// TypedConfigure decodes a configuration map into a typed plugin's config
+// struct and passes the result on to ConfigureTyped. Typed plugins can simply
+// return this from Configure, so they keep working when configured directly.
+func TypedConfigure(plugin TypedConfigPlugin, config map[string]interface{}) error {
+	target := plugin.ConfigStruct()
+	if err := DecodeConfig(config, target); err != nil {
+		return err
+	}
+	return plugin.ConfigureTyped(target)
+}
+
+// DecodeConfig decodes a configuration map into target, which must be a
+// pointer to a struct. Defaults are applied, and the resulting values are
+// validated against the struct's tags.
+func DecodeConfig(config map[string]interface{}, target interface{}) error {
+	v := reflect.ValueOf(target)
+	if v.Kind() != reflect.Ptr || v.Elem().Kind() != reflect.Struct {
+		return fmt.Errorf("Config target must be a pointer to a struct, not %T.", target)
+	}
+	if config == nil {
+		config = map[string]interface{}{}
+	}
+	return decodeStruct("", config, v.Elem())
+}
+
+type configField struct {
+	name     string
+	index    int
+	def      string
+	hasDef   bool
+	required bool
+	enum     []string
+	min, max string
+}
+
+func configFields(t reflect.Type) []configField {
+	fields := []configField{}
+	for i := 0; i < t.NumField(); i++ {
+		f := t.Field(i)
+		if f.PkgPath != "" {
+			continue
+		}
+		name := f.Tag.Get("config")
+		if name == "-" {
+			continue
+		}
+		if name == "" {
+			name = snakeCase(f.Name)
+		}
+		cf := configField{
+			name:     name,
+			index:    i,
+			required: f.Tag.Get("required") == "true",
+			min:      f.Tag.Get("min"),
+			max:      f.Tag.Get("max"),
+		}
+		cf.def, cf.hasDef = f.Tag.Lookup("default")
+		if enum := f.Tag.Get("enum"); enum != "" {
+			cf.enum = strings.Split(enum, ",")
+		}
+		fields = append(fields, cf)
+	}
+	return fields
+}
+
+func snakeCase(s string) string {
+	out := make([]rune, 0, len(s)+4)
+	rs := []rune(s)
+	for i, r := range rs {
+		if unicode.IsUpper(r) {
+			if i > 0 && (unicode.IsLower(rs[i-1]) || (i+1 < len(rs) && unicode.IsLower(rs[i+1]))) {
+				out = append(out, '_')
+			}
+			r = unicode.ToLower(r)
+		}
+		out = append(out, r)
+	}
+	return string(out)
+}
+
+func joinPath(path, name string) string {
+	if path == "" {
+		return name
+	}
+	return path + "." + name
+}
+
+// normalizeMap turns the map[interface{}]interface{} values that YAML produces
+// for nested maps into map[string]interface{}.
+func normalizeMap(raw interface{}) (map[string]interface{}, bool) {
+	switch m := raw.(type) {
+	case map[string]interface{}:
+		return m, true
+	case map[interface{}]interface{}:
+		n := make(map[string]interface{}, len(m))
+		for k, v := range m {
+			n[fmt.Sprintf("%v", k)] = v
+		}
+		return n, true
+	}
+	return nil, false
+}
+
+// normalizeValue applies normalizeMap recursively, so arbitrary nested config
+// values can be serialized (e.g. to JSON).
+func normalizeValue(raw interface{}) interface{} {
+	if m, ok := normalizeMap(raw); ok {
+		n := make(map[string]interface{}, len(m))
+		for k, v := range m {
+			n[k] = normalizeValue(v)
+		}
+		return n
+	}
+	if l, ok := raw.([]interface{}); ok {
+		n := make([]interface{}, len(l))
+		for i, v := range l {
+			n[i] = normalizeValue(v)
+		}
+		return n
+	}
+	return raw
+}
+
+func decodeStruct(path string, raw map[string]interface{}, v reflect.Value) error {
+	fields := configFields(v.Type())
+	known := make(map[string]bool, len(fields))
+	for _, f := range fields {
+		known[f.name] = true
+		fpath := joinPath(path, f.name)
+		fv := v.Field(f.index)
+
+		val, present := raw[f.name]
+		if !present || val == nil {
+			if f.required {
+				return fmt.Errorf("Field '%s' is required.", fpath)
+			}
+			if f.hasDef {
+				if err := decodeDefault(fpath, f.def, fv); err != nil {
+					return err
+				}
+			} else if fv.Kind() == reflect.Struct && fv.Type() != durationType {
+				// nested structs may carry their own defaults
+				if err := decodeStruct(fpath, map[string]interface{}{}, fv); err != nil {
+					return err
+				}
+			}
+		} else {
+			if err := decodeValue(fpath, val, fv); err != nil {
+				return err
+			}
+			if f.required && isEmptyValue(fv) {
+				return fmt.Errorf("Field '%s' is required and must not be empty.", fpath)
+			}
+		}
+		if err := validateField(fpath, f, fv); err != nil {
+			return err
+		}
+	}
+	for k := range raw {
+		if !known[k] {
+			return fmt.Errorf("Unknown field '%s'.", joinPath(path, k))
+		}
+	}
+	return nil
+}
+
+// decodeDefault decodes a default tag. Slices take comma-separated values.
+func decodeDefault(path string, def string, v reflect.Value) error {
+	switch v.Kind() {
+	case reflect.Slice:
+		items := []interface{}{}
+		if def != "" {
+			for _, item := range strings.Split(def, ",") {
+				items = append(items, item)
+			}
+		}
+		return decodeValue(path, items, v)
+	case reflect.String:
+		v.SetString(def)
+		return nil
+	case reflect.Bool:
+		b, err := strconv.ParseBool(def)
+		if err != nil {
+			return fmt.Errorf("Field '%s': invalid default '%s'.", path, def)
+		}
+		v.SetBool(b)
+		return nil
+	}
+	if v.Type() == durationType {
+		return decodeValue(path, def, v)
+	}
+	switch v.Kind() {
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64,
+		reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64,
+		reflect.Float32, reflect.Float64:
+		f, err := strconv.ParseFloat(def, 64)
+		if err != nil {
+			return fmt.Errorf("Field '%s': invalid default '%s'.", path, def)
+		}
+		return decodeValue(path, f, v)
+	}
+	return fmt.Errorf("Field '%s': defaults are not supported for %s values.", path, v.Type())
+}
+
+func toFloat(raw interface{}) (float64, bool) {
+	switch n := raw.(type) {
+	case int:
+		return float64(n), true
+	case int8:
+		return float64(n), true
+	case int16:
+		return float64(n), true
+	case int32:
+		return float64(n), true
+	case int64:
+		return float64(n), true
+	case uint:
+		return float64(n), true
+	case uint8:
+		return float64(n), true
+	case uint16:
+		return float64(n), true
+	case uint32:
+		return float64(n), true
+	case uint64:
+		return float64(n), true
+	case float32:
+		return float64(n), true
+	case float64:
+		return n, true
+	}
+	return 0, false
+}
+
+func decodeValue(path string, raw interface{}, v reflect.Value) error {
+	if v.Type() == durationType {
+		switch d := raw.(type) {
+		case string:
+			pd, err := time.ParseDuration(d)
+			if err != nil {
+				return fmt.Errorf("Field '%s': '%s' is not a valid duration (try something like \"30s\" or \"5m\").", path, d)
+			}
+			v.SetInt(int64(pd))
+			return nil
+		default:
+			if f, ok := toFloat(raw); ok {
+				v.SetInt(int64(f * float64(time.Second)))
+				return nil
+			}
+		}
+		return fmt.Errorf("Field '%s': expected a duration, got %T.", path, raw)
+	}
+
+	switch v.Kind() {
+	case reflect.String:
+		s, ok := raw.(string)
+		if !ok {
+			return fmt.Errorf("Field '%s': expected a string, got %T.", path, raw)
+		}
+		v.SetString(s)
+	case reflect.Bool:
+		b, ok := raw.(bool)
+		if !ok {
+			return fmt.Errorf("Field '%s': expected true or false, got %T.", path, raw)
+		}
+		v.SetBool(b)
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64:
+		f, ok := toFloat(raw)
+		if !ok {
+			return fmt.Errorf("Field '%s': expected an integer, got %T.", path, raw)
+		}
+		if f != math.Trunc(f) {
+			return fmt.Errorf("Field '%s': expected an integer, got %v.", path, raw)
+		}
+		if v.OverflowInt(int64(f)) {
+			return fmt.Errorf("Field '%s': %v is out of range.", path, raw)
+		}
+		v.SetInt(int64(f))
+	case reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64:
+		f, ok := toFloat(raw)
+		if !ok || f != math.Trunc(f) || f < 0 {
+			return fmt.Errorf("Field '%s': expected a positive integer, got %v.", path, raw)
+		}
+		if v.OverflowUint(uint64(f)) {
+			return fmt.Errorf("Field '%s': %v is out of range.", path, raw)
+		}
+		v.SetUint(uint64(f))
+	case reflect.Float32, reflect.Float64:
+		f, ok := toFloat(raw)
+		if !ok {
+			return fmt.Errorf("Field '%s': expected a number, got %T.", path, raw)
+		}
+		v.SetFloat(f)
+	case reflect.Struct:
+		m, ok := normalizeMap(raw)
+		if !ok {
+			return fmt.Errorf("Field '%s': expected a map, got %T.", path, raw)
+		}
+		return decodeStruct(path, m, v)
+	case reflect.Ptr:
+		if raw == nil {
+			return nil
+		}
+		n := reflect.New(v.Type().Elem())
+		if err := decodeValue(path, raw, n.Elem()); err != nil {
+			return err
+		}
+		v.Set(n)
+	case reflect.Slice:
+		items, ok := raw.([]interface{})
+		if !ok {
+			return fmt.Errorf("Field '%s': expected a list, got %T.", path, raw)
+		}
+		s := reflect.MakeSlice(v.Type(), len(items), len(items))
+		for i, item := range items {
+			if err := decodeValue(fmt.Sprintf("%s[%d]", path, i), item, s.Index(i)); err != nil {
+				return err
+			}
+		}
+		v.Set(s)
+	case reflect.Map:
+		if v.Type().Key().Kind() != reflect.String {
+			return fmt.Errorf("Field '%s': only maps with string keys are supported.", path)
+		}
+		m, ok := normalizeMap(raw)
+		if !ok {
+			return fmt.Errorf("Field '%s': expected a map, got %T.", path, raw)
+		}
+		mv := reflect.MakeMapWithSize(v.Type(), len(m))
+		for k, item := range m {
+			ev := reflect.New(v.Type().Elem()).Elem()
+			if err := decodeValue(joinPath(path, k), item, ev); err != nil {
+				return err
+			}
+			mv.SetMapIndex(reflect.ValueOf(k).Convert(v.Type().Key()), ev)
+		}
+		v.Set(mv)
+	case reflect.Interface:
+		if raw = normalizeValue(raw); raw != nil {
+			v.Set(reflect.ValueOf(raw))
+		}
+	default:
+		return fmt.Errorf("Field '%s': unsupported config type %s.", path, v.Type())
+	}
+	return nil
+}
+
+func isEmptyValue(v reflect.Value) bool {
+	switch v.Kind() {
+	case reflect.String, reflect.Slice, reflect.Map:
+		return v.Len() == 0
+	case reflect.Ptr, reflect.Interface:
+		return v.IsNil()
+	}
+	return false
+}
+
+func inEnum(enum []string, actual string) bool {
+	for _, e := range enum {
+		if e == actual {
+			return true
+		}
+	}
+	return false
+}
+
+func validateField(path string, f configField, v reflect.Value) error {
+	if len(f.enum) > 0 {
+		values := []reflect.Value{v}
+		if v.Kind() == reflect.Slice {
+			values = values[:0]
+			for i := 0; i < v.Len(); i++ {
+				values = append(values, v.Index(i))
+			}
+		}
+		for _, ev := range values {
+			actual := fmt.Sprintf("%v", ev.Interface())
+			if ev.Kind() == reflect.String && actual == "" && !f.required {
+				continue
+			}
+			if !inEnum(f.enum, actual) {
+				return fmt.Errorf("Field '%s': '%s' is not one of: %s.", path, actual, strings.Join(f.enum, ", "))
+			}
+		}
+	}
+	if f.min == "" && f.max == "" {
+		return nil
+	}
+	var actual float64
+	bound := func(s string) (float64, error) {
+		if v.Type() == durationType {
+			d, err := time.ParseDuration(s)
+			return float64(d), err
+		}
+		return strconv.ParseFloat(s, 64)
+	}
+	switch v.Kind() {
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64:
+		actual = float64(v.Int())
+	case reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64:
+		actual = float64(v.Uint())
+	case reflect.Float32, reflect.Float64:
+		actual = v.Float()
+	default:
+		return fmt.Errorf("Field '%s': min/max only apply to numbers and durations.", path)
+	}
+	if f.min != "" {
+		min, err := bound(f.min)
+		if err != nil {
+			return fmt.Errorf("Field '%s': invalid min '%s'.", path, f.min)
+		}
+		if actual < min {
+			return fmt.Errorf("Field '%s': %v is below the minimum of %s.", path, v.Interface(), f.min)
+		}
+	}
+	if f.max != "" {
+		max, err := bound(f.max)
+		if err != nil {
+			return fmt.Errorf("Field '%s': invalid max '%s'.", path, f.max)
+		}
+		if actual > max {
+			return fmt.Errorf("Field '%s': %v is above the maximum of %s.", path, v.Interface(), f.max)
+		}
+	}
+	return nil
+}
+
+// structDefaults renders a config struct type as a default configuration map,
+// as it would appear in a generated config file.
+func structDefaults(t reflect.Type) map[string]interface{} {
+	m := make(map[string]interface{})
+	for _, f := range configFields(t) {
+		ft := t.Field(f.index).Type
+		if f.hasDef {
+			v := reflect.New(ft).Elem()
+			if err := decodeDefault(f.name, f.def, v); err == nil {
+				m[f.name] = plainDefault(f.def, v)
+				continue
+			}
+		}
+		m[f.name] = zeroDefault(ft)
+	}
+	return m
+}
+
+func plainDefault(def string, v reflect.Value) interface{} {
+	if v.Type() == durationType {
+		return def
+	}
+	switch v.Kind() {
+	case reflect.Slice:
+		items := make([]interface{}, v.Len())
+		for i := range items {
+			items[i] = v.Index(i).Interface()
+		}
+		return items
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64:
+		return int(v.Int())
+	case reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64:
+		return int(v.Uint())
+	case reflect.Float32:
+		return v.Float()
+	}
+	return v.Interface()
+}
+
+func zeroDefault(t reflect.Type) interface{} {
+	if t == durationType {
+		return "0s"
+	}
+	switch t.Kind() {
+	case reflect.Struct:
+		return structDefaults(t)
+	case reflect.Ptr:
+		if t.Elem().Kind() == reflect.Struct {
+			return structDefaults(t.Elem())
+		}
+		return nil
+	case reflect.Slice:
+		return []interface{}{}
+	case reflect.Map:
+		return map[string]interface{}{}
+	case reflect.Interface:
+		return nil
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64,
+		reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64:
+		return 0
+	}
+	return reflect.Zero(t).Interface()
+}
@@ -0,0 +1,145 @@
+package apiplexy
+
+import (
+	. "github.com/smartystreets/goconvey/convey"
+	"gopkg.in/yaml.v2"
+	"testing"
+	"time"
+)
+
+type testUpstreamConfig struct {
+	URL     string        `config:"url" required:"true"`
+	Timeout time.Duration `default:"5s" min:"1s" max:"1m"`
+	Weight  float64       `default:"1"`
+}
+
+type testPluginConfig struct {
+	Mode      string               `default:"strict" enum:"strict,lenient"`
+	Retries   int                  `default:"3" min:"0" max:"10"`
+	Enabled   bool                 `default:"true"`
+	Methods   []string             `default:"GET,HEAD" enum:"GET,HEAD,POST"`
+	Upstreams []testUpstreamConfig `config:"upstreams"`
+	Labels    map[string]string
+}
+
+type testTypedPlugin struct {
+	config *testPluginConfig
+}
+
+func (p *testTypedPlugin) ConfigStruct() interface{} {
+	return &testPluginConfig{}
+}
+
+func (p *testTypedPlugin) ConfigureTyped(config interface{}) error {
+	p.config = config.(*testPluginConfig)
+	return nil
+}
+
+func (p *testTypedPlugin) DefaultConfig() map[string]interface{} {
+	return TypedDefaultConfig(p)
+}
+
+func (p *testTypedPlugin) Configure(config map[string]interface{}) error {
+	return TypedConfigure(p, config)
+}
+
+func parseYAMLConfig(y string) map[string]interface{} {
+	m := make(map[string]interface{})
+	yaml.Unmarshal([]byte(y), &m)
+	return m
+}
+
+func TestTypedConfig(t *testing.T) {
+	Convey("Defaults should be applied to an empty configuration", t, func() {
+		p := testTypedPlugin{}
+		So(configurePlugin(&p, nil), ShouldBeNil)
+		So(p.config.Mode, ShouldEqual, "strict")
+		So(p.config.Retries, ShouldEqual, 3)
+		So(p.config.Enabled, ShouldBeTrue)
+		So(p.config.Methods, ShouldResemble, []string{"GET", "HEAD"})
+	})
+
+	Convey("Nested lists and maps from YAML should be decoded", t, func() {
+		p := testTypedPlugin{}
+		err := configurePlugin(&p, parseYAMLConfig(`
+retries: 5.0
+upstreams:
+- url: http://a
+  timeout: 10s
+- url: http://b
+  weight: 2
+labels:
+  team: core
+`))
+		So(err, ShouldBeNil)
+		So(p.config.Retries, ShouldEqual, 5)
+		So(len(p.config.Upstreams), ShouldEqual, 2)
+		So(p.config.Upstreams[0].Timeout, ShouldEqual, 10*time.Second)
+		So(p.config.Upstreams[1].Timeout, ShouldEqual, 5*time.Second)
+		So(p.config.Upstreams[1].Weight, ShouldEqual, 2.0)
+		So(p.config.Labels["team"], ShouldEqual, "core")
+	})
+
+	Convey("Invalid values should produce precise errors", t, func() {
+		cases := map[string]string{
+			"mode: sloppy":                       "Field 'mode': 'sloppy' is not one of: strict, lenient.",
+			"retries: 11":                        "Field 'retries': 11 is above the maximum of 10.",
+			"retries: 1.5":                       "Field 'retries': expected an integer, got 1.5.",
+			"methods: [GET, DELETE]":             "Field 'methods': 'DELETE' is not one of: GET, HEAD, POST.",
+			"upstreams: [{timeout: 2s}]":         "Field 'upstreams[0].url' is required.",
+			"upstreams: [{url: x, timeout: 5}]":  "",
+			"upstreams: [{url: x, timeout: 2m}]": "Field 'upstreams[0].timeout': 2m0s is above the maximum of 1m.",
+			"retry: 3":                           "Unknown field 'retry'.",
+		}
+		for y, expected := range cases {
+			p := testTypedPlugin{}
+			err := configurePlugin(&p, parseYAMLConfig(y))
+			if expected == "" {
+				So(err, ShouldBeNil)
+			} else {
+				So(err, ShouldNotBeNil)
+				So(err.Error(), ShouldEqual, expected)
+			}
+		}
+	})
+
+	Convey("The generated default configuration should be accepted as-is", t, func() {
+		p := testTypedPlugin{}
+		defaults := p.DefaultConfig()
+		So(defaults["mode"], ShouldEqual, "strict")
+		So(defaults["methods"], ShouldResemble, []interface{}{"GET", "HEAD"})
+		So(p.Configure(defaults), ShouldBeNil)
+	})
+}
+
+func TestEnsureDefaults(t *testing.T) {
+	defaults := map[string]interface{}{
+		"timeout": 2.5,
+		"port":    5432,
+		"name":    "default",
+		"pool": map[string]interface{}{
+			"size": 10,
+		},
+	}
+
+	Convey("Missing and null values should be filled in", t, func() {
+		target := map[string]interface{}{"name": nil}
+		So(ensureDefaults("", target, defaults), ShouldBeNil)
+		So(target["name"], ShouldEqual, "default")
+		So(target["port"], ShouldEqual, 5432)
+	})
+
+	Convey("YAML ints and floats should be interchangeable", t, func() {
+		target := parseYAMLConfig("timeout: 3\nport: 5433.0")
+		So(ensureDefaults("", target, defaults), ShouldBeNil)
+		So(target["timeout"], ShouldEqual, 3.0)
+		So(target["port"], ShouldEqual, 5433)
+	})
+
+	Convey("Nested maps should be checked recursively", t, func() {
+		target := parseYAMLConfig("pool:\n  size: lots")
+		err := ensureDefaults("", target, defaults)
+		So(err, ShouldNotBeNil)
+		So(err.Error(), ShouldEqual, "Field 'pool.size': expected a value of type int.")
+	})
+}
@@ -1,7 +1,9 @@
 package apiplexy
 
 import (
+	"context"
 	"net/http"
+	"time"
 )
 
 // If your plugin returns an AbortRequest as its error value, the API request
@@ -28,7 +30,20 @@ func Abort(status int, message string) AbortRequest {
 // various structs used for config parsing; not really helpful to have public
 type apiplexPluginConfig struct {
 	Plugin string
-	Config map[string]interface{} `yaml:",omitempty" json:",omitempty"`
+	Config map[string]interface{}  `yaml:",omitempty" json:",omitempty"`
+	When   *apiplexPluginCondition `yaml:",omitempty" json:",omitempty"`
+}
+
+// Restricts a request-stage plugin to matching requests. All given conditions
+// must match; within a condition, any of the listed values may match. Quotas
+// match the quota a request is charged against, so keys without a (known)
+// quota match "default", and keyless requests "keyless".
+type apiplexPluginCondition struct {
+	Paths    []string `yaml:",omitempty" json:",omitempty"`
+	Methods  []string `yaml:",omitempty" json:",omitempty"`
+	KeyTypes []string `yaml:"key_types,omitempty" json:"key_types,omitempty"`
+	Quotas   []string `yaml:",omitempty" json:",omitempty"`
+	Keyless  *bool    `yaml:",omitempty" json:",omitempty"`
 }
 
 type apiplexConfigRedis struct {
@@ -43,6 +58,136 @@ type apiplexConfigServe struct {
 	PortalAPI  string `yaml:"portal_api"`
 	Portal     string `yaml:"portal"`
 	SigningKey string `yaml:"signing_key"`
+	Health     string `yaml:"health,omitempty"`
+	AdminAPI   string `yaml:"admin_api,omitempty"`
+	AdminToken string `yaml:"admin_token,omitempty"`
+}
+
+// Metrics are served on Path (if set), which must lie outside the API path.
+// They need no credentials, so keep Path away from the public (e.g. through
+// the reverse proxy in front of apiplexy). Request metrics are labelled by the
+// first of Routes (path patterns) that matches; by key ID only if KeyLabels
+// is set, as that creates a set of time series for every key.
+type apiplexConfigMetrics struct {
+	Path      string   `yaml:",omitempty"`
+	Routes    []string `yaml:",omitempty"`
+	KeyLabels bool     `yaml:"key_labels,omitempty"`
+}
+
+// Liveness and readiness probes are served on their own paths (if set), e.g.
+// /healthz and /readyz, so API authentication and quotas don't apply to them.
+// Checks lists what readiness depends on: any of "redis", "backends" and
+// "upstreams" (all of them if unset). Upstreams are probed with a GET to
+// UpstreamPath, relative to each upstream address. Checks that take longer
+// than Timeout (default 2 seconds) fail. Probe paths must lie outside the API
+// path, and only report "ok" or "error" for each check; details are logged.
+type apiplexConfigProbes struct {
+	Liveness     string        `yaml:",omitempty"`
+	Readiness    string        `yaml:",omitempty"`
+	Checks       []string      `yaml:",omitempty"`
+	UpstreamPath string        `yaml:"upstream_path,omitempty"`
+	Timeout      time.Duration `yaml:",omitempty"`
+}
+
+// Spans are exported over OTLP/HTTP to Endpoint (if set), e.g.
+// http://localhost:4318/v1/traces. Headers are sent along with every export,
+// e.g. for collector authentication.
+type apiplexConfigTracing struct {
+	Endpoint    string            `yaml:",omitempty"`
+	ServiceName string            `yaml:"service_name,omitempty"`
+	Headers     map[string]string `yaml:",omitempty"`
+}
+
+// The OAuth2 token endpoint is served on TokenEndpoint (if set). It hands out
+// access tokens for a key's ID and secret (the client credentials grant),
+// signed with SigningKey and valid for Lifetime. To accept these tokens on the
+// API, configure the oauth2 auth plugin with the same signing key and issuer.
+type apiplexConfigOAuth2 struct {
+	TokenEndpoint string        `yaml:"token_endpoint,omitempty"`
+	SigningKey    string        `yaml:"signing_key,omitempty"`
+	Issuer        string        `yaml:",omitempty"`
+	Lifetime      time.Duration `yaml:",omitempty"`
+}
+
+// Keys are only accepted from within their realm. Web apps are recognized by
+// their Origin (or Referer) header, native apps identify themselves in
+// AppHeader (default X-App-ID). With Require, keys that have a realm are
+// rejected on requests from neither. With CORS, apiplexy answers preflight
+// requests and lets web apps in a key's realm read the responses, sending
+// AllowHeaders (or whatever the browser asks for) and MaxAge. Preflight
+// requests carry no credentials, and some requests need no key at all, so
+// those are only allowed for the web apps in Origins (domains, as in realms).
+type apiplexConfigRealms struct {
+	AppHeader    string        `yaml:"app_header,omitempty"`
+	Require      bool          `yaml:",omitempty"`
+	CORS         bool          `yaml:"cors,omitempty"`
+	Origins      []string      `yaml:",omitempty"`
+	AllowHeaders []string      `yaml:"allow_headers,omitempty"`
+	MaxAge       time.Duration `yaml:"max_age,omitempty"`
+}
+
+// Keys carry scopes from the Catalog (scope names and descriptions, which
+// developers choose from when creating keys). Routes declare the scopes a key
+// needs: all Scopes of every route whose Paths (patterns as in MatchPath) and
+// Methods (if set) match the request.
+type apiplexConfigScopes struct {
+	Catalog map[string]string   `yaml:",omitempty"`
+	Routes  []apiplexScopeRoute `yaml:",omitempty"`
+}
+
+type apiplexScopeRoute struct {
+	Paths   []string
+	Methods []string `yaml:",omitempty"`
+	Scopes  []string
+}
+
+// Keys found in a backend are cached in Redis for CacheTTL (default 10
+// minutes). Changes made through apiplexy take effect immediately anyway;
+// CacheTTL only bounds how long changes made directly in the backend take.
+// Keys the backends don't know are remembered for NegativeCacheTTL (default
+// 30 seconds), so that guessing doesn't cost a backend lookup every time; a
+// negative NegativeCacheTTL (e.g. -1s) turns this off. At most
+// BackendConcurrency lookups (if set) run at once; others wait for up to
+// BackendWait (default 1 second), then fail with a 503.
+//
+// With LocalCacheSize set, each node also keeps up to that many keys in memory
+// for LocalCacheTTL (default 5 seconds), which saves a trip to Redis for busy
+// keys. Changed keys are dropped from the local caches of all nodes.
+//
+// Keys may expire. The portal API warns about keys that expire within
+// ExpiryWarning (default 7 days). When a key's secret is rotated, the previous
+// one keeps working for RotationGrace (default 24 hours), so clients can switch
+// over without downtime.
+type apiplexConfigKeys struct {
+	CacheTTL           time.Duration `yaml:"cache_ttl,omitempty"`
+	NegativeCacheTTL   time.Duration `yaml:"negative_cache_ttl,omitempty"`
+	BackendConcurrency int           `yaml:"backend_concurrency,omitempty"`
+	BackendWait        time.Duration `yaml:"backend_wait,omitempty"`
+	LocalCacheSize     int           `yaml:"local_cache_size,omitempty"`
+	LocalCacheTTL      time.Duration `yaml:"local_cache_ttl,omitempty"`
+	ExpiryWarning      time.Duration `yaml:"expiry_warning,omitempty"`
+	RotationGrace      time.Duration `yaml:"rotation_grace,omitempty"`
+}
+
+// Client IPs that fail to authenticate (with unknown or invalid credentials)
+// MaxFailures times within Window (default 5 minutes) are locked out: their
+// requests with credentials are rejected with a 429 until the window is over.
+// Lockouts are logged and counted in the metrics.
+type apiplexConfigLockout struct {
+	MaxFailures int           `yaml:"max_failures,omitempty"`
+	Window      time.Duration `yaml:",omitempty"`
+}
+
+// Clients are known by their IP address. Behind load balancers or other
+// proxies, list their networks (in CIDR notation, or single addresses) in
+// TrustedProxies: requests from them are attributed to the address they
+// forwarded for (in X-Forwarded-For). Clients in Deny are turned away from
+// everything the gateway serves (API, portal, admin API, token endpoint) before
+// anything else happens. Keys may also be limited to, or kept out of, certain
+// networks on their own.
+type apiplexConfigNetwork struct {
+	TrustedProxies []string `yaml:"trusted_proxies,omitempty"`
+	Deny           []string `yaml:",omitempty"`
 }
 
 type apiplexConfigPlugins struct {
@@ -64,6 +209,15 @@ type ApiplexConfig struct {
 	Redis   apiplexConfigRedis
 	Quotas  map[string]apiplexQuota
 	Serve   apiplexConfigServe
+	Metrics apiplexConfigMetrics `yaml:",omitempty"`
+	Tracing apiplexConfigTracing `yaml:",omitempty"`
+	Probes  apiplexConfigProbes  `yaml:",omitempty"`
+	OAuth2  apiplexConfigOAuth2  `yaml:"oauth2,omitempty"`
+	Realms  apiplexConfigRealms  `yaml:",omitempty"`
+	Scopes  apiplexConfigScopes  `yaml:",omitempty"`
+	Keys    apiplexConfigKeys    `yaml:",omitempty"`
+	Lockout apiplexConfigLockout `yaml:",omitempty"`
+	Network apiplexConfigNetwork `yaml:",omitempty"`
 	Plugins apiplexConfigPlugins
 }
 
@@ -81,15 +235,46 @@ type User struct {
 // A Key has a unique ID, a user-defined Type (like "HMAC"), an assigned Quota
 // and can have extra data (such as secret signing keys) attached for validation.
 //
-// The key's Realm is either an app identifier (for native apps) or a web domain.
-// If apiplexy receives a request with a Referrer header set (meaning it came from
-// a web app), it will check the webapp's Referrer domain against the key's Realm.
+// The key's Realm is a list of web domains and app identifiers (for native apps),
+// separated by commas, e.g. "example.com, *.example.org, com.example.app". If
+// apiplexy receives a request with an Origin or Referer header set (meaning it
+// came from a web app), it will check the web app's domain against the key's
+// Realm; native apps are checked by the identifier they send. A domain starting
+// with "*." covers all its subdomains. Keys without a Realm work from anywhere.
+//
+// A key's Scopes are what it may do. Routes can require scopes, and keys without
+// them are turned away there.
+//
+// A key with an ExpiresAt stops working at that time.
+//
+// AllowIPs and DenyIPs limit where a key can be used from: networks in CIDR
+// notation (or single addresses). If AllowIPs is set, the client's address must
+// be in one of its networks; it must never be in one of DenyIPs.
+//
+// Some key types are only ever stored as a hash, which then serves as the ID.
+// For those, Generate puts the plaintext credential into Token, so it can be
+// shown to the user once. Token is never stored by backends.
 type Key struct {
-	ID    string                 `json:"id"`
-	Realm string                 `json:"realm"`
-	Quota string                 `json:"quota"`
-	Type  string                 `json:"type"`
-	Data  map[string]interface{} `json:"data,omitempty"`
+	ID        string                 `json:"id"`
+	Realm     string                 `json:"realm"`
+	Quota     string                 `json:"quota"`
+	Type      string                 `json:"type"`
+	Scopes    []string               `json:"scopes,omitempty"`
+	ExpiresAt *time.Time             `json:"expires_at,omitempty"`
+	AllowIPs  []string               `json:"allow_ips,omitempty"`
+	DenyIPs   []string               `json:"deny_ips,omitempty"`
+	Data      map[string]interface{} `json:"data,omitempty"`
+	Token     string                 `json:"token,omitempty"`
+}
+
+// HasScope tells whether the key carries a scope.
+func (k *Key) HasScope(scope string) bool {
+	return containsString(k.Scopes, scope)
+}
+
+// Expired tells whether the key has expired at the given time.
+func (k *Key) Expired(now time.Time) bool {
+	return k.ExpiresAt != nil && !now.Before(*k.ExpiresAt)
 }
 
 // An APIContext map accompanies every API request through its lifecycle. Use this
@@ -98,9 +283,13 @@ type Key struct {
 // As a convention, Logging plugins MUST log everything stored under Log. Log MUST
 // at least(!) be kept JSON-serializable; or better yet, as a map from strings to
 // plain types.
+//
+// ClientIP is the address of the client, which may sit behind trusted proxies.
+// Use it instead of the request's RemoteAddr.
 type APIContext struct {
 	Keyless  bool
 	Key      *Key
+	ClientIP string
 	Cost     int
 	Path     string
 	Upstream *APIUpstream
@@ -134,6 +323,52 @@ type ApiplexPlugin interface {
 	DefaultConfig() map[string]interface{}
 }
 
+// A TypedConfigPlugin declares its configuration as a struct rather than a map.
+// ConfigStruct returns a pointer to a fresh, zero-valued config struct whose
+// fields are annotated with tags for defaults, required fields, enums and
+// ranges (see config.go). The builder decodes the user's configuration into
+// this struct, validates it, and passes it to ConfigureTyped. Errors point to
+// the exact offending field, e.g. "Field 'rules[2].cost': expected an integer".
+//
+// Typed plugins must still satisfy ApiplexPlugin. The easiest way is to
+// delegate to the typed helpers:
+//
+//  func (p *MyPlugin) DefaultConfig() map[string]interface{} {
+//      return apiplexy.TypedDefaultConfig(p)
+//  }
+//
+//  func (p *MyPlugin) Configure(config map[string]interface{}) error {
+//      return apiplexy.TypedConfigure(p, config)
+//  }
+type TypedConfigPlugin interface {
+	ConfigStruct() interface{}
+	ConfigureTyped(config interface{}) error
+}
+
+// Plugins may implement any of the following optional lifecycle interfaces.
+//
+// Start is called once all plugins have been configured, right before the
+// gateway starts serving. The context is cancelled when the gateway shuts down
+// or is replaced on reload, so it can be used to stop background goroutines.
+// Returning an error aborts startup (or the reload).
+//
+// Close is called on shutdown, and on the old set of plugins after a reload
+// has swapped in a new one. Release connections, file handles and the like.
+//
+// Health is called by the gateway's health endpoint. Return nil if your
+// plugin is able to do its job, or an error describing what's wrong.
+type StartablePlugin interface {
+	Start(ctx context.Context) error
+}
+
+type ClosablePlugin interface {
+	Close() error
+}
+
+type HealthReportingPlugin interface {
+	Health() error
+}
+
 // An AuthPlugin takes responsibility for one or several authentication methods
 // that an API request may use. You might have an auth plugin for HMAC, one
 // for OAuth2, and so on.
@@ -157,6 +392,65 @@ type AuthPlugin interface {
 	Validate(key *Key, req *http.Request, ctx *APIContext, authCtx map[string]interface{}) (isValid bool, err error)
 }
 
+// A ResolvingAuthPlugin can build the full key on its own from what Detect
+// found, such as the claims of a signed token, so no backend is needed. The
+// gateway calls Resolve instead of asking the backends, and does not cache the
+// result unless the plugin is a CachingAuthPlugin. Return a nil key if the
+// credentials are not valid. A resolved key is still passed to Validate as
+// usual.
+type ResolvingAuthPlugin interface {
+	AuthPlugin
+	Resolve(maybeKey string, keyType string, authCtx map[string]interface{}) (*Key, error)
+}
+
+// A CachingAuthPlugin is a ResolvingAuthPlugin whose answers are worth
+// caching, e.g. because Resolve asks a remote service. The gateway caches what
+// Resolve returns in Redis, valid and invalid (nil) keys alike, for as long as
+// CacheTTL says. Return 0 to not cache an answer.
+type CachingAuthPlugin interface {
+	ResolvingAuthPlugin
+	CacheTTL(key *Key, authCtx map[string]interface{}) time.Duration
+}
+
+// A SecretVerifyingAuthPlugin can check a key's secret on its own, without a
+// request signed with it. The OAuth2 token endpoint uses this when clients
+// exchange their key's ID and secret for an access token.
+type SecretVerifyingAuthPlugin interface {
+	AuthPlugin
+	VerifySecret(key *Key, secret string) bool
+}
+
+// A RotatingAuthPlugin can give a key a new secret, for the portal API's key
+// rotation. Rotate changes the key in place (the gateway then stores it), and
+// should keep the previous secret working for grace, so clients can switch
+// over to the new one without downtime.
+type RotatingAuthPlugin interface {
+	AuthPlugin
+	Rotate(key *Key, grace time.Duration) error
+}
+
+// A KeyWatchingPlugin keeps its own copies of keys, or of anything derived
+// from them. Whenever keys are changed or deleted through apiplexy, on any
+// gateway node, KeysChanged is called with their IDs (on every node), so the
+// plugin can drop its copies. It runs on a single background goroutine, so
+// keep it quick.
+type KeyWatchingPlugin interface {
+	KeysChanged(keyIDs []string)
+}
+
+// A SingleUseAuthPlugin is an AuthPlugin whose credentials must only be used
+// once, such as request signatures or nonces. After a request has passed
+// Validate, the gateway asks the plugin for the request's nonce. If it returns
+// one, the gateway records it in Redis for ttl, and rejects any request
+// presenting the same nonce (for the same key) within that time as a replay.
+//
+// The ttl should cover the whole time the request would otherwise be accepted,
+// e.g. the clock skew window of a signed Date header.
+type SingleUseAuthPlugin interface {
+	AuthPlugin
+	Nonce(req *http.Request, authCtx map[string]interface{}) (nonce string, ttl time.Duration)
+}
+
 // A basic BackendPlugin can retrieve valid keys from some sort of key store.
 // It can not delete or manage these keys, and is used exclusively in request
 // authentication.
@@ -196,6 +490,43 @@ type ManagementBackendPlugin interface {
 	GetAllKeys(email string) ([]*Key, error)
 }
 
+// A KeyUpdatingBackendPlugin is a ManagementBackendPlugin that can also change
+// existing keys, which the portal API needs to rotate secrets and to change
+// the networks a key may be used from.
+//
+// UpdateKey stores changes to one of the user's keys. It MUST fail if the key
+// doesn't belong to the user, and MUST NOT change the key's quota (that's up
+// to operators).
+type KeyUpdatingBackendPlugin interface {
+	ManagementBackendPlugin
+	UpdateKey(email string, key *Key) error
+}
+
+// An AdminBackendPlugin is a ManagementBackendPlugin that also supports the
+// operator actions of the admin API, which work across all users. The admin
+// API is only available if the first management backend implements this.
+//
+// IsAdmin reports whether a user may use the admin API with their regular
+// portal login token. Inactive users are never admins.
+//
+// ListUsers returns users ordered by email, starting at offset, at most limit
+// of them. DeactivateUser disables an account: the user can no longer log in,
+// and GetKey MUST stop returning the user's keys (so they no longer work).
+//
+// FindKey looks up any key by its ID, regardless of type, and returns it along
+// with its owner's email; or a nil key if there is none. RevokeKey deletes a
+// key without checking ownership.
+type AdminBackendPlugin interface {
+	ManagementBackendPlugin
+	IsAdmin(email string) bool
+	SetAdmin(email string, admin bool) error
+	ListUsers(offset int, limit int) ([]*User, error)
+	DeactivateUser(email string) error
+	FindKey(keyID string) (key *Key, owner string, err error)
+	SetKeyQuota(keyID string, quota string) error
+	RevokeKey(keyID string) error
+}
+
 // A plugin that runs immediately after authentication (so the request is valid
 // and generally allowed), but before the quota is checked. Use this to restrict
 // access or modify cost based on things like the request's path. apiplexy checks
@@ -219,6 +550,10 @@ type PreUpstreamPlugin interface {
 // A PostUpstreamPlugin runs after the request has been handled by upstream, and
 // receives an additional "res" parameter. This is the response returned by upstream.
 // You can modify the response body here.
+//
+// You may also still change ctx.Cost, e.g. based on the response size. The
+// difference to the cost checked before is charged (or refunded) to the quota
+// afterwards, without rejecting the request that has already been served.
 type PostUpstreamPlugin interface {
 	ApiplexPlugin
 	PostUpstream(req *http.Request, res *http.Response, ctx *APIContext) error
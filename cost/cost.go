@@ -0,0 +1,160 @@
+package cost
+
+import (
+	"fmt"
+	"github.com/12foo/apiplexy"
+	"io"
+	"net/http"
+	"strconv"
+	"strings"
+)
+
+type costRule struct {
+	Methods  []string `config:"methods"`
+	Path     string   `config:"path"`
+	Query    []string `config:"query"`
+	KeyTypes []string `config:"key_types"`
+	Cost     int      `config:"cost" required:"true" min:"0"`
+}
+
+type costConfig struct {
+	Rules        []costRule `config:"rules"`
+	CostHeader   string     `config:"cost_header"`
+	BytesPerUnit int        `config:"bytes_per_unit" default:"0" min:"0"`
+	MaxCost      int        `config:"max_cost" default:"0" min:"0"`
+}
+
+// CostPlugin sets a request's cost from a table of rules, so expensive
+// endpoints use up more of the quota. The first rule matching the request's
+// method, path, query parameters and key type decides the cost; requests
+// matching no rule keep the default cost of 1.
+//
+// After the upstream has answered, the cost can be adjusted to what the request
+// actually turned out to cost: either by the upstream itself, through a header
+// such as X-Cost, or by the size of the response.
+type CostPlugin struct {
+	config *costConfig
+}
+
+func (rule *costRule) matches(req *http.Request, ctx *apiplexy.APIContext) bool {
+	if len(rule.Methods) > 0 && !contains(rule.Methods, req.Method) {
+		return false
+	}
+	if rule.Path != "" && !apiplexy.MatchPath(rule.Path, ctx.Path) {
+		return false
+	}
+	if len(rule.Query) > 0 {
+		query := req.URL.Query()
+		for _, param := range rule.Query {
+			if _, ok := query[param]; !ok {
+				return false
+			}
+		}
+	}
+	if len(rule.KeyTypes) > 0 && (ctx.Key == nil || !contains(rule.KeyTypes, ctx.Key.Type)) {
+		return false
+	}
+	return true
+}
+
+func contains(list []string, s string) bool {
+	for _, item := range list {
+		if item == s {
+			return true
+		}
+	}
+	return false
+}
+
+func (p *CostPlugin) PostAuth(req *http.Request, ctx *apiplexy.APIContext) error {
+	for i := range p.config.Rules {
+		if p.config.Rules[i].matches(req, ctx) {
+			ctx.Cost = p.config.Rules[i].Cost
+			break
+		}
+	}
+	return nil
+}
+
+// countingBody adds to a request's cost while the response body is read (i.e.
+// sent on to the client), so the body doesn't have to be held for counting.
+type countingBody struct {
+	io.ReadCloser
+	p    *CostPlugin
+	ctx  *apiplexy.APIContext
+	base int
+	read int
+}
+
+func (b *countingBody) Read(buf []byte) (int, error) {
+	n, err := b.ReadCloser.Read(buf)
+	b.read += n
+	b.ctx.Cost = b.p.capped(b.base + b.read/b.p.config.BytesPerUnit)
+	return n, err
+}
+
+func (p *CostPlugin) capped(cost int) int {
+	if p.config.MaxCost > 0 && cost > p.config.MaxCost {
+		return p.config.MaxCost
+	}
+	return cost
+}
+
+// PostUpstream adjusts the cost after the fact. A valid cost header from the
+// upstream sets the cost outright. Otherwise, if bytes_per_unit is set, every
+// full bytes_per_unit bytes of response body add one to the cost, as they are
+// sent to the client.
+func (p *CostPlugin) PostUpstream(req *http.Request, res *http.Response, ctx *apiplexy.APIContext) error {
+	if h := res.Header.Get(p.config.CostHeader); p.config.CostHeader != "" && h != "" {
+		if c, err := strconv.Atoi(strings.TrimSpace(h)); err == nil && c >= 0 {
+			ctx.Cost = c
+		}
+	} else if p.config.BytesPerUnit > 0 {
+		res.Body = &countingBody{ReadCloser: res.Body, p: p, ctx: ctx, base: ctx.Cost}
+	}
+	ctx.Cost = p.capped(ctx.Cost)
+	return nil
+}
+
+func (p *CostPlugin) ConfigStruct() interface{} {
+	return &costConfig{}
+}
+
+func (p *CostPlugin) ConfigureTyped(config interface{}) error {
+	c := config.(*costConfig)
+	for i := range c.Rules {
+		rule := &c.Rules[i]
+		if rule.Path != "" {
+			if err := apiplexy.ValidatePathPattern(rule.Path); err != nil {
+				return fmt.Errorf("Field 'rules[%d].path': %s", i, err.Error())
+			}
+		}
+		for j, m := range rule.Methods {
+			rule.Methods[j] = strings.ToUpper(m)
+		}
+	}
+	p.config = c
+	return nil
+}
+
+func (p *CostPlugin) DefaultConfig() map[string]interface{} {
+	d := apiplexy.TypedDefaultConfig(p)
+	d["rules"] = []interface{}{
+		map[string]interface{}{"methods": []interface{}{"POST"}, "path": "/reports/**", "cost": 10},
+	}
+	return d
+}
+
+func (p *CostPlugin) Configure(config map[string]interface{}) error {
+	return apiplexy.TypedConfigure(p, config)
+}
+
+func init() {
+	// _ = apiplexy.PostAuthPlugin(&CostPlugin{})
+	apiplexy.RegisterPlugin(
+		"cost",
+		"Set request costs from a table of method, path, query and key type rules.",
+		"https://github.com/12foo/apiplexy/tree/master/cost",
+		CostPlugin{},
+	)
+}
@@ -0,0 +1,119 @@
+package cost
+
+import (
+	"github.com/12foo/apiplexy"
+	. "github.com/smartystreets/goconvey/convey"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"strings"
+	"testing"
+)
+
+func costPlugin(config map[string]interface{}) (*CostPlugin, error) {
+	p := &CostPlugin{}
+	err := p.Configure(config)
+	return p, err
+}
+
+func postAuthCost(p *CostPlugin, method, path string, key *apiplexy.Key) int {
+	req, _ := http.NewRequest(method, "http://dummy-request.com"+path, nil)
+	ctx := &apiplexy.APIContext{Cost: 1, Path: strings.SplitN(path, "?", 2)[0], Key: key, Keyless: key == nil}
+	p.PostAuth(req, ctx)
+	return ctx.Cost
+}
+
+func TestConfigure(t *testing.T) {
+	Convey("Plugin should not panic when configuring with default configuration", t, func() {
+		So(func() {
+			tplugin := apiplexy.PostAuthPlugin(&CostPlugin{})
+			_ = tplugin.Configure(tplugin.DefaultConfig())
+		}, ShouldNotPanic)
+	})
+
+	Convey("Invalid rules should be refused", t, func() {
+		_, err := costPlugin(map[string]interface{}{"rules": []interface{}{
+			map[string]interface{}{"path": "/items/[a-", "cost": 2},
+		}})
+		So(err, ShouldNotBeNil)
+		_, err = costPlugin(map[string]interface{}{"rules": []interface{}{
+			map[string]interface{}{"path": "/items"},
+		}})
+		So(err, ShouldNotBeNil)
+	})
+}
+
+func TestCostTable(t *testing.T) {
+	hmacKey := &apiplexy.Key{ID: "k", Type: "HMAC"}
+	p, err := costPlugin(map[string]interface{}{"rules": []interface{}{
+		map[string]interface{}{"methods": []interface{}{"post"}, "path": "/reports/**", "cost": 10},
+		map[string]interface{}{"path": "/search", "query": []interface{}{"fulltext"}, "cost": 5},
+		map[string]interface{}{"path": "/search", "key_types": []interface{}{"HMAC"}, "cost": 0},
+		map[string]interface{}{"path": "/search", "cost": 2},
+	}})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	Convey("The first matching rule should set the cost", t, func() {
+		So(postAuthCost(p, "POST", "/reports/2015/q1", hmacKey), ShouldEqual, 10)
+		So(postAuthCost(p, "GET", "/search?fulltext=x", hmacKey), ShouldEqual, 5)
+		So(postAuthCost(p, "GET", "/search?q=x", hmacKey), ShouldEqual, 0)
+		So(postAuthCost(p, "GET", "/search?q=x", nil), ShouldEqual, 2)
+	})
+
+	Convey("Requests matching no rule should keep their cost", t, func() {
+		So(postAuthCost(p, "GET", "/reports/2015/q1", hmacKey), ShouldEqual, 1)
+		So(postAuthCost(p, "GET", "/items", nil), ShouldEqual, 1)
+	})
+}
+
+func TestAdjustment(t *testing.T) {
+	p, err := costPlugin(map[string]interface{}{"cost_header": "X-Cost", "bytes_per_unit": 100, "max_cost": 50})
+	if err != nil {
+		t.Fatal(err)
+	}
+	adjust := func(header string, body string) (int, string) {
+		req, _ := http.NewRequest("GET", "http://dummy-request.com/items", nil)
+		res := &http.Response{Header: http.Header{}, Body: ioutil.NopCloser(strings.NewReader(body))}
+		if header != "" {
+			res.Header.Set("X-Cost", header)
+		}
+		ctx := &apiplexy.APIContext{Cost: 2}
+		p.PostUpstream(req, res, ctx)
+		b, _ := ioutil.ReadAll(res.Body)
+		return ctx.Cost, string(b)
+	}
+
+	Convey("The upstream's cost header should set the cost", t, func() {
+		cost, _ := adjust("7", "")
+		So(cost, ShouldEqual, 7)
+		cost, _ = adjust("1000", "")
+		So(cost, ShouldEqual, 50)
+		cost, _ = adjust("lots", "")
+		So(cost, ShouldEqual, 2)
+	})
+
+	Convey("Without a header, large responses should cost more", t, func() {
+		cost, body := adjust("", strings.Repeat("x", 250))
+		So(cost, ShouldEqual, 4)
+		So(len(body), ShouldEqual, 250)
+		cost, _ = adjust("", "small")
+		So(cost, ShouldEqual, 2)
+		cost, _ = adjust("", strings.Repeat("x", 10000))
+		So(cost, ShouldEqual, 50)
+	})
+
+	Convey("Response sizes should be counted as the body is sent, not up front", t, func() {
+		req, _ := http.NewRequest("GET", "http://dummy-request.com/items", nil)
+		res := &http.Response{Header: http.Header{}, Body: ioutil.NopCloser(strings.NewReader(strings.Repeat("x", 250)))}
+		ctx := &apiplexy.APIContext{Cost: 2}
+		p.PostUpstream(req, res, ctx)
+		So(ctx.Cost, ShouldEqual, 2)
+		buf := make([]byte, 150)
+		io.ReadFull(res.Body, buf)
+		So(ctx.Cost, ShouldEqual, 3)
+		ioutil.ReadAll(res.Body)
+		So(ctx.Cost, ShouldEqual, 4)
+	})
+}
@@ -0,0 +1,419 @@
+package external
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"github.com/12foo/apiplexy"
+	"io"
+	"io/ioutil"
+	"log"
+	"net"
+	"net/http"
+	"net/rpc"
+	"net/rpc/jsonrpc"
+	"os"
+	"os/exec"
+	"strings"
+	"sync"
+	"time"
+)
+
+const maxRestartBackoff = 30 * time.Second
+
+// maxUpstreams is how many upstreams chosen by the plugin are kept at once.
+const maxUpstreams = 100
+
+var errTimeout = errors.New("call timed out")
+
+type externalConfig struct {
+	Command        []string               `config:"command"`
+	Env            map[string]string      `config:"env"`
+	Socket         string                 `config:"socket"`
+	Config         map[string]interface{} `config:"config"`
+	Timeout        time.Duration          `config:"timeout" default:"2s" min:"1ms"`
+	SendBody       bool                   `config:"send_body" default:"false"`
+	FailOpen       bool                   `config:"fail_open" default:"false"`
+	RestartBackoff time.Duration          `config:"restart_backoff" default:"1s" min:"0s"`
+}
+
+// ExternalPlugin runs a plugin outside of the apiplexy process, either by
+// launching an executable and talking to it over stdin/stdout, or by
+// connecting to a unix socket. See protocol.go for the wire protocol.
+//
+// If the plugin crashes, hangs past the call timeout or drops the connection,
+// it is restarted (or reconnected) on the next call, with exponential backoff.
+type ExternalPlugin struct {
+	config *externalConfig
+
+	lock      sync.Mutex
+	client    *rpc.Client
+	cmd       *exec.Cmd
+	exited    chan struct{}
+	stages    map[string]bool
+	backoff   time.Duration
+	nextStart time.Time
+	closed    bool
+
+	upstreams *apiplexy.UpstreamCache
+}
+
+func (p *ExternalPlugin) launch() (io.ReadWriteCloser, error) {
+	if p.config.Socket != "" {
+		return net.DialTimeout("unix", p.config.Socket, p.config.Timeout)
+	}
+	cmd := exec.Command(p.config.Command[0], p.config.Command[1:]...)
+	cmd.Env = os.Environ()
+	for k, v := range p.config.Env {
+		cmd.Env = append(cmd.Env, k+"="+v)
+	}
+	stdin, err := cmd.StdinPipe()
+	if err != nil {
+		return nil, err
+	}
+	// not cmd.StdoutPipe: Wait closes those right away, possibly before we
+	// have read everything the plugin wrote before exiting
+	stdout, stdoutW := io.Pipe()
+	stderr, stderrW := io.Pipe()
+	cmd.Stdout = stdoutW
+	cmd.Stderr = stderrW
+	if err := cmd.Start(); err != nil {
+		return nil, err
+	}
+	go func() {
+		scanner := bufio.NewScanner(stderr)
+		for scanner.Scan() {
+			log.Printf("[%s] %s\n", p.config.Command[0], scanner.Text())
+		}
+	}()
+	exited := make(chan struct{})
+	go func() {
+		cmd.Wait()
+		stdoutW.Close()
+		stderrW.Close()
+		close(exited)
+	}()
+	p.cmd = cmd
+	p.exited = exited
+	return stdioConn{stdout, stdin}, nil
+}
+
+// connect launches (or dials) the plugin and performs the handshake. Must be
+// called with the lock held.
+func (p *ExternalPlugin) connect() error {
+	conn, err := p.launch()
+	if err != nil {
+		return err
+	}
+	client := jsonrpc.NewClient(conn)
+	hs := HandshakeResult{}
+	err = callTimeout(client, "Plugin.Handshake", &HandshakeArgs{ProtocolVersion: ProtocolVersion, Config: p.config.Config}, &hs, p.config.Timeout)
+	if err == nil && hs.ProtocolVersion != ProtocolVersion {
+		err = fmt.Errorf("plugin speaks protocol version %d, apiplexy speaks version %d", hs.ProtocolVersion, ProtocolVersion)
+	}
+	if err != nil {
+		client.Close()
+		p.kill()
+		return fmt.Errorf("Handshake failed: %s", err.Error())
+	}
+	p.client = client
+	p.stages = make(map[string]bool, len(hs.Stages))
+	for _, s := range hs.Stages {
+		p.stages[strings.ToLower(s)] = true
+	}
+	return nil
+}
+
+func (p *ExternalPlugin) kill() {
+	if p.cmd != nil && p.cmd.Process != nil {
+		p.cmd.Process.Kill()
+	}
+	p.cmd = nil
+}
+
+// getClient returns a live client, restarting the plugin if necessary.
+func (p *ExternalPlugin) getClient() (*rpc.Client, error) {
+	p.lock.Lock()
+	defer p.lock.Unlock()
+	if p.closed {
+		return nil, fmt.Errorf("Plugin has been closed.")
+	}
+	if p.client != nil && p.exited != nil {
+		select {
+		case <-p.exited:
+			p.reset(p.client)
+		default:
+		}
+	}
+	if p.client != nil {
+		return p.client, nil
+	}
+	if time.Now().Before(p.nextStart) {
+		return nil, fmt.Errorf("Plugin is down, waiting %s before restarting.", p.nextStart.Sub(time.Now()).String())
+	}
+	if err := p.connect(); err != nil {
+		p.backoff *= 2
+		if p.backoff == 0 {
+			p.backoff = p.config.RestartBackoff
+		}
+		if p.backoff > maxRestartBackoff {
+			p.backoff = maxRestartBackoff
+		}
+		p.nextStart = time.Now().Add(p.backoff)
+		return nil, err
+	}
+	p.backoff = 0
+	return p.client, nil
+}
+
+// reset drops a broken client (and its process), so the next call restarts
+// the plugin. Must be called with the lock held.
+func (p *ExternalPlugin) reset(client *rpc.Client) {
+	if p.client != client {
+		return
+	}
+	p.client.Close()
+	p.client = nil
+	p.kill()
+	p.nextStart = time.Now().Add(p.config.RestartBackoff)
+}
+
+func callTimeout(client *rpc.Client, method string, args interface{}, reply interface{}, timeout time.Duration) error {
+	call := client.Go(method, args, reply, make(chan *rpc.Call, 1))
+	select {
+	case <-call.Done:
+		return call.Error
+	case <-time.After(timeout):
+		return errTimeout
+	}
+}
+
+func (p *ExternalPlugin) call(method string, args interface{}, reply interface{}) error {
+	client, err := p.getClient()
+	if err != nil {
+		return err
+	}
+	err = callTimeout(client, method, args, reply, p.config.Timeout)
+	if err != nil {
+		if _, isPluginError := err.(rpc.ServerError); !isPluginError {
+			// crashed, hung or disconnected
+			p.lock.Lock()
+			p.reset(client)
+			p.lock.Unlock()
+		}
+		return fmt.Errorf("External plugin call %s failed: %w", method, err)
+	}
+	return nil
+}
+
+func (p *ExternalPlugin) wantsStage(stage string) bool {
+	if _, err := p.getClient(); err != nil {
+		// let the call itself fail (or fail open)
+		return true
+	}
+	p.lock.Lock()
+	defer p.lock.Unlock()
+	return p.stages[stage]
+}
+
+func readBody(body io.ReadCloser) ([]byte, io.ReadCloser, error) {
+	if body == nil {
+		return nil, nil, nil
+	}
+	b, err := ioutil.ReadAll(body)
+	body.Close()
+	if err != nil {
+		return nil, nil, err
+	}
+	return b, ioutil.NopCloser(bytes.NewReader(b)), nil
+}
+
+func (p *ExternalPlugin) buildArgs(stage string, req *http.Request, res *http.Response, ctx *apiplexy.APIContext) (*StageArgs, error) {
+	cost := ctx.Cost
+	args := StageArgs{
+		Stage: stage,
+		Request: Request{
+			Method:     req.Method,
+			URL:        req.URL.String(),
+			RemoteAddr: req.RemoteAddr,
+			Header:     req.Header,
+		},
+		Context: Context{
+			Keyless: ctx.Keyless,
+			Key:     ctx.Key,
+			Cost:    &cost,
+			Path:    ctx.Path,
+			Log:     ctx.Log,
+			Data:    ctx.Data,
+		},
+	}
+	if ctx.Upstream != nil {
+		args.Context.Upstream = ctx.Upstream.Address.String()
+	}
+	if p.config.SendBody {
+		b, body, err := readBody(req.Body)
+		if err != nil {
+			return nil, err
+		}
+		args.Request.Body, req.Body = b, body
+	}
+	if res != nil {
+		args.Response = &Response{Status: res.StatusCode, Header: res.Header}
+		if p.config.SendBody {
+			b, body, err := readBody(res.Body)
+			if err != nil {
+				return nil, err
+			}
+			args.Response.Body, res.Body = b, body
+		}
+	}
+	return &args, nil
+}
+
+func (p *ExternalPlugin) apply(result *StageResult, req *http.Request, res *http.Response, ctx *apiplexy.APIContext) error {
+	if result.Abort != nil {
+		status := result.Abort.Status
+		if status == 0 {
+			status = 400
+		}
+		return apiplexy.Abort(status, result.Abort.Message)
+	}
+	if c := result.Context; c != nil {
+		if c.Cost != nil {
+			ctx.Cost = *c.Cost
+		}
+		if c.Log != nil {
+			ctx.Log = c.Log
+		}
+		if c.Data != nil {
+			ctx.Data = c.Data
+		}
+		if c.Upstream != "" && (ctx.Upstream == nil || ctx.Upstream.Address.String() != c.Upstream) {
+			us, err := p.upstreams.Get(c.Upstream)
+			if err != nil {
+				return fmt.Errorf("External plugin chose an invalid upstream: %s", err.Error())
+			}
+			ctx.Upstream = us
+		}
+	}
+	if result.Header != nil {
+		req.Header = result.Header
+	}
+	if r := result.Response; r != nil && res != nil {
+		if r.Status != 0 {
+			res.StatusCode = r.Status
+			res.Status = fmt.Sprintf("%d %s", r.Status, http.StatusText(r.Status))
+		}
+		if r.Header != nil {
+			res.Header = r.Header
+		}
+		if r.Body != nil {
+			res.Body = ioutil.NopCloser(bytes.NewReader(r.Body))
+			res.ContentLength = int64(len(r.Body))
+		}
+	}
+	return nil
+}
+
+func (p *ExternalPlugin) runStage(stage, method string, req *http.Request, res *http.Response, ctx *apiplexy.APIContext) error {
+	if !p.wantsStage(stage) {
+		return nil
+	}
+	args, err := p.buildArgs(stage, req, res, ctx)
+	if err != nil {
+		return err
+	}
+	result := StageResult{}
+	if err := p.call(method, args, &result); err != nil {
+		if p.config.FailOpen {
+			log.Println(err.Error())
+			return nil
+		}
+		return err
+	}
+	return p.apply(&result, req, res, ctx)
+}
+
+func (p *ExternalPlugin) PostAuth(req *http.Request, ctx *apiplexy.APIContext) error {
+	return p.runStage("postauth", "Plugin.PostAuth", req, nil, ctx)
+}
+
+func (p *ExternalPlugin) PreUpstream(req *http.Request, ctx *apiplexy.APIContext) error {
+	return p.runStage("preupstream", "Plugin.PreUpstream", req, nil, ctx)
+}
+
+func (p *ExternalPlugin) PostUpstream(req *http.Request, res *http.Response, ctx *apiplexy.APIContext) error {
+	return p.runStage("postupstream", "Plugin.PostUpstream", req, res, ctx)
+}
+
+func (p *ExternalPlugin) Log(req *http.Request, res *http.Response, ctx *apiplexy.APIContext) error {
+	return p.runStage("log", "Plugin.Log", req, res, ctx)
+}
+
+func (p *ExternalPlugin) Start(ctx context.Context) error {
+	p.lock.Lock()
+	defer p.lock.Unlock()
+	return p.connect()
+}
+
+// Health asks the plugin whether it is healthy. Plugins that don't implement
+// Plugin.Health are taken to be.
+func (p *ExternalPlugin) Health() error {
+	err := p.call("Plugin.Health", &Empty{}, &Empty{})
+	var se rpc.ServerError
+	if errors.As(err, &se) && strings.HasPrefix(string(se), "rpc: can't find method") {
+		return nil
+	}
+	return err
+}
+
+func (p *ExternalPlugin) Close() error {
+	p.lock.Lock()
+	defer p.lock.Unlock()
+	p.closed = true
+	if p.client == nil {
+		return nil
+	}
+	// give the plugin a chance to clean up, but don't wait for it too long
+	callTimeout(p.client, "Plugin.Close", &Empty{}, &Empty{}, p.config.Timeout)
+	p.client.Close()
+	p.client = nil
+	p.kill()
+	return nil
+}
+
+func (p *ExternalPlugin) ConfigStruct() interface{} {
+	return &externalConfig{}
+}
+
+func (p *ExternalPlugin) ConfigureTyped(config interface{}) error {
+	c := config.(*externalConfig)
+	if (len(c.Command) == 0) == (c.Socket == "") {
+		return fmt.Errorf("Specify either a command to launch, or a socket to connect to.")
+	}
+	p.config = c
+	p.upstreams = apiplexy.NewUpstreamCache(maxUpstreams)
+	return nil
+}
+
+func (p *ExternalPlugin) DefaultConfig() map[string]interface{} {
+	d := apiplexy.TypedDefaultConfig(p)
+	d["command"] = []interface{}{"/path/to/your/plugin"}
+	return d
+}
+
+func (p *ExternalPlugin) Configure(config map[string]interface{}) error {
+	return apiplexy.TypedConfigure(p, config)
+}
+
+func init() {
+	// _ = apiplexy.PostAuthPlugin(&ExternalPlugin{})
+	apiplexy.RegisterPlugin(
+		"external",
+		"Run a plugin as a separate process (in any language), talking JSON-RPC.",
+		"https://github.com/12foo/apiplexy/tree/master/external",
+		ExternalPlugin{},
+	)
+}
@@ -0,0 +1,195 @@
+package external
+
+import (
+	"context"
+	"fmt"
+	"github.com/12foo/apiplexy"
+	. "github.com/smartystreets/goconvey/convey"
+	"net/http"
+	"os"
+	"testing"
+	"time"
+)
+
+// helperPlugin is served by the test binary itself when it is launched as an
+// external plugin (see TestHelperPlugin).
+type helperPlugin struct {
+	config map[string]interface{}
+}
+
+func (h *helperPlugin) Handshake(args *HandshakeArgs, result *HandshakeResult) error {
+	h.config = args.Config
+	result.ProtocolVersion = ProtocolVersion
+	result.Stages = []string{"postauth"}
+	return nil
+}
+
+func (h *helperPlugin) PostAuth(args *StageArgs, result *StageResult) error {
+	switch args.Context.Path {
+	case "/crash":
+		os.Exit(1)
+	case "/slow":
+		time.Sleep(time.Second)
+	case "/forbidden":
+		result.Abort = &AbortResult{Status: 403, Message: "Not for you."}
+		return nil
+	case "/log-only":
+		result.Context = &Context{Log: map[string]interface{}{"pid": os.Getpid()}}
+		return nil
+	}
+	c := args.Context
+	cost := int(h.config["cost"].(float64))
+	c.Cost = &cost
+	c.Log["pid"] = os.Getpid()
+	result.Context = &c
+	return nil
+}
+
+func (h *helperPlugin) Health(args *Empty, result *Empty) error {
+	return nil
+}
+
+// minimalPlugin implements as little of the protocol as possible.
+type minimalPlugin struct{}
+
+func (m *minimalPlugin) Handshake(args *HandshakeArgs, result *HandshakeResult) error {
+	result.ProtocolVersion = ProtocolVersion
+	return nil
+}
+
+func TestHelperPlugin(t *testing.T) {
+	switch os.Getenv("APIPLEXY_HELPER_PLUGIN") {
+	case "1":
+		Serve(&helperPlugin{})
+	case "minimal":
+		Serve(&minimalPlugin{})
+	default:
+		return
+	}
+	os.Exit(0)
+}
+
+func helperConfig(extra map[string]interface{}) map[string]interface{} {
+	config := map[string]interface{}{
+		"command":         []interface{}{os.Args[0], "-test.run=TestHelperPlugin"},
+		"env":             map[string]interface{}{"APIPLEXY_HELPER_PLUGIN": "1"},
+		"config":          map[string]interface{}{"cost": 5},
+		"timeout":         "200ms",
+		"restart_backoff": "1ms",
+	}
+	for k, v := range extra {
+		config[k] = v
+	}
+	return config
+}
+
+func runPostAuth(p *ExternalPlugin, path string) (*apiplexy.APIContext, error) {
+	req, _ := http.NewRequest("GET", "http://dummy-request.com"+path, nil)
+	ctx := apiplexy.APIContext{Cost: 1, Path: path, Log: map[string]interface{}{}, Data: map[string]interface{}{}}
+	err := p.PostAuth(req, &ctx)
+	return &ctx, err
+}
+
+func TestConfigure(t *testing.T) {
+	Convey("Plugin should not panic when configuring with default configuration", t, func() {
+		So(func() {
+			tplugin := apiplexy.PostAuthPlugin(&ExternalPlugin{})
+			_ = tplugin.Configure(tplugin.DefaultConfig())
+		}, ShouldNotPanic)
+	})
+
+	Convey("Plugin should insist on either a command or a socket", t, func() {
+		p := ExternalPlugin{}
+		So(p.Configure(map[string]interface{}{}), ShouldNotBeNil)
+		So(p.Configure(map[string]interface{}{"command": []interface{}{"x"}, "socket": "/tmp/x.sock"}), ShouldNotBeNil)
+	})
+}
+
+func TestExternalPlugin(t *testing.T) {
+	p := ExternalPlugin{}
+	if err := p.Configure(helperConfig(nil)); err != nil {
+		t.Fatal(err)
+	}
+	if err := p.Start(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+	defer p.Close()
+
+	Convey("Stage calls should update the context", t, func() {
+		ctx, err := runPostAuth(&p, "/items")
+		So(err, ShouldBeNil)
+		So(ctx.Cost, ShouldEqual, 5)
+		So(ctx.Log["pid"], ShouldNotBeNil)
+		So(p.Health(), ShouldBeNil)
+	})
+
+	Convey("Context fields left out should be kept", t, func() {
+		ctx, err := runPostAuth(&p, "/log-only")
+		So(err, ShouldBeNil)
+		So(ctx.Cost, ShouldEqual, 1)
+		So(ctx.Log["pid"], ShouldNotBeNil)
+	})
+
+	Convey("Aborts should be passed on as AbortRequests", t, func() {
+		_, err := runPostAuth(&p, "/forbidden")
+		So(err, ShouldResemble, apiplexy.Abort(403, "Not for you."))
+	})
+
+	Convey("A crashed plugin should be restarted", t, func() {
+		before, _ := runPostAuth(&p, "/items")
+		_, err := runPostAuth(&p, "/crash")
+		So(err, ShouldNotBeNil)
+		time.Sleep(10 * time.Millisecond)
+		after, err := runPostAuth(&p, "/items")
+		So(err, ShouldBeNil)
+		So(after.Log["pid"], ShouldNotEqual, before.Log["pid"])
+	})
+
+	Convey("A hanging plugin should time out", t, func() {
+		_, err := runPostAuth(&p, "/slow")
+		So(err, ShouldNotBeNil)
+		So(err.Error(), ShouldContainSubstring, "timed out")
+	})
+}
+
+func TestMinimalPlugin(t *testing.T) {
+	p := ExternalPlugin{}
+	if err := p.Configure(helperConfig(map[string]interface{}{"env": map[string]interface{}{"APIPLEXY_HELPER_PLUGIN": "minimal"}})); err != nil {
+		t.Fatal(err)
+	}
+	if err := p.Start(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+	defer p.Close()
+
+	Convey("Plugins without Health should be taken to be healthy", t, func() {
+		So(p.Health(), ShouldBeNil)
+	})
+}
+
+func TestFailOpen(t *testing.T) {
+	p := ExternalPlugin{}
+	if err := p.Configure(helperConfig(map[string]interface{}{"fail_open": true})); err != nil {
+		t.Fatal(err)
+	}
+	if err := p.Start(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+	defer p.Close()
+
+	Convey("With fail_open, a failing plugin should be skipped", t, func() {
+		ctx, err := runPostAuth(&p, "/slow")
+		So(err, ShouldBeNil)
+		So(ctx.Cost, ShouldEqual, 1)
+	})
+}
+
+func TestVersionMismatch(t *testing.T) {
+	Convey("Plugins speaking another protocol version should be refused", t, func() {
+		p := ExternalPlugin{}
+		So(p.Configure(map[string]interface{}{"command": []interface{}{"sh", "-c", fmt.Sprintf(`read line; echo '{"id":0,"result":{"protocol_version":%d},"error":null}'`, ProtocolVersion+1)}}), ShouldBeNil)
+		err := p.Start(context.Background())
+		So(err, ShouldNotBeNil)
+		So(err.Error(), ShouldContainSubstring, "protocol version")
+	})
+}
@@ -0,0 +1,140 @@
+package external
+
+import (
+	"github.com/12foo/apiplexy"
+	"io"
+	"net/http"
+	"net/rpc"
+	"net/rpc/jsonrpc"
+	"os"
+)
+
+// ProtocolVersion is the version of the plugin protocol spoken by this
+// package. Plugins must answer the handshake with the same version.
+const ProtocolVersion = 1
+
+// The protocol is JSON-RPC 1.0 (as implemented by net/rpc/jsonrpc): a stream of
+// request objects {"method": ..., "params": [args], "id": ...} answered by
+// {"id": ..., "result": ..., "error": null|"message"}, over the plugin's
+// stdin/stdout or a unix socket. Byte slices ([]byte) travel as base64 strings.
+//
+// Methods, in lifecycle order:
+//
+//  Plugin.Handshake    HandshakeArgs -> HandshakeResult
+//  Plugin.PostAuth     StageArgs     -> StageResult
+//  Plugin.PreUpstream  StageArgs     -> StageResult
+//  Plugin.PostUpstream StageArgs     -> StageResult
+//  Plugin.Log          StageArgs     -> StageResult
+//  Plugin.Health       Empty         -> Empty
+//  Plugin.Close        Empty         -> Empty
+//
+// Only Handshake is mandatory. Stage methods are only called for the stages
+// listed in HandshakeResult.Stages. Health errors are reported; a plugin
+// without Health is taken to be healthy. Close errors and a missing Close are
+// ignored.
+
+// HandshakeArgs is sent right after the plugin has been launched (or the
+// socket has been connected), and again after every restart. Config is the
+// "config" map from the apiplexy configuration.
+type HandshakeArgs struct {
+	ProtocolVersion int                    `json:"protocol_version"`
+	Config          map[string]interface{} `json:"config"`
+}
+
+// HandshakeResult must echo ProtocolVersion, and lists the stages ("postauth",
+// "preupstream", "postupstream", "log") the plugin wants to be called for.
+type HandshakeResult struct {
+	ProtocolVersion int      `json:"protocol_version"`
+	Stages          []string `json:"stages"`
+}
+
+// Request describes the incoming API request. Body is only sent if the
+// plugin is configured with send_body.
+type Request struct {
+	Method     string      `json:"method"`
+	URL        string      `json:"url"`
+	RemoteAddr string      `json:"remote_addr"`
+	Header     http.Header `json:"header"`
+	Body       []byte      `json:"body,omitempty"`
+}
+
+// Response describes the upstream response (PostUpstream and Log only).
+type Response struct {
+	Status int         `json:"status"`
+	Header http.Header `json:"header"`
+	Body   []byte      `json:"body,omitempty"`
+}
+
+// Context mirrors apiplexy.APIContext. Upstream is the address of the chosen
+// upstream (empty if none has been chosen yet).
+type Context struct {
+	Keyless  bool                   `json:"keyless"`
+	Key      *apiplexy.Key          `json:"key,omitempty"`
+	Cost     *int                   `json:"cost,omitempty"`
+	Path     string                 `json:"path"`
+	Upstream string                 `json:"upstream,omitempty"`
+	Log      map[string]interface{} `json:"log"`
+	Data     map[string]interface{} `json:"data"`
+}
+
+type StageArgs struct {
+	Stage    string    `json:"stage"`
+	Request  Request   `json:"request"`
+	Response *Response `json:"response,omitempty"`
+	Context  Context   `json:"context"`
+}
+
+// StageResult carries a plugin's changes; all fields are optional.
+//
+// Context: Cost, Upstream, Log and Data are taken over where set (Cost, Log
+// and Data only if non-null, Upstream only if non-empty). The key cannot be
+// changed.
+// Header: replaces the request headers (PostAuth, PreUpstream).
+// Response: Status, Header and Body replace the upstream response's, where
+// set (PostUpstream).
+// Abort: ends the request with the given status and message.
+type StageResult struct {
+	Context  *Context     `json:"context,omitempty"`
+	Header   http.Header  `json:"header,omitempty"`
+	Response *Response    `json:"response,omitempty"`
+	Abort    *AbortResult `json:"abort,omitempty"`
+}
+
+type AbortResult struct {
+	Status  int    `json:"status"`
+	Message string `json:"message"`
+}
+
+type Empty struct{}
+
+type stdioConn struct {
+	io.ReadCloser
+	io.WriteCloser
+}
+
+func (c stdioConn) Close() error {
+	c.WriteCloser.Close()
+	return c.ReadCloser.Close()
+}
+
+// ServeConn serves a plugin written in Go over a connection. The plugin must
+// have a Handshake method and any stage methods it announces, with net/rpc
+// signatures, e.g.:
+//
+//  func (p *MyPlugin) Handshake(args *external.HandshakeArgs, result *external.HandshakeResult) error
+//  func (p *MyPlugin) PostAuth(args *external.StageArgs, result *external.StageResult) error
+func ServeConn(plugin interface{}, conn io.ReadWriteCloser) error {
+	server := rpc.NewServer()
+	if err := server.RegisterName("Plugin", plugin); err != nil {
+		return err
+	}
+	server.ServeCodec(jsonrpc.NewServerCodec(conn))
+	return nil
+}
+
+// Serve serves a plugin written in Go over stdin/stdout, which is how apiplexy
+// talks to plugins it launches via "command". Don't write anything else to
+// stdout; use stderr for logging.
+func Serve(plugin interface{}) error {
+	return ServeConn(plugin, stdioConn{os.Stdin, os.Stdout})
+}
@@ -0,0 +1,255 @@
+package apiplexy
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"strings"
+	"sync"
+)
+
+type pluginInstance struct {
+	name   string
+	plugin interface{}
+}
+
+// A Gateway is a running apiplexy instance. It serves the API (and the portal
+// API, if configured), and manages the lifecycle of all configured plugins.
+// The whole configuration can be swapped out at runtime using Reload.
+type Gateway struct {
+	mu      sync.RWMutex
+	current *apiplex
+}
+
+// New builds a Gateway from a configuration: all plugins are created and
+// configured, then started.
+func New(config ApiplexConfig) (*Gateway, error) {
+	ap, err := buildGateway(config)
+	if err != nil {
+		return nil, err
+	}
+	return &Gateway{current: ap}, nil
+}
+
+func buildGateway(config ApiplexConfig) (*apiplex, error) {
+	ap, err := buildApiplex(config)
+	if err != nil {
+		return nil, err
+	}
+
+	mux := http.NewServeMux()
+	mux.HandleFunc(ap.apipath, ap.HandleAPI)
+
+	if config.Serve.PortalAPI != "" {
+		papath := ensureFinalSlash(config.Serve.PortalAPI)
+		portalAPI, err := ap.BuildPortalAPI(config.Serve.PortalAPI)
+		if err != nil {
+			ap.close()
+			return nil, fmt.Errorf("Could not create Portal API. %s", err.Error())
+		}
+		mux.Handle(papath, portalAPI)
+	}
+
+	if config.Serve.AdminAPI != "" {
+		adpath := ensureFinalSlash(config.Serve.AdminAPI)
+		adminAPI, err := ap.BuildAdminAPI(config.Serve.AdminAPI, config.Serve.AdminToken)
+		if err != nil {
+			ap.close()
+			return nil, fmt.Errorf("Could not create admin API. %s", err.Error())
+		}
+		mux.Handle(adpath, adminAPI)
+	}
+
+	if config.OAuth2.TokenEndpoint != "" {
+		tokens, err := newTokenEndpoint(config.OAuth2, ap)
+		if err != nil {
+			ap.close()
+			return nil, fmt.Errorf("Invalid OAuth2 configuration: %s", err.Error())
+		}
+		mux.HandleFunc(config.OAuth2.TokenEndpoint, tokens.HandleToken)
+	}
+
+	if config.Serve.Health != "" {
+		if err := ap.checkOutsideAPI("health", config.Serve.Health); err != nil {
+			ap.close()
+			return nil, fmt.Errorf("Invalid health configuration: %s", err.Error())
+		}
+		mux.HandleFunc(config.Serve.Health, ap.HandleHealth)
+	}
+
+	if config.Probes.Liveness != "" || config.Probes.Readiness != "" {
+		probes, err := newProbes(config.Probes, ap)
+		if err != nil {
+			ap.close()
+			return nil, fmt.Errorf("Invalid probe configuration: %s", err.Error())
+		}
+		if config.Probes.Liveness != "" {
+			mux.HandleFunc(config.Probes.Liveness, probes.HandleLiveness)
+		}
+		if config.Probes.Readiness != "" {
+			mux.HandleFunc(config.Probes.Readiness, probes.HandleReadiness)
+		}
+	}
+
+	if ap.metrics != nil {
+		if err := ap.checkOutsideAPI("metrics", config.Metrics.Path); err != nil {
+			ap.close()
+			return nil, fmt.Errorf("Invalid metrics configuration: %s", err.Error())
+		}
+		mux.Handle(config.Metrics.Path, ap.metrics.handler())
+	}
+
+	ap.handler = ap.denyClients(mux)
+
+	if err := ap.start(); err != nil {
+		return nil, err
+	}
+	return ap, nil
+}
+
+// checkOutsideAPI makes sure that one of the gateway's own endpoints isn't
+// mounted under the API path, where it would shadow the upstream's routes.
+func (ap *apiplex) checkOutsideAPI(endpoint string, path string) error {
+	if path != "" && strings.HasPrefix(ensureFinalSlash(path), ap.apipath) {
+		return fmt.Errorf("The %s path '%s' is inside the API path '%s'. Move one of them.", endpoint, path, ap.apipath)
+	}
+	return nil
+}
+
+// denyClients turns away clients on the gateway-wide deny list, before any of
+// the gateway's handlers (API, portal, admin API, token endpoint) sees them.
+func (ap *apiplex) denyClients(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(res http.ResponseWriter, req *http.Request) {
+		if ap.network.denied(ap.network.clientIP(req)) {
+			ap.metrics.authFailure("denied_ip")
+			ap.error(500, errDeniedIP, res)
+			return
+		}
+		next.ServeHTTP(res, req)
+	})
+}
+
+// ServeHTTP hands the request to the currently active configuration.
+func (g *Gateway) ServeHTTP(res http.ResponseWriter, req *http.Request) {
+	g.mu.RLock()
+	ap := g.current
+	ap.inflight.Add(1)
+	g.mu.RUnlock()
+	defer ap.inflight.Done()
+	ap.handler.ServeHTTP(res, req)
+}
+
+// Reload builds and starts a complete new set of plugins from the supplied
+// configuration, then swaps it in. The old plugins are closed as soon as
+// their in-flight requests have finished. If the new configuration fails to
+// build or start, the gateway keeps running on the old one.
+//
+// Note that the listening port cannot be changed by a reload.
+func (g *Gateway) Reload(config ApiplexConfig) error {
+	ap, err := buildGateway(config)
+	if err != nil {
+		return err
+	}
+	g.mu.Lock()
+	old := g.current
+	g.current = ap
+	g.mu.Unlock()
+
+	go func() {
+		old.inflight.Wait()
+		if err := old.close(); err != nil {
+			log.Printf("Error while closing previous configuration: %s\n", err.Error())
+		}
+	}()
+	return nil
+}
+
+// Close shuts down the gateway's plugins and connections. Stop accepting
+// requests (e.g. via http.Server.Shutdown) before calling this.
+func (g *Gateway) Close() error {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	g.current.inflight.Wait()
+	return g.current.close()
+}
+
+// start runs Start on all plugins that implement StartablePlugin, in the
+// order they were configured. If one fails, the whole set is closed again.
+// Then it starts listening for key changes.
+func (ap *apiplex) start() error {
+	ctx, cancel := context.WithCancel(context.Background())
+	ap.cancel = cancel
+	for _, p := range ap.plugins {
+		if sp, ok := p.plugin.(StartablePlugin); ok {
+			if err := sp.Start(ctx); err != nil {
+				ap.close()
+				return fmt.Errorf("While starting '%s': %s", p.name, err.Error())
+			}
+		}
+	}
+	go ap.watchKeys(ctx)
+	return nil
+}
+
+// closePlugins runs Close on all plugins that implement ClosablePlugin, in
+// reverse order. All plugins are closed, even if some return errors; the first
+// error is returned.
+func (ap *apiplex) closePlugins() error {
+	var first error
+	for i := len(ap.plugins) - 1; i >= 0; i-- {
+		p := ap.plugins[i]
+		if cp, ok := p.plugin.(ClosablePlugin); ok {
+			if err := cp.Close(); err != nil && first == nil {
+				first = fmt.Errorf("While closing '%s': %s", p.name, err.Error())
+			}
+		}
+	}
+	return first
+}
+
+func (ap *apiplex) close() error {
+	if ap.cancel != nil {
+		ap.cancel()
+	}
+	err := ap.closePlugins()
+	if terr := ap.tracing.close(); terr != nil && err == nil {
+		err = terr
+	}
+	if ap.redis != nil {
+		ap.redis.Close()
+	}
+	return err
+}
+
+type healthReport struct {
+	Status  string            `json:"status"`
+	Plugins map[string]string `json:"plugins"`
+}
+
+// HandleHealth reports the health of all plugins that implement
+// HealthReportingPlugin. Responds 200 if all of them are fine, 503 otherwise.
+// Plugins are only reported as "ok" or "error"; what went wrong is logged, as
+// plugin errors may well mention hosts or connection strings.
+func (ap *apiplex) HandleHealth(res http.ResponseWriter, req *http.Request) {
+	report := healthReport{Status: "ok", Plugins: make(map[string]string)}
+	for _, p := range ap.plugins {
+		if hp, ok := p.plugin.(HealthReportingPlugin); ok {
+			if err := hp.Health(); err != nil {
+				log.Printf("Plugin '%s' is unhealthy: %s\n", p.name, err.Error())
+				report.Status = "error"
+				report.Plugins[p.name] = "error"
+			} else {
+				report.Plugins[p.name] = "ok"
+			}
+		}
+	}
+	res.Header().Set("Content-Type", "application/json;charset=utf-8")
+	if report.Status == "ok" {
+		res.WriteHeader(http.StatusOK)
+	} else {
+		res.WriteHeader(http.StatusServiceUnavailable)
+	}
+	json.NewEncoder(res).Encode(&report)
+}
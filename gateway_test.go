@@ -0,0 +1,47 @@
+package apiplexy
+
+import (
+	"context"
+	"fmt"
+	. "github.com/smartystreets/goconvey/convey"
+	"testing"
+)
+
+// lifecyclePlugin notes down when it's started and closed.
+type lifecyclePlugin struct {
+	name   string
+	broken bool
+	events *[]string
+	ctx    context.Context
+}
+
+func (p *lifecyclePlugin) Start(ctx context.Context) error {
+	*p.events = append(*p.events, "start "+p.name)
+	p.ctx = ctx
+	if p.broken {
+		return fmt.Errorf("Broken.")
+	}
+	return nil
+}
+
+func (p *lifecyclePlugin) Close() error {
+	*p.events = append(*p.events, "close "+p.name)
+	return nil
+}
+
+func TestStart(t *testing.T) {
+	Convey("A plugin failing to start should close all plugins again", t, func() {
+		events := []string{}
+		first := &lifecyclePlugin{name: "first", events: &events}
+		ap := &apiplex{plugins: []pluginInstance{
+			{name: "first", plugin: first},
+			{name: "broken", plugin: &lifecyclePlugin{name: "broken", broken: true, events: &events}},
+			{name: "last", plugin: &lifecyclePlugin{name: "last", events: &events}},
+		}}
+		err := ap.start()
+		So(err, ShouldNotBeNil)
+		So(err.Error(), ShouldContainSubstring, "'broken'")
+		So(events, ShouldResemble, []string{"start first", "start broken", "close last", "close broken", "close first"})
+		So(first.ctx.Err(), ShouldNotBeNil)
+	})
+}
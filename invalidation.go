@@ -0,0 +1,104 @@
+package apiplexy
+
+import (
+	"context"
+	"encoding/json"
+	"github.com/garyburd/redigo/redis"
+	"log"
+	"time"
+)
+
+// keyChannel is where gateway nodes announce keys that have been changed or
+// deleted, as a JSON list of key IDs.
+const keyChannel = "auth_invalidate"
+
+// forgetKeys drops keys from the auth cache, so changes to them take effect
+// immediately instead of once the cache expires. All gateway nodes are told
+// about it, so they can drop their local copies too.
+func (ap *apiplex) forgetKeys(keyIDs ...string) {
+	if len(keyIDs) == 0 {
+		return
+	}
+	// don't wait for the announcement to come back to this node
+	ap.keyCache.forget(keyIDs)
+	rd := ap.redis.Get()
+	defer rd.Close()
+	args := make([]interface{}, len(keyIDs))
+	for i, id := range keyIDs {
+		args[i] = "auth_cache:" + id
+	}
+	if _, err := rd.Do("DEL", args...); err != nil {
+		log.Printf("Could not drop changed keys from the auth cache: %s\n", err.Error())
+	}
+	msg, _ := json.Marshal(keyIDs)
+	if _, err := rd.Do("PUBLISH", keyChannel, string(msg)); err != nil {
+		log.Printf("Could not announce changed keys: %s\n", err.Error())
+	}
+}
+
+// keysChanged passes announced key changes on to everything that keeps its
+// own copies of keys.
+func (ap *apiplex) keysChanged(keyIDs []string) {
+	ap.keyCache.forget(keyIDs)
+	for _, p := range ap.plugins {
+		if kw, ok := p.plugin.(KeyWatchingPlugin); ok {
+			kw.KeysChanged(keyIDs)
+		}
+	}
+}
+
+// watchKeys listens for key changes announced by any gateway node (this one
+// included), until ctx is done. If the connection to Redis is lost, it keeps
+// reconnecting.
+func (ap *apiplex) watchKeys(ctx context.Context) {
+	for {
+		if err := ap.receiveKeyChanges(ctx); err != nil {
+			log.Printf("Lost the subscription to key changes, reconnecting: %s\n", err.Error())
+		}
+		select {
+		case <-ctx.Done():
+			return
+		case <-time.After(time.Second):
+		}
+	}
+}
+
+func (ap *apiplex) receiveKeyChanges(ctx context.Context) error {
+	// subscribing blocks the connection, so it doesn't come from the pool
+	c, err := ap.redis.Dial()
+	if err != nil {
+		return err
+	}
+	defer c.Close()
+	psc := redis.PubSubConn{Conn: c}
+	if err := psc.Subscribe(keyChannel); err != nil {
+		return err
+	}
+	done := make(chan struct{})
+	defer close(done)
+	go func() {
+		select {
+		case <-ctx.Done():
+			psc.Unsubscribe()
+		case <-done:
+		}
+	}()
+	for {
+		switch v := psc.Receive().(type) {
+		case redis.Message:
+			var keyIDs []string
+			if err := json.Unmarshal(v.Data, &keyIDs); err == nil {
+				ap.keysChanged(keyIDs)
+			}
+		case redis.Subscription:
+			if v.Count == 0 {
+				return nil
+			}
+		case error:
+			if ctx.Err() != nil {
+				return nil
+			}
+			return v
+		}
+	}
+}
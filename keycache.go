@@ -0,0 +1,111 @@
+package apiplexy
+
+import (
+	"container/list"
+	"sync"
+	"time"
+)
+
+// keyCache is a small in-process cache in front of the auth cache in Redis.
+// It holds keys as JSON (unknown keys as null), just like Redis does, for a
+// short time, and drops the least recently used ones once it's full. Changes
+// announced on the key channel drop keys from it on every node.
+//
+// All methods can be called on a nil *keyCache (when the local cache is
+// disabled), in which case it never has anything.
+type keyCache struct {
+	mu      sync.Mutex
+	size    int
+	ttl     time.Duration
+	entries map[string]*list.Element
+	order   *list.List
+}
+
+type keyCacheEntry struct {
+	id      string
+	kjson   string
+	expires time.Time
+}
+
+func newKeyCache(size int, ttl time.Duration) *keyCache {
+	if size <= 0 {
+		return nil
+	}
+	return &keyCache{
+		size:    size,
+		ttl:     ttl,
+		entries: make(map[string]*list.Element),
+		order:   list.New(),
+	}
+}
+
+// get returns a cached key's JSON, if it's there and still fresh.
+func (c *keyCache) get(id string) (string, bool) {
+	if c == nil {
+		return "", false
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	el, ok := c.entries[id]
+	if !ok {
+		return "", false
+	}
+	entry := el.Value.(*keyCacheEntry)
+	if !time.Now().Before(entry.expires) {
+		c.order.Remove(el)
+		delete(c.entries, id)
+		return "", false
+	}
+	c.order.MoveToFront(el)
+	return entry.kjson, true
+}
+
+// set caches a key's JSON for ttl, but no longer than the cache's TTL. Keys
+// with a ttl of zero or less aren't cached at all.
+func (c *keyCache) set(id, kjson string, ttl time.Duration) {
+	if c == nil || ttl <= 0 {
+		return
+	}
+	if ttl > c.ttl {
+		ttl = c.ttl
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	expires := time.Now().Add(ttl)
+	if el, ok := c.entries[id]; ok {
+		entry := el.Value.(*keyCacheEntry)
+		entry.kjson, entry.expires = kjson, expires
+		c.order.MoveToFront(el)
+		return
+	}
+	c.entries[id] = c.order.PushFront(&keyCacheEntry{id: id, kjson: kjson, expires: expires})
+	for c.order.Len() > c.size {
+		oldest := c.order.Back()
+		c.order.Remove(oldest)
+		delete(c.entries, oldest.Value.(*keyCacheEntry).id)
+	}
+}
+
+// forget drops keys from the cache.
+func (c *keyCache) forget(ids []string) {
+	if c == nil {
+		return
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	for _, id := range ids {
+		if el, ok := c.entries[id]; ok {
+			c.order.Remove(el)
+			delete(c.entries, id)
+		}
+	}
+}
+
+func (c *keyCache) len() int {
+	if c == nil {
+		return 0
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.order.Len()
+}
@@ -0,0 +1,66 @@
+package apiplexy
+
+import (
+	. "github.com/smartystreets/goconvey/convey"
+	"testing"
+	"time"
+)
+
+func TestKeyCache(t *testing.T) {
+	Convey("The local key cache should keep recently used keys", t, func() {
+		c := newKeyCache(2, time.Minute)
+		c.set("a", `{"id":"a"}`, time.Minute)
+		c.set("b", `{"id":"b"}`, time.Minute)
+		kjson, ok := c.get("a")
+		So(ok, ShouldBeTrue)
+		So(kjson, ShouldEqual, `{"id":"a"}`)
+
+		// b is now the least recently used
+		c.set("c", "null", time.Minute)
+		So(c.len(), ShouldEqual, 2)
+		_, ok = c.get("b")
+		So(ok, ShouldBeFalse)
+		_, ok = c.get("a")
+		So(ok, ShouldBeTrue)
+		kjson, ok = c.get("c")
+		So(ok, ShouldBeTrue)
+		So(kjson, ShouldEqual, "null")
+	})
+
+	Convey("Cached keys should expire", t, func() {
+		c := newKeyCache(10, time.Minute)
+		c.set("short", "null", time.Millisecond)
+		c.set("long", "null", time.Hour)
+		time.Sleep(5 * time.Millisecond)
+		_, ok := c.get("short")
+		So(ok, ShouldBeFalse)
+		So(c.len(), ShouldEqual, 1)
+		// no longer than the cache's own TTL, though
+		So(c.entries["long"].Value.(*keyCacheEntry).expires, ShouldHappenBefore, time.Now().Add(time.Minute+time.Second))
+		// and not at all without a TTL
+		c.set("none", "null", 0)
+		_, ok = c.get("none")
+		So(ok, ShouldBeFalse)
+	})
+
+	Convey("Changed keys should be forgotten", t, func() {
+		c := newKeyCache(10, time.Minute)
+		c.set("a", "null", time.Minute)
+		c.set("b", "null", time.Minute)
+		c.forget([]string{"a", "unknown"})
+		_, ok := c.get("a")
+		So(ok, ShouldBeFalse)
+		_, ok = c.get("b")
+		So(ok, ShouldBeTrue)
+	})
+
+	Convey("A disabled cache should never have anything", t, func() {
+		var c *keyCache = newKeyCache(0, time.Minute)
+		So(c, ShouldBeNil)
+		c.set("a", "null", time.Minute)
+		_, ok := c.get("a")
+		So(ok, ShouldBeFalse)
+		c.forget([]string{"a"})
+		So(c.len(), ShouldEqual, 0)
+	})
+}
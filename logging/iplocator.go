@@ -1,6 +1,7 @@
 package logging
 
 import (
+	"context"
 	"fmt"
 	"net"
 	"net/http"
@@ -20,12 +21,13 @@ type concurrentMap struct {
 type IPLocatorPlugin struct {
 	pathToMmdbFile string         //Path to the GeoIP2 File-Database
 	ipCache        *concurrentMap //Caching of Locations to avoid slow fs access
+	db             *g.Reader      //Opened on Start, released on Close
 }
 
 //Log ..
 func (l *IPLocatorPlugin) Log(req *http.Request, res *http.Response, ctx *apiplexy.APIContext) error {
 
-	ip, _, _ := net.SplitHostPort(req.RemoteAddr)
+	ip := ctx.ClientIP
 	if l.ipCache != nil { //Try to use Ip Cache
 
 		l.ipCache.RLock()
@@ -56,14 +58,12 @@ func (l *IPLocatorPlugin) Log(req *http.Request, res *http.Response, ctx *apiple
 
 func (l *IPLocatorPlugin) retriveLocationFromFsDB(ip string, ctx *apiplexy.APIContext) error {
 
-	db, err := g.Open(l.pathToMmdbFile)
-	if err != nil {
-		return fmt.Errorf("GeoLite database not found")
+	if l.db == nil {
+		return fmt.Errorf("GeoLite database not opened")
 	}
-	defer db.Close()
 
 	netIP := net.ParseIP(ip)
-	city, err := db.City(netIP)
+	city, err := l.db.City(netIP)
 	if err != nil {
 		return fmt.Errorf("No record for IP:" + ip)
 	}
@@ -83,7 +83,7 @@ func (l *IPLocatorPlugin) DefaultConfig() map[string]interface{} {
 //Configure ...
 func (l *IPLocatorPlugin) Configure(config map[string]interface{}) error {
 	path := config["mmdb_path"].(string)
-	if strings.HasSuffix(path, ".mmdb") {
+	if !strings.HasSuffix(path, ".mmdb") {
 		return fmt.Errorf("'%s' is not a valid geo database", path)
 	}
 	l.pathToMmdbFile = path
@@ -93,6 +93,34 @@ func (l *IPLocatorPlugin) Configure(config map[string]interface{}) error {
 	return nil
 }
 
+//Start opens the GeoIP2 File-Database once for the plugin's lifetime
+func (l *IPLocatorPlugin) Start(ctx context.Context) error {
+	db, err := g.Open(l.pathToMmdbFile)
+	if err != nil {
+		return fmt.Errorf("GeoLite database not found at '%s'", l.pathToMmdbFile)
+	}
+	l.db = db
+	return nil
+}
+
+//Close releases the GeoIP2 File-Database
+func (l *IPLocatorPlugin) Close() error {
+	if l.db == nil {
+		return nil
+	}
+	err := l.db.Close()
+	l.db = nil
+	return err
+}
+
+//Health ..
+func (l *IPLocatorPlugin) Health() error {
+	if l.db == nil {
+		return fmt.Errorf("GeoLite database not opened")
+	}
+	return nil
+}
+
 func init() {
 	// _ = apiplexy.LoggingPlugin(&IPLocatorPlugin{})
 	apiplexy.RegisterPlugin(
@@ -0,0 +1,227 @@
+package apiplexy
+
+import (
+	"github.com/garyburd/redigo/redis"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/collectors"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
+	"net/http"
+	"strconv"
+	"time"
+)
+
+// apiplexMetrics collects Prometheus metrics for one apiplex. Every apiplex
+// gets its own registry, so a reload starts from fresh counters.
+//
+// All methods can be called on a nil *apiplexMetrics (when metrics are
+// disabled), in which case they do nothing.
+type apiplexMetrics struct {
+	registry        *prometheus.Registry
+	routes          []string
+	keyLabels       bool
+	requests        *prometheus.CounterVec
+	duration        *prometheus.HistogramVec
+	authFailures    *prometheus.CounterVec
+	authCache       *prometheus.CounterVec
+	lockouts        prometheus.Counter
+	quotaRejections *prometheus.CounterVec
+	pluginDuration  *prometheus.HistogramVec
+	upstreamUp      *prometheus.GaugeVec
+	upstreamErrors  *prometheus.CounterVec
+}
+
+func newMetrics(config apiplexConfigMetrics, pool *redis.Pool, keys *keyCache) (*apiplexMetrics, error) {
+	for _, route := range config.Routes {
+		if err := ValidatePathPattern(route); err != nil {
+			return nil, err
+		}
+	}
+	requestLabels := []string{"route", "method", "status", "upstream"}
+	if config.KeyLabels {
+		requestLabels = append(requestLabels, "key")
+	}
+	m := &apiplexMetrics{
+		registry:  prometheus.NewRegistry(),
+		routes:    config.Routes,
+		keyLabels: config.KeyLabels,
+		requests: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Namespace: "apiplexy",
+			Name:      "requests_total",
+			Help:      "API requests handled, by route, method, status and upstream.",
+		}, requestLabels),
+		duration: prometheus.NewHistogramVec(prometheus.HistogramOpts{
+			Namespace: "apiplexy",
+			Name:      "request_duration_seconds",
+			Help:      "Time taken to handle API requests, including the upstream.",
+			Buckets:   prometheus.DefBuckets,
+		}, requestLabels),
+		authFailures: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Namespace: "apiplexy",
+			Name:      "auth_failures_total",
+			Help:      "Requests denied during authentication, by reason.",
+		}, []string{"reason"}),
+		authCache: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Namespace: "apiplexy",
+			Name:      "auth_cache_lookups_total",
+			Help:      "Auth cache lookups for detected keys, by cache tier (local, redis or resolve) and result (hit or miss).",
+		}, []string{"tier", "result"}),
+		lockouts: prometheus.NewCounter(prometheus.CounterOpts{
+			Namespace: "apiplexy",
+			Name:      "auth_lockouts_total",
+			Help:      "Client IPs locked out after too many failed authentication attempts.",
+		}),
+		quotaRejections: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Namespace: "apiplexy",
+			Name:      "quota_rejections_total",
+			Help:      "Requests rejected for exceeding a quota, by quota name and limit (ip or key).",
+		}, []string{"quota", "limit"}),
+		pluginDuration: prometheus.NewHistogramVec(prometheus.HistogramOpts{
+			Namespace: "apiplexy",
+			Name:      "plugin_duration_seconds",
+			Help:      "Time spent in request-stage plugins, by plugin.",
+			Buckets:   []float64{.0001, .0005, .001, .005, .01, .05, .1, .5, 1},
+		}, []string{"plugin"}),
+		upstreamUp: prometheus.NewGaugeVec(prometheus.GaugeOpts{
+			Namespace: "apiplexy",
+			Name:      "upstream_up",
+			Help:      "Whether the last request to an upstream got a response (1) or failed (0).",
+		}, []string{"upstream"}),
+		upstreamErrors: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Namespace: "apiplexy",
+			Name:      "upstream_errors_total",
+			Help:      "Requests to an upstream that failed without a response.",
+		}, []string{"upstream"}),
+	}
+	m.registry.MustRegister(
+		m.requests, m.duration, m.authFailures, m.authCache, m.lockouts, m.quotaRejections,
+		m.pluginDuration, m.upstreamUp, m.upstreamErrors,
+		prometheus.NewGaugeFunc(prometheus.GaugeOpts{
+			Namespace: "apiplexy",
+			Name:      "redis_pool_active_connections",
+			Help:      "Connections in the Redis pool, in use or idle.",
+		}, func() float64 { return float64(pool.ActiveCount()) }),
+		prometheus.NewGaugeFunc(prometheus.GaugeOpts{
+			Namespace: "apiplexy",
+			Name:      "redis_pool_idle_connections",
+			Help:      "Idle connections in the Redis pool.",
+		}, func() float64 { return float64(pool.IdleCount()) }),
+		prometheus.NewGaugeFunc(prometheus.GaugeOpts{
+			Namespace: "apiplexy",
+			Name:      "auth_local_cache_keys",
+			Help:      "Keys held in this node's local auth cache.",
+		}, func() float64 { return float64(keys.len()) }),
+		collectors.NewGoCollector(),
+		collectors.NewProcessCollector(collectors.ProcessCollectorOpts{}),
+	)
+	return m, nil
+}
+
+func (m *apiplexMetrics) handler() http.Handler {
+	return promhttp.HandlerFor(m.registry, promhttp.HandlerOpts{})
+}
+
+// route maps a request path to the first configured route pattern it matches.
+// Raw paths are never used as labels, so they can't blow up the number of
+// time series.
+func (m *apiplexMetrics) route(p string) string {
+	for _, route := range m.routes {
+		if MatchPath(route, p) {
+			return route
+		}
+	}
+	return "other"
+}
+
+func upstreamLabel(us *APIUpstream) string {
+	if us == nil {
+		return "none"
+	}
+	return us.Address.Host
+}
+
+func (m *apiplexMetrics) observeRequest(req *http.Request, ctx *APIContext, status int, elapsed time.Duration) {
+	if m == nil {
+		return
+	}
+	labels := prometheus.Labels{
+		"route":    m.route(ctx.Path),
+		"method":   req.Method,
+		"status":   strconv.Itoa(status),
+		"upstream": upstreamLabel(ctx.Upstream),
+	}
+	if m.keyLabels {
+		switch {
+		case ctx.Key != nil:
+			labels["key"] = ctx.Key.ID
+		case ctx.Keyless:
+			labels["key"] = "keyless"
+		default:
+			labels["key"] = "none"
+		}
+	}
+	m.requests.With(labels).Inc()
+	m.duration.With(labels).Observe(elapsed.Seconds())
+}
+
+func (m *apiplexMetrics) authFailure(reason string) {
+	if m == nil {
+		return
+	}
+	m.authFailures.WithLabelValues(reason).Inc()
+}
+
+func (m *apiplexMetrics) authCacheLookup(tier string, hit bool) {
+	if m == nil {
+		return
+	}
+	if hit {
+		m.authCache.WithLabelValues(tier, "hit").Inc()
+	} else {
+		m.authCache.WithLabelValues(tier, "miss").Inc()
+	}
+}
+
+func (m *apiplexMetrics) lockout() {
+	if m == nil {
+		return
+	}
+	m.lockouts.Inc()
+}
+
+func (m *apiplexMetrics) quotaRejected(quota string, limit string) {
+	if m == nil {
+		return
+	}
+	m.quotaRejections.WithLabelValues(quota, limit).Inc()
+}
+
+func (m *apiplexMetrics) observePlugin(name string, elapsed time.Duration) {
+	if m == nil {
+		return
+	}
+	m.pluginDuration.WithLabelValues(name).Observe(elapsed.Seconds())
+}
+
+func (m *apiplexMetrics) upstreamResult(us *APIUpstream, err error) {
+	if m == nil {
+		return
+	}
+	label := upstreamLabel(us)
+	if err != nil {
+		m.upstreamUp.WithLabelValues(label).Set(0)
+		m.upstreamErrors.WithLabelValues(label).Inc()
+	} else {
+		m.upstreamUp.WithLabelValues(label).Set(1)
+	}
+}
+
+// statusWriter remembers the status code written to a response.
+type statusWriter struct {
+	http.ResponseWriter
+	status int
+}
+
+func (w *statusWriter) WriteHeader(status int) {
+	w.status = status
+	w.ResponseWriter.WriteHeader(status)
+}
@@ -0,0 +1,152 @@
+package apiplexy
+
+import (
+	"fmt"
+	"net"
+	"net/http"
+	"strings"
+	"sync"
+)
+
+// maxKeyNets is how many parsed key networks are kept at most.
+const maxKeyNets = 10000
+
+// apiplexNetwork works out where requests come from, and keeps clients out
+// that aren't allowed in: anyone on the gateway-wide deny list, and anyone
+// outside of the ranges a key is limited to.
+type apiplexNetwork struct {
+	trusted []*net.IPNet
+	deny    []*net.IPNet
+	mu      sync.Mutex
+	// keys' networks as parsed before, by entry (nil if they can't be parsed)
+	keyNets map[string]*net.IPNet
+}
+
+func newNetwork(config apiplexConfigNetwork) (*apiplexNetwork, error) {
+	trusted, err := parseCIDRs(config.TrustedProxies)
+	if err != nil {
+		return nil, err
+	}
+	deny, err := parseCIDRs(config.Deny)
+	if err != nil {
+		return nil, err
+	}
+	return &apiplexNetwork{trusted: trusted, deny: deny, keyNets: make(map[string]*net.IPNet)}, nil
+}
+
+// parseCIDRs parses a list of networks in CIDR notation. Plain IP addresses
+// are taken as networks of one.
+func parseCIDRs(entries []string) ([]*net.IPNet, error) {
+	nets := make([]*net.IPNet, 0, len(entries))
+	for _, e := range entries {
+		e = strings.TrimSpace(e)
+		if !strings.Contains(e, "/") {
+			ip := net.ParseIP(e)
+			if ip == nil {
+				return nil, fmt.Errorf("'%s' is neither an IP address nor a network in CIDR notation.", e)
+			}
+			bits := 8 * net.IPv6len
+			if ip.To4() != nil {
+				ip, bits = ip.To4(), 8*net.IPv4len
+			}
+			nets = append(nets, &net.IPNet{IP: ip, Mask: net.CIDRMask(bits, bits)})
+			continue
+		}
+		_, n, err := net.ParseCIDR(e)
+		if err != nil {
+			return nil, fmt.Errorf("'%s' is neither an IP address nor a network in CIDR notation.", e)
+		}
+		nets = append(nets, n)
+	}
+	return nets, nil
+}
+
+// checkCIDRs tells whether a list of networks can be parsed.
+func checkCIDRs(entries []string) error {
+	_, err := parseCIDRs(entries)
+	return err
+}
+
+func containsIP(nets []*net.IPNet, ip net.IP) bool {
+	for _, n := range nets {
+		if n.Contains(ip) {
+			return true
+		}
+	}
+	return false
+}
+
+// clientIP returns the address of the client a request comes from. Requests
+// from trusted proxies are followed back through their X-Forwarded-For
+// header, up to the first address that isn't a trusted proxy itself.
+func (n *apiplexNetwork) clientIP(req *http.Request) string {
+	clientIP, _, err := net.SplitHostPort(req.RemoteAddr)
+	if err != nil {
+		clientIP = req.RemoteAddr
+	}
+	if len(n.trusted) == 0 {
+		return clientIP
+	}
+	hops := []string{}
+	for _, h := range req.Header["X-Forwarded-For"] {
+		hops = append(hops, strings.Split(h, ",")...)
+	}
+	for i := len(hops) - 1; i >= 0; i-- {
+		ip := net.ParseIP(clientIP)
+		if ip == nil || !containsIP(n.trusted, ip) {
+			break
+		}
+		clientIP = strings.TrimSpace(hops[i])
+	}
+	return clientIP
+}
+
+// denied tells whether a client is on the gateway-wide deny list.
+func (n *apiplexNetwork) denied(clientIP string) bool {
+	ip := net.ParseIP(clientIP)
+	return ip != nil && containsIP(n.deny, ip)
+}
+
+// check makes sure that a key may be used from the client's address: not from
+// its denied networks, and only from its allowed networks (if it has any).
+func (n *apiplexNetwork) check(clientIP string, key *Key) error {
+	if len(key.AllowIPs) == 0 && len(key.DenyIPs) == 0 {
+		return nil
+	}
+	ip := net.ParseIP(clientIP)
+	if ip != nil && !n.matchesAny(key.DenyIPs, ip) && (len(key.AllowIPs) == 0 || n.matchesAny(key.AllowIPs, ip)) {
+		return nil
+	}
+	return Abort(403, fmt.Sprintf("Access denied. This key may not be used from %s.", clientIP))
+}
+
+// matchesAny checks an address against a key's networks. Entries that can't
+// be parsed (e.g. edited straight in the backend) never match.
+func (n *apiplexNetwork) matchesAny(entries []string, ip net.IP) bool {
+	for _, e := range entries {
+		if ipnet := n.keyNet(e); ipnet != nil && ipnet.Contains(ip) {
+			return true
+		}
+	}
+	return false
+}
+
+// keyNet parses one of a key's networks, once. Keys come from the caches as
+// JSON on every request, so their parsed networks are kept here instead, up
+// to maxKeyNets of them.
+func (n *apiplexNetwork) keyNet(entry string) *net.IPNet {
+	n.mu.Lock()
+	defer n.mu.Unlock()
+	if ipnet, ok := n.keyNets[entry]; ok {
+		return ipnet
+	}
+	var ipnet *net.IPNet
+	if nets, err := parseCIDRs([]string{entry}); err == nil {
+		ipnet = nets[0]
+	}
+	if len(n.keyNets) >= maxKeyNets {
+		n.keyNets = make(map[string]*net.IPNet)
+	}
+	n.keyNets[entry] = ipnet
+	return ipnet
+}
@@ -0,0 +1,75 @@
+package apiplexy
+
+import (
+	. "github.com/smartystreets/goconvey/convey"
+	"net/http"
+	"testing"
+)
+
+func TestNetwork(t *testing.T) {
+	network, err := newNetwork(apiplexConfigNetwork{
+		TrustedProxies: []string{"10.0.0.0/8", "fd00::1"},
+		Deny:           []string{"203.0.113.0/24"},
+	})
+
+	from := func(remoteAddr string, forwardedFor ...string) *http.Request {
+		req, _ := http.NewRequest("GET", "http://api.example.com/things", nil)
+		req.RemoteAddr = remoteAddr
+		for _, f := range forwardedFor {
+			req.Header.Add("X-Forwarded-For", f)
+		}
+		return req
+	}
+
+	Convey("Networks should be parsed from CIDR notation or single addresses", t, func() {
+		So(err, ShouldBeNil)
+		nets, err := parseCIDRs([]string{"198.51.100.0/24", " 192.0.2.1 ", "2001:db8::/32", "2001:db8::1"})
+		So(err, ShouldBeNil)
+		So(nets, ShouldHaveLength, 4)
+		So(nets[1].String(), ShouldEqual, "192.0.2.1/32")
+		So(nets[3].String(), ShouldEqual, "2001:db8::1/128")
+
+		So(checkCIDRs([]string{"198.51.100.0/33"}), ShouldNotBeNil)
+		So(checkCIDRs([]string{"example.com"}), ShouldNotBeNil)
+		_, err = newNetwork(apiplexConfigNetwork{Deny: []string{"nonsense"}})
+		So(err, ShouldNotBeNil)
+	})
+
+	Convey("Clients should be found behind trusted proxies only", t, func() {
+		So(network.clientIP(from("198.51.100.1:1234")), ShouldEqual, "198.51.100.1")
+		So(network.clientIP(from("198.51.100.1:1234", "192.0.2.1")), ShouldEqual, "198.51.100.1")
+		So(network.clientIP(from("10.1.2.3:1234", "192.0.2.1")), ShouldEqual, "192.0.2.1")
+		So(network.clientIP(from("10.1.2.3:1234", "192.0.2.1, 10.4.5.6")), ShouldEqual, "192.0.2.1")
+		So(network.clientIP(from("10.1.2.3:1234", "192.0.2.1", "10.4.5.6")), ShouldEqual, "192.0.2.1")
+		So(network.clientIP(from("[fd00::1]:1234", "2001:db8::7")), ShouldEqual, "2001:db8::7")
+
+		// clients can claim to be anyone, but only the last untrusted hop counts
+		So(network.clientIP(from("10.1.2.3:1234", "10.9.9.9, 192.0.2.1")), ShouldEqual, "192.0.2.1")
+		// a proxy that forwards for nobody is the client
+		So(network.clientIP(from("10.1.2.3:1234")), ShouldEqual, "10.1.2.3")
+	})
+
+	Convey("Clients on the deny list should be recognized", t, func() {
+		So(network.denied("203.0.113.9"), ShouldBeTrue)
+		So(network.denied("198.51.100.1"), ShouldBeFalse)
+		So(network.denied("not-an-ip"), ShouldBeFalse)
+	})
+
+	Convey("Keys should only be used from their allowed networks", t, func() {
+		key := &Key{ID: "k", AllowIPs: []string{"198.51.100.0/24", "2001:db8::/32"}, DenyIPs: []string{"198.51.100.7"}}
+		So(network.check("198.51.100.1", key), ShouldBeNil)
+		So(network.check("2001:db8::1", key), ShouldBeNil)
+		So(network.check("198.51.100.7", key), ShouldResemble, Abort(403, "Access denied. This key may not be used from 198.51.100.7."))
+		So(network.check("192.0.2.1", key), ShouldNotBeNil)
+		So(network.check("", key), ShouldNotBeNil)
+
+		So(network.check("192.0.2.1", &Key{ID: "k"}), ShouldBeNil)
+		So(network.check("198.51.100.1", &Key{ID: "k", DenyIPs: []string{"198.51.100.0/24"}}), ShouldNotBeNil)
+		So(network.check("192.0.2.1", &Key{ID: "k", DenyIPs: []string{"198.51.100.0/24"}}), ShouldBeNil)
+		// broken entries never match
+		So(network.check("192.0.2.1", &Key{ID: "k", AllowIPs: []string{"nonsense"}}), ShouldNotBeNil)
+		// and are only parsed once
+		So(network.keyNets, ShouldContainKey, "198.51.100.0/24")
+		So(network.keyNets["nonsense"], ShouldBeNil)
+	})
+}
@@ -0,0 +1,201 @@
+package apiplexy
+
+import (
+	"encoding/json"
+	"fmt"
+	"github.com/dgrijalva/jwt-go"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+)
+
+// apiplexTokenEndpoint is an OAuth2 token endpoint (RFC 6749) for the client
+// credentials grant: clients send a key's ID and secret, and get a short-lived
+// access token in return that carries the key's quota, realm, networks and
+// scopes (or just the scopes they asked for).
+type apiplexTokenEndpoint struct {
+	ap         *apiplex
+	signingKey []byte
+	issuer     string
+	lifetime   time.Duration
+}
+
+type tokenResponse struct {
+	AccessToken string `json:"access_token"`
+	TokenType   string `json:"token_type"`
+	ExpiresIn   int    `json:"expires_in"`
+	Scope       string `json:"scope,omitempty"`
+}
+
+type tokenError struct {
+	Error       string `json:"error"`
+	Description string `json:"error_description,omitempty"`
+}
+
+func newTokenEndpoint(config apiplexConfigOAuth2, ap *apiplex) (*apiplexTokenEndpoint, error) {
+	if len(config.SigningKey) < 32 {
+		return nil, fmt.Errorf("The OAuth2 signing key must be at least 32 characters long.")
+	}
+	t := apiplexTokenEndpoint{
+		ap:         ap,
+		signingKey: []byte(config.SigningKey),
+		issuer:     config.Issuer,
+		lifetime:   config.Lifetime,
+	}
+	if t.issuer == "" {
+		t.issuer = "apiplexy"
+	}
+	if t.lifetime <= 0 {
+		t.lifetime = time.Hour
+	}
+	return &t, nil
+}
+
+func writeTokenResponse(res http.ResponseWriter, status int, body interface{}) {
+	res.Header().Set("Content-Type", "application/json;charset=utf-8")
+	res.Header().Set("Cache-Control", "no-store")
+	res.Header().Set("Pragma", "no-cache")
+	if status == http.StatusUnauthorized {
+		res.Header().Set("WWW-Authenticate", `Basic realm="apiplexy"`)
+	}
+	res.WriteHeader(status)
+	json.NewEncoder(res).Encode(body)
+}
+
+// clientCredentials returns the client's ID and secret, from HTTP Basic auth
+// or (less preferably) the request body.
+func clientCredentials(req *http.Request) (string, string) {
+	if id, secret, ok := req.BasicAuth(); ok {
+		// both are form-encoded before they go into the header
+		uid, err1 := url.QueryUnescape(id)
+		usecret, err2 := url.QueryUnescape(secret)
+		if err1 == nil && err2 == nil {
+			return uid, usecret
+		}
+		return id, secret
+	}
+	return req.PostFormValue("client_id"), req.PostFormValue("client_secret")
+}
+
+// findClient looks up a key by its ID in all key types of all auth plugins
+// that can verify secrets, and returns it if the secret matches.
+func (t *apiplexTokenEndpoint) findClient(id, secret string) (*Key, error) {
+	for _, auth := range t.ap.auth {
+		verifier, ok := auth.(SecretVerifyingAuthPlugin)
+		if !ok {
+			continue
+		}
+		for _, kt := range auth.AvailableTypes() {
+			key, err := t.ap.findKey(id, kt.Name)
+			if err != nil {
+				return nil, err
+			}
+			if key != nil {
+				if verifier.VerifySecret(key, secret) {
+					return key, nil
+				}
+				return nil, nil
+			}
+		}
+	}
+	return nil, nil
+}
+
+func (t *apiplexTokenEndpoint) HandleToken(res http.ResponseWriter, req *http.Request) {
+	if req.Method != "POST" {
+		res.Header().Set("Allow", "POST")
+		writeTokenResponse(res, http.StatusMethodNotAllowed, &tokenError{Error: "invalid_request", Description: "Request tokens with a POST."})
+		return
+	}
+	if req.PostFormValue("grant_type") != "client_credentials" {
+		writeTokenResponse(res, http.StatusBadRequest, &tokenError{Error: "unsupported_grant_type", Description: "Only the client_credentials grant is supported."})
+		return
+	}
+	id, secret := clientCredentials(req)
+	if id == "" || secret == "" {
+		writeTokenResponse(res, http.StatusUnauthorized, &tokenError{Error: "invalid_client", Description: "Authenticate with your key's ID and secret."})
+		return
+	}
+	// the same protections as for API requests apply
+	rd := t.ap.redis.Get()
+	defer rd.Close()
+	clientIP := t.ap.network.clientIP(req)
+	if t.ap.lockedOut(rd, clientIP) {
+		t.ap.metrics.authFailure("locked_out")
+		writeTokenResponse(res, http.StatusTooManyRequests, &tokenError{Error: "invalid_client", Description: errLockedOut.Error()})
+		return
+	}
+	key, err := t.findClient(id, secret)
+	if err == errBackendBusy {
+		t.ap.metrics.authFailure("backend_busy")
+		writeTokenResponse(res, http.StatusServiceUnavailable, &tokenError{Error: "temporarily_unavailable", Description: err.Error()})
+		return
+	}
+	if err != nil {
+		t.ap.metrics.authFailure("error")
+		writeTokenResponse(res, http.StatusInternalServerError, &tokenError{Error: "server_error", Description: err.Error()})
+		return
+	}
+	if key == nil {
+		t.ap.metrics.authFailure("invalid")
+		t.ap.failedAuth(rd, clientIP)
+		writeTokenResponse(res, http.StatusUnauthorized, &tokenError{Error: "invalid_client", Description: "Unknown key, or wrong secret."})
+		return
+	}
+	now := time.Now()
+	if key.Expired(now) {
+		t.ap.metrics.authFailure("expired")
+		writeTokenResponse(res, http.StatusUnauthorized, &tokenError{Error: "invalid_client", Description: fmt.Sprintf("This key expired on %s.", key.ExpiresAt.UTC().Format(time.RFC1123))})
+		return
+	}
+	// clients may ask for fewer scopes than their key has
+	scopes := key.Scopes
+	if requested := strings.Fields(req.PostFormValue("scope")); len(requested) > 0 {
+		for _, scope := range requested {
+			if !key.HasScope(scope) {
+				writeTokenResponse(res, http.StatusBadRequest, &tokenError{Error: "invalid_scope", Description: fmt.Sprintf("Your key lacks the scope '%s'.", scope)})
+				return
+			}
+		}
+		scopes = requested
+	}
+
+	// tokens don't outlive their key
+	expires := now.Add(t.lifetime)
+	if key.ExpiresAt != nil && key.ExpiresAt.Before(expires) {
+		expires = *key.ExpiresAt
+	}
+	token := jwt.New(jwt.SigningMethodHS256)
+	token.Claims["iss"] = t.issuer
+	token.Claims["sub"] = key.ID
+	token.Claims["iat"] = now.Unix()
+	token.Claims["exp"] = expires.Unix()
+	token.Claims["key_type"] = key.Type
+	if key.Quota != "" {
+		token.Claims["quota"] = key.Quota
+	}
+	if key.Realm != "" {
+		token.Claims["realm"] = key.Realm
+	}
+	if len(scopes) > 0 {
+		token.Claims["scope"] = strings.Join(scopes, " ")
+	}
+	if len(key.AllowIPs) > 0 {
+		token.Claims["allow_ips"] = strings.Join(key.AllowIPs, " ")
+	}
+	if len(key.DenyIPs) > 0 {
+		token.Claims["deny_ips"] = strings.Join(key.DenyIPs, " ")
+	}
+	ts, err := token.SignedString(t.signingKey)
+	if err != nil {
+		writeTokenResponse(res, http.StatusInternalServerError, &tokenError{Error: "server_error", Description: err.Error()})
+		return
+	}
+	writeTokenResponse(res, http.StatusOK, &tokenResponse{
+		AccessToken: ts,
+		TokenType:   "Bearer",
+		ExpiresIn:   int(expires.Sub(now) / time.Second),
+		Scope:       strings.Join(scopes, " "),
+	})
+}
@@ -0,0 +1,152 @@
+package openapi
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"github.com/12foo/apiplexy"
+	"github.com/getkin/kin-openapi/openapi3"
+	"github.com/getkin/kin-openapi/openapi3filter"
+	"github.com/getkin/kin-openapi/routers"
+	"github.com/getkin/kin-openapi/routers/gorillamux"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"strings"
+)
+
+type openapiConfig struct {
+	Spec              string `config:"spec" required:"true"`
+	ValidateBody      bool   `config:"validate_body" default:"true"`
+	AllowUnknownPaths bool   `config:"allow_unknown_paths" default:"false"`
+}
+
+// OpenAPIPlugin validates requests against an OpenAPI 3 spec before any quota
+// is charged. Requests with an unknown path or method, invalid parameters or
+// a JSON body not matching the operation's schema are rejected with a 400 and
+// a message describing the problem. The matched operation's ID is logged as
+// "operation_id".
+//
+// Paths in the spec are relative to the API path (apiplexy's serve.api), so
+// the spec's own servers are ignored.
+type OpenAPIPlugin struct {
+	config  *openapiConfig
+	router  routers.Router
+	options *openapi3filter.Options
+}
+
+func loadSpec(spec string) (*openapi3.T, error) {
+	loader := openapi3.NewLoader()
+	loader.IsExternalRefsAllowed = true
+	if strings.HasPrefix(spec, "http://") || strings.HasPrefix(spec, "https://") {
+		u, err := url.Parse(spec)
+		if err != nil {
+			return nil, err
+		}
+		return loader.LoadFromURI(u)
+	}
+	return loader.LoadFromFile(spec)
+}
+
+func (p *OpenAPIPlugin) PostAuth(req *http.Request, ctx *apiplexy.APIContext) error {
+	// validate a copy of the request with its path relative to the API, so
+	// the spec's paths match
+	vreq := new(http.Request)
+	*vreq = *req
+	u := *req.URL
+	u.Path = ctx.Path
+	u.RawPath = ""
+	vreq.URL = &u
+
+	route, params, err := p.router.FindRoute(vreq)
+	switch err {
+	case nil:
+	case routers.ErrPathNotFound:
+		if p.config.AllowUnknownPaths {
+			return nil
+		}
+		return apiplexy.Abort(400, fmt.Sprintf("Unknown API path: %s", ctx.Path))
+	case routers.ErrMethodNotAllowed:
+		return apiplexy.Abort(400, fmt.Sprintf("Method %s is not allowed on %s.", req.Method, ctx.Path))
+	default:
+		return err
+	}
+	if route.Operation.OperationID != "" {
+		ctx.Log["operation_id"] = route.Operation.OperationID
+	}
+
+	// the validator consumes the body; both requests get their own copy
+	if p.config.ValidateBody && req.Body != nil && req.Body != http.NoBody {
+		b, err := ioutil.ReadAll(req.Body)
+		req.Body.Close()
+		if err != nil {
+			return err
+		}
+		req.Body = ioutil.NopCloser(bytes.NewReader(b))
+		vreq.Body = ioutil.NopCloser(bytes.NewReader(b))
+		vreq.GetBody = nil
+	}
+
+	input := &openapi3filter.RequestValidationInput{
+		Request:    vreq,
+		PathParams: params,
+		Route:      route,
+		Options:    p.options,
+	}
+	if err := openapi3filter.ValidateRequest(context.Background(), input); err != nil {
+		return apiplexy.Abort(400, fmt.Sprintf("Invalid request: %s", err.Error()))
+	}
+	return nil
+}
+
+func (p *OpenAPIPlugin) ConfigStruct() interface{} {
+	return &openapiConfig{}
+}
+
+func (p *OpenAPIPlugin) ConfigureTyped(config interface{}) error {
+	c := config.(*openapiConfig)
+	doc, err := loadSpec(c.Spec)
+	if err != nil {
+		return fmt.Errorf("Couldn't load OpenAPI spec %s: %s", c.Spec, err.Error())
+	}
+	if err := doc.Validate(context.Background()); err != nil {
+		return fmt.Errorf("OpenAPI spec %s is invalid: %s", c.Spec, err.Error())
+	}
+	doc.Servers = nil
+	for _, item := range doc.Paths {
+		item.Servers = nil
+	}
+	router, err := gorillamux.NewRouter(doc)
+	if err != nil {
+		return fmt.Errorf("Couldn't route OpenAPI spec %s: %s", c.Spec, err.Error())
+	}
+	p.config = c
+	p.router = router
+	p.options = &openapi3filter.Options{
+		ExcludeRequestBody: !c.ValidateBody,
+		// apiplexy has already authenticated the request
+		AuthenticationFunc:  openapi3filter.NoopAuthenticationFunc,
+		SkipSettingDefaults: true,
+	}
+	return nil
+}
+
+func (p *OpenAPIPlugin) DefaultConfig() map[string]interface{} {
+	d := apiplexy.TypedDefaultConfig(p)
+	d["spec"] = "/path/to/openapi.yaml"
+	return d
+}
+
+func (p *OpenAPIPlugin) Configure(config map[string]interface{}) error {
+	return apiplexy.TypedConfigure(p, config)
+}
+
+func init() {
+	// _ = apiplexy.PostAuthPlugin(&OpenAPIPlugin{})
+	apiplexy.RegisterPlugin(
+		"openapi",
+		"Reject requests that don't match your OpenAPI 3 spec.",
+		"https://github.com/12foo/apiplexy/tree/master/openapi",
+		OpenAPIPlugin{},
+	)
+}
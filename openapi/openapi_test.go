@@ -0,0 +1,156 @@
+package openapi
+
+import (
+	"github.com/12foo/apiplexy"
+	. "github.com/smartystreets/goconvey/convey"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+const testSpec = `
+openapi: 3.0.0
+info:
+  title: Items
+  version: "1.0"
+servers:
+- url: https://api.example.com/v1
+paths:
+  /items:
+    get:
+      operationId: listItems
+      parameters:
+      - name: limit
+        in: query
+        schema:
+          type: integer
+          maximum: 100
+      responses:
+        "200":
+          description: OK
+    post:
+      operationId: createItem
+      requestBody:
+        required: true
+        content:
+          application/json:
+            schema:
+              type: object
+              required: [name]
+              properties:
+                name:
+                  type: string
+      responses:
+        "201":
+          description: Created
+  /items/{id}:
+    get:
+      operationId: getItem
+      parameters:
+      - name: id
+        in: path
+        required: true
+        schema:
+          type: integer
+      responses:
+        "200":
+          description: OK
+`
+
+func testPlugin(t *testing.T, extra map[string]interface{}) *OpenAPIPlugin {
+	dir, err := ioutil.TempDir("", "apiplexy-openapi")
+	if err != nil {
+		t.Fatal(err)
+	}
+	spec := filepath.Join(dir, "openapi.yaml")
+	if err := ioutil.WriteFile(spec, []byte(testSpec), 0644); err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	config := map[string]interface{}{"spec": spec}
+	for k, v := range extra {
+		config[k] = v
+	}
+	p := &OpenAPIPlugin{}
+	if err := p.Configure(config); err != nil {
+		t.Fatal(err)
+	}
+	return p
+}
+
+func check(p *OpenAPIPlugin, method, path, body string) (*apiplexy.APIContext, *http.Request, error) {
+	req, _ := http.NewRequest(method, "http://dummy-request.com/api"+path, strings.NewReader(body))
+	if body != "" {
+		req.Header.Set("Content-Type", "application/json")
+	}
+	ctx := &apiplexy.APIContext{Path: strings.SplitN(path, "?", 2)[0], Log: map[string]interface{}{}}
+	err := p.PostAuth(req, ctx)
+	return ctx, req, err
+}
+
+func TestConfigure(t *testing.T) {
+	Convey("Plugin should not panic when configuring with default configuration", t, func() {
+		So(func() {
+			tplugin := apiplexy.PostAuthPlugin(&OpenAPIPlugin{})
+			_ = tplugin.Configure(tplugin.DefaultConfig())
+		}, ShouldNotPanic)
+	})
+}
+
+func TestValidation(t *testing.T) {
+	p := testPlugin(t, nil)
+
+	Convey("Matching requests should pass and log their operation ID", t, func() {
+		ctx, _, err := check(p, "GET", "/items?limit=10", "")
+		So(err, ShouldBeNil)
+		So(ctx.Log["operation_id"], ShouldEqual, "listItems")
+
+		ctx, _, err = check(p, "GET", "/items/42", "")
+		So(err, ShouldBeNil)
+		So(ctx.Log["operation_id"], ShouldEqual, "getItem")
+	})
+
+	Convey("Unknown paths and methods should be rejected", t, func() {
+		_, _, err := check(p, "GET", "/users", "")
+		So(err, ShouldHaveSameTypeAs, apiplexy.AbortRequest{})
+		So(err.(apiplexy.AbortRequest).Status, ShouldEqual, 400)
+
+		_, _, err = check(p, "DELETE", "/items", "")
+		So(err, ShouldNotBeNil)
+		So(err.Error(), ShouldContainSubstring, "not allowed")
+	})
+
+	Convey("Invalid parameters should be rejected", t, func() {
+		_, _, err := check(p, "GET", "/items?limit=1000", "")
+		So(err, ShouldNotBeNil)
+		So(err.Error(), ShouldContainSubstring, "limit")
+
+		_, _, err = check(p, "GET", "/items/abc", "")
+		So(err, ShouldNotBeNil)
+	})
+
+	Convey("JSON bodies should be validated and remain readable", t, func() {
+		_, _, err := check(p, "POST", "/items", `{"color": "red"}`)
+		So(err, ShouldNotBeNil)
+		So(err.Error(), ShouldContainSubstring, "name")
+
+		_, req, err := check(p, "POST", "/items", `{"name": "hat"}`)
+		So(err, ShouldBeNil)
+		b, _ := ioutil.ReadAll(req.Body)
+		So(string(b), ShouldEqual, `{"name": "hat"}`)
+	})
+}
+
+func TestUnknownPaths(t *testing.T) {
+	p := testPlugin(t, map[string]interface{}{"allow_unknown_paths": true})
+
+	Convey("With allow_unknown_paths, paths outside the spec should pass", t, func() {
+		_, _, err := check(p, "GET", "/users", "")
+		So(err, ShouldBeNil)
+		_, _, err = check(p, "GET", "/items?limit=1000", "")
+		So(err, ShouldNotBeNil)
+	})
+}
@@ -163,6 +163,10 @@ func (p *portalAPI) getKeyTypes(email string, res http.ResponseWriter, req *http
 	finish(res, p.keytypes)
 }
 
+func (p *portalAPI) getScopes(email string, res http.ResponseWriter, req *http.Request) {
+	finish(res, p.a.scopes.list())
+}
+
 func (p *portalAPI) getAllKeys(email string, res http.ResponseWriter, req *http.Request) {
 	keys, err := p.m.GetAllKeys(email)
 	if err != nil {
@@ -175,13 +179,29 @@ func (p *portalAPI) getAllKeys(email string, res http.ResponseWriter, req *http.
 func (p *portalAPI) createKey(email string, res http.ResponseWriter, req *http.Request) {
 	decoder := json.NewDecoder(req.Body)
 	r := struct {
-		Type  string `json:"type"`
-		Realm string `json:"realm"`
+		Type      string     `json:"type"`
+		Realm     string     `json:"realm"`
+		Scopes    []string   `json:"scopes"`
+		ExpiresAt *time.Time `json:"expires_at"`
+		AllowIPs  []string   `json:"allow_ips"`
+		DenyIPs   []string   `json:"deny_ips"`
 	}{}
 	if decoder.Decode(&r) != nil || r.Type == "" {
 		abort(res, 400, "Specify a key_type.")
 		return
 	}
+	if r.ExpiresAt != nil && !r.ExpiresAt.After(time.Now()) {
+		abort(res, 400, "A new key can't expire in the past.")
+		return
+	}
+	if err := p.a.scopes.checkCatalog(r.Scopes); err != nil {
+		abort(res, 400, "%s", err.Error())
+		return
+	}
+	if err := checkCIDRs(append(r.AllowIPs, r.DenyIPs...)); err != nil {
+		abort(res, 400, "%s", err.Error())
+		return
+	}
 	plugin, found := p.keyplugins[r.Type]
 	if !found {
 		abort(res, 400, "The requested key type is not available for creation.")
@@ -189,6 +209,10 @@ func (p *portalAPI) createKey(email string, res http.ResponseWriter, req *http.R
 	}
 	key, err := plugin.Generate(r.Type)
 	key.Realm = r.Realm
+	key.Scopes = r.Scopes
+	key.ExpiresAt = r.ExpiresAt
+	key.AllowIPs = r.AllowIPs
+	key.DenyIPs = r.DenyIPs
 	if err != nil {
 		abort(res, 500, "Could not create %s key: %s", r.Type, err.Error())
 		return
@@ -197,9 +221,143 @@ func (p *portalAPI) createKey(email string, res http.ResponseWriter, req *http.R
 		abort(res, 500, "The new key could not be stored. %s", err.Error())
 		return
 	}
+	// someone may have tried the key before it existed
+	p.a.forgetKeys(key.ID)
 	finish(res, &key)
 }
 
+// ownKey returns one of the user's keys, or nil if the user has no such key.
+func (p *portalAPI) ownKey(email string, keyID string) (*Key, error) {
+	keys, err := p.m.GetAllKeys(email)
+	if err != nil {
+		return nil, err
+	}
+	for _, key := range keys {
+		if key.ID == keyID {
+			return key, nil
+		}
+	}
+	return nil, nil
+}
+
+// rotateKey gives a key a new secret. The previous secret keeps working for
+// the configured grace period.
+func (p *portalAPI) rotateKey(email string, res http.ResponseWriter, req *http.Request) {
+	updater, ok := p.m.(KeyUpdatingBackendPlugin)
+	if !ok {
+		abort(res, 501, "The backend can't change existing keys.")
+		return
+	}
+	decoder := json.NewDecoder(req.Body)
+	r := struct {
+		KID string `json:"key_id"`
+	}{}
+	if decoder.Decode(&r) != nil || r.KID == "" {
+		abort(res, 400, "Specify a key_id to rotate.")
+		return
+	}
+	key, err := p.ownKey(email, r.KID)
+	if err != nil {
+		abort(res, 500, "Could not find key: %s", err.Error())
+		return
+	}
+	if key == nil {
+		abort(res, 404, "You have no key %s.", r.KID)
+		return
+	}
+	rotator, ok := p.keyplugins[key.Type].(RotatingAuthPlugin)
+	if !ok {
+		abort(res, 400, "Keys of type %s can't be rotated.", key.Type)
+		return
+	}
+	if err := rotator.Rotate(key, p.a.keys.RotationGrace); err != nil {
+		abort(res, 500, "Could not rotate key: %s", err.Error())
+		return
+	}
+	if err := updater.UpdateKey(email, key); err != nil {
+		abort(res, 500, "The rotated key could not be stored. %s", err.Error())
+		return
+	}
+	p.a.forgetKeys(key.ID)
+	finish(res, key)
+}
+
+// setKeyIPs replaces the networks a key may (or may not) be used from.
+func (p *portalAPI) setKeyIPs(email string, res http.ResponseWriter, req *http.Request) {
+	updater, ok := p.m.(KeyUpdatingBackendPlugin)
+	if !ok {
+		abort(res, 501, "The backend can't change existing keys.")
+		return
+	}
+	decoder := json.NewDecoder(req.Body)
+	r := struct {
+		KID      string   `json:"key_id"`
+		AllowIPs []string `json:"allow_ips"`
+		DenyIPs  []string `json:"deny_ips"`
+	}{}
+	if decoder.Decode(&r) != nil || r.KID == "" {
+		abort(res, 400, "Specify a key_id, and the allow_ips and deny_ips for it.")
+		return
+	}
+	if err := checkCIDRs(append(r.AllowIPs, r.DenyIPs...)); err != nil {
+		abort(res, 400, "%s", err.Error())
+		return
+	}
+	key, err := p.ownKey(email, r.KID)
+	if err != nil {
+		abort(res, 500, "Could not find key: %s", err.Error())
+		return
+	}
+	if key == nil {
+		abort(res, 404, "You have no key %s.", r.KID)
+		return
+	}
+	key.AllowIPs = r.AllowIPs
+	key.DenyIPs = r.DenyIPs
+	if err := updater.UpdateKey(email, key); err != nil {
+		abort(res, 500, "The key could not be stored. %s", err.Error())
+		return
+	}
+	p.a.forgetKeys(key.ID)
+	finish(res, key)
+}
+
+type keyWarning struct {
+	KeyID     string    `json:"key_id"`
+	ExpiresAt time.Time `json:"expires_at"`
+	Expired   bool      `json:"expired"`
+	Message   string    `json:"message"`
+}
+
+// getExpiringKeys warns about the user's keys that have expired, or will
+// expire soon.
+func (p *portalAPI) getExpiringKeys(email string, res http.ResponseWriter, req *http.Request) {
+	keys, err := p.m.GetAllKeys(email)
+	if err != nil {
+		abort(res, 500, "Could not list keys: %s", err.Error())
+		return
+	}
+	now := time.Now()
+	warnings := []keyWarning{}
+	for _, key := range keys {
+		if key.ExpiresAt == nil || key.ExpiresAt.After(now.Add(p.a.keys.ExpiryWarning)) {
+			continue
+		}
+		w := keyWarning{
+			KeyID:     key.ID,
+			ExpiresAt: *key.ExpiresAt,
+			Expired:   key.Expired(now),
+		}
+		if w.Expired {
+			w.Message = fmt.Sprintf("Key %s expired on %s.", key.ID, key.ExpiresAt.UTC().Format(time.RFC1123))
+		} else {
+			w.Message = fmt.Sprintf("Key %s expires on %s.", key.ID, key.ExpiresAt.UTC().Format(time.RFC1123))
+		}
+		warnings = append(warnings, w)
+	}
+	finish(res, warnings)
+}
+
 func (p *portalAPI) deleteKey(email string, res http.ResponseWriter, req *http.Request) {
 	decoder := json.NewDecoder(req.Body)
 	r := struct {
@@ -213,6 +371,7 @@ func (p *portalAPI) deleteKey(email string, res http.ResponseWriter, req *http.R
 		abort(res, 500, "Could not delete key: %s", err.Error())
 		return
 	}
+	p.a.forgetKeys(r.KID)
 	msg := struct {
 		Deleted string `json:"deleted"`
 	}{Deleted: r.KID}
@@ -233,7 +392,7 @@ func (p *portalAPI) auth(inner func(string, http.ResponseWriter, *http.Request))
 		}
 		email, ok := token.Claims["email"].(string)
 		if !ok {
-			abort(res, 403, "Access denied: user token did not supply a valid user.", err.Error())
+			abort(res, 403, "Access denied: user token did not supply a valid user.")
 			return
 		}
 		inner(email, res, req)
@@ -276,9 +435,13 @@ func (ap *apiplex) BuildPortalAPI(prefix string) (*mux.Router, error) {
 	r.HandleFunc("/account/token", p.getToken).Methods("POST").Headers("Content-Type", "application/json")
 	r.HandleFunc("/account/update", p.auth(p.updateProfile)).Methods("POST").Headers("Content-Type", "application/json")
 	r.HandleFunc("/keys/types", p.auth(p.getKeyTypes))
+	r.HandleFunc("/keys/scopes", p.auth(p.getScopes))
+	r.HandleFunc("/keys/expiring", p.auth(p.getExpiringKeys)).Methods("GET")
+	r.HandleFunc("/keys/rotate", p.auth(p.rotateKey)).Methods("POST").Headers("Content-Type", "application/json")
+	r.HandleFunc("/keys/ips", p.auth(p.setKeyIPs)).Methods("POST").Headers("Content-Type", "application/json")
 	r.HandleFunc("/keys", p.auth(p.getAllKeys)).Methods("GET")
 	r.HandleFunc("/keys", p.auth(p.createKey)).Methods("POST").Headers("Content-Type", "application/json")
-	r.HandleFunc("/keys/delete", p.auth(p.createKey)).Methods("POST").Headers("Content-Type", "application/json")
+	r.HandleFunc("/keys/delete", p.auth(p.deleteKey)).Methods("POST").Headers("Content-Type", "application/json")
 
 	return r, nil
 }
@@ -0,0 +1,163 @@
+package apiplexy
+
+import (
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+)
+
+var readinessChecks = []string{"redis", "backends", "upstreams"}
+
+// apiplexProbes answers liveness and readiness probes. Liveness only tells
+// whether the process is serving HTTP at all; readiness checks the components
+// the API depends on.
+type apiplexProbes struct {
+	ap           *apiplex
+	checks       map[string]bool
+	upstreamPath string
+	timeout      time.Duration
+	client       *http.Client
+}
+
+type probeReport struct {
+	Status     string            `json:"status"`
+	Components map[string]string `json:"components,omitempty"`
+}
+
+func newProbes(config apiplexConfigProbes, ap *apiplex) (*apiplexProbes, error) {
+	for _, path := range []string{config.Liveness, config.Readiness} {
+		if err := ap.checkOutsideAPI("probe", path); err != nil {
+			return nil, err
+		}
+	}
+	p := apiplexProbes{
+		ap:           ap,
+		checks:       make(map[string]bool),
+		upstreamPath: config.UpstreamPath,
+		timeout:      config.Timeout,
+	}
+	checks := config.Checks
+	if checks == nil {
+		checks = readinessChecks
+	}
+	for _, c := range checks {
+		if !containsString(readinessChecks, c) {
+			return nil, fmt.Errorf("Unknown readiness check '%s'. Valid checks are: %s.", c, strings.Join(readinessChecks, ", "))
+		}
+		p.checks[c] = true
+	}
+	if p.timeout <= 0 {
+		p.timeout = 2 * time.Second
+	}
+	p.client = &http.Client{Timeout: p.timeout}
+	return &p, nil
+}
+
+func writeProbeReport(res http.ResponseWriter, report *probeReport) {
+	res.Header().Set("Content-Type", "application/json;charset=utf-8")
+	if report.Status == "ok" {
+		res.WriteHeader(http.StatusOK)
+	} else {
+		res.WriteHeader(http.StatusServiceUnavailable)
+	}
+	json.NewEncoder(res).Encode(report)
+}
+
+// HandleLiveness always responds 200 while the gateway is serving requests.
+func (p *apiplexProbes) HandleLiveness(res http.ResponseWriter, req *http.Request) {
+	writeProbeReport(res, &probeReport{Status: "ok"})
+}
+
+// HandleReadiness runs all configured readiness checks concurrently. Responds
+// 200 if all of them pass, 503 otherwise, with "ok" or "error" for every
+// check. Why a check failed is only logged, as probes don't need credentials.
+func (p *apiplexProbes) HandleReadiness(res http.ResponseWriter, req *http.Request) {
+	report := probeReport{Status: "ok", Components: make(map[string]string)}
+	var mu sync.Mutex
+	var wg sync.WaitGroup
+	check := func(name string, f func() error) {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			err := p.withTimeout(f)
+			mu.Lock()
+			defer mu.Unlock()
+			if err != nil {
+				log.Printf("Readiness check '%s' failed: %s\n", name, err.Error())
+				report.Status = "error"
+				report.Components[name] = "error"
+			} else {
+				report.Components[name] = "ok"
+			}
+		}()
+	}
+
+	if p.checks["redis"] {
+		check("redis", p.checkRedis)
+	}
+	if p.checks["backends"] {
+		for _, pi := range p.ap.plugins {
+			if _, ok := pi.plugin.(BackendPlugin); !ok {
+				continue
+			}
+			if hp, ok := pi.plugin.(HealthReportingPlugin); ok {
+				check(pi.name, hp.Health)
+			}
+		}
+	}
+	if p.checks["upstreams"] {
+		for i := range p.ap.upstreams {
+			us := &p.ap.upstreams[i]
+			check("upstream/"+us.Address.String(), func() error {
+				return p.checkUpstream(us)
+			})
+		}
+	}
+	wg.Wait()
+	writeProbeReport(res, &report)
+}
+
+// withTimeout runs a check, but gives up on it after the probe timeout. Plugin
+// health checks can't be cancelled, so a hanging one is left to finish on its
+// own.
+func (p *apiplexProbes) withTimeout(f func() error) error {
+	done := make(chan error, 1)
+	go func() {
+		done <- f()
+	}()
+	select {
+	case err := <-done:
+		return err
+	case <-time.After(p.timeout):
+		return fmt.Errorf("No answer within %s.", p.timeout)
+	}
+}
+
+func (p *apiplexProbes) checkRedis() error {
+	rd := p.ap.redis.Get()
+	defer rd.Close()
+	_, err := rd.Do("PING")
+	return err
+}
+
+// checkUpstream sends a GET to the upstream (or to UpstreamPath relative to
+// it). The upstream counts as up if it answers with anything but a 5xx.
+func (p *apiplexProbes) checkUpstream(us *APIUpstream) error {
+	u := *us.Address
+	if p.upstreamPath != "" {
+		u.Path = strings.TrimSuffix(u.Path, "/") + "/" + strings.TrimPrefix(p.upstreamPath, "/")
+	}
+	resp, err := p.client.Get(u.String())
+	if err != nil {
+		return err
+	}
+	resp.Body.Close()
+	if resp.StatusCode >= 500 {
+		return fmt.Errorf("Upstream responded %s.", resp.Status)
+	}
+	return nil
+}
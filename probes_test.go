@@ -0,0 +1,33 @@
+package apiplexy
+
+import (
+	"encoding/json"
+	. "github.com/smartystreets/goconvey/convey"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+func (b *slowBackend) Health() error {
+	<-b.release
+	return nil
+}
+
+func TestProbes(t *testing.T) {
+	Convey("Backends that don't answer in time should fail readiness", t, func() {
+		backend := &slowBackend{release: make(chan struct{})}
+		defer close(backend.release)
+		ap := &apiplex{apipath: "/api/", plugins: []pluginInstance{{name: "slow", plugin: backend}}}
+		probes, err := newProbes(apiplexConfigProbes{Checks: []string{"backends"}, Timeout: 20 * time.Millisecond}, ap)
+		So(err, ShouldBeNil)
+
+		req, _ := http.NewRequest("GET", "/readyz", nil)
+		res := httptest.NewRecorder()
+		probes.HandleReadiness(res, req)
+		So(res.Code, ShouldEqual, 503)
+		report := probeReport{}
+		json.Unmarshal(res.Body.Bytes(), &report)
+		So(report.Components["slow"], ShouldEqual, "error")
+	})
+}
@@ -0,0 +1,186 @@
+package apiplexy
+
+import (
+	"fmt"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// apiplexRealms keeps keys within their realm: the web domains and native apps
+// they may be used from. It also takes care of CORS for the API.
+type apiplexRealms struct {
+	appHeader    string
+	require      bool
+	cors         bool
+	origins      []string
+	allowHeaders string
+	maxAge       string
+}
+
+func newRealms(config apiplexConfigRealms) *apiplexRealms {
+	r := apiplexRealms{
+		appHeader: config.AppHeader,
+		require:   config.Require,
+		cors:      config.CORS,
+		origins:   realmEntries(strings.Join(config.Origins, ",")),
+	}
+	if r.appHeader == "" {
+		r.appHeader = "X-App-ID"
+	}
+	if len(config.AllowHeaders) > 0 {
+		r.allowHeaders = strings.Join(config.AllowHeaders, ", ")
+	}
+	if config.MaxAge > 0 {
+		r.maxAge = strconv.Itoa(int(config.MaxAge / time.Second))
+	}
+	return &r
+}
+
+// realmEntries splits a key's realm into its (lowercase) entries. Entries are
+// separated by commas or whitespace; for domains, only the host counts.
+func realmEntries(realm string) []string {
+	entries := []string{}
+	for _, e := range strings.FieldsFunc(strings.ToLower(realm), func(r rune) bool {
+		return r == ',' || r == ' ' || r == '\t' || r == '\n'
+	}) {
+		if i := strings.Index(e, "://"); i >= 0 {
+			e = e[i+3:]
+		}
+		if i := strings.IndexAny(e, "/:"); i >= 0 {
+			e = e[:i]
+		}
+		if e != "" {
+			entries = append(entries, e)
+		}
+	}
+	return entries
+}
+
+// matchesRealm checks a host or app identifier against a realm entry. Entries
+// starting with "*." match any subdomain, but not the domain itself.
+func matchesRealm(entry, value string) bool {
+	if strings.HasPrefix(entry, "*.") {
+		return strings.HasSuffix(value, entry[1:])
+	}
+	return entry == value
+}
+
+// source returns where a request comes from: the host of a web app (from the
+// Origin or Referer header), or the identifier a native app sent.
+func (r *apiplexRealms) source(req *http.Request) (kind string, value string) {
+	for _, h := range []string{"Origin", "Referer"} {
+		if v := req.Header.Get(h); v != "" {
+			u, err := url.Parse(v)
+			if err != nil || u.Host == "" {
+				// e.g. the "null" origin of sandboxed pages
+				return "web", strings.ToLower(v)
+			}
+			return "web", strings.ToLower(u.Hostname())
+		}
+	}
+	if v := strings.TrimSpace(req.Header.Get(r.appHeader)); v != "" {
+		return "app", strings.ToLower(v)
+	}
+	return "", ""
+}
+
+// check rejects requests made with a key outside of its realm. Keys without a
+// realm may be used from anywhere.
+func (r *apiplexRealms) check(req *http.Request, key *Key) error {
+	entries := realmEntries(key.Realm)
+	if len(entries) == 0 {
+		return nil
+	}
+	kind, value := r.source(req)
+	if kind == "" {
+		if r.require {
+			return Abort(403, fmt.Sprintf("Access denied. This key is restricted to its realm, so requests must come from a web app or identify their app in the %s header.", r.appHeader))
+		}
+		return nil
+	}
+	for _, e := range entries {
+		if matchesRealm(e, value) {
+			return nil
+		}
+	}
+	if kind == "app" {
+		return Abort(403, fmt.Sprintf("Access denied. This key may not be used from the app '%s'.", value))
+	}
+	return Abort(403, fmt.Sprintf("Access denied. This key may not be used from '%s'.", value))
+}
+
+// originAllowed tells whether a web app may read responses: if the key has a
+// realm, the app must be in it, otherwise (or without a key) it must be one
+// of the configured origins.
+func (r *apiplexRealms) originAllowed(origin string, key *Key) bool {
+	u, err := url.Parse(origin)
+	if err != nil || u.Host == "" {
+		return false
+	}
+	entries := r.origins
+	if key != nil {
+		if realm := realmEntries(key.Realm); len(realm) > 0 {
+			entries = realm
+		}
+	}
+	host := strings.ToLower(u.Hostname())
+	for _, e := range entries {
+		if matchesRealm(e, host) {
+			return true
+		}
+	}
+	return false
+}
+
+// allowOrigin allows the requesting web app to read the response, if it may.
+// It is only called once the request has passed its realm check.
+func (r *apiplexRealms) allowOrigin(res http.ResponseWriter, req *http.Request, key *Key) {
+	origin := req.Header.Get("Origin")
+	if origin == "" {
+		return
+	}
+	res.Header().Add("Vary", "Origin")
+	if r.originAllowed(origin, key) {
+		res.Header().Set("Access-Control-Allow-Origin", origin)
+	}
+}
+
+func isPreflight(req *http.Request) bool {
+	return req.Method == "OPTIONS" && req.Header.Get("Origin") != "" && req.Header.Get("Access-Control-Request-Method") != ""
+}
+
+// handlePreflight answers CORS preflight requests itself, instead of passing
+// them upstream. Browsers don't send credentials with a preflight, so unless
+// the key is in the URL, it is only checked on the actual request; until then,
+// only the configured origins are allowed.
+func (ap *apiplex) handlePreflight(res http.ResponseWriter, req *http.Request, ctx *APIContext) {
+	rd := ap.redis.Get()
+	defer rd.Close()
+	if err := ap.authenticateRequest(req, rd, ctx); err != nil && err != errMissingCredentials {
+		ap.error(500, err, res)
+		return
+	}
+	origin := req.Header.Get("Origin")
+	if !ap.realms.originAllowed(origin, ctx.Key) {
+		res.Header().Add("Vary", "Origin")
+		ap.error(500, Abort(403, fmt.Sprintf("Access denied. Web apps from '%s' may not use this API.", origin)), res)
+		return
+	}
+	ap.realms.allowOrigin(res, req, ctx.Key)
+	h := res.Header()
+	h.Set("Access-Control-Allow-Methods", req.Header.Get("Access-Control-Request-Method"))
+	if ap.realms.allowHeaders != "" {
+		h.Set("Access-Control-Allow-Headers", ap.realms.allowHeaders)
+	} else if rh := req.Header.Get("Access-Control-Request-Headers"); rh != "" {
+		h.Set("Access-Control-Allow-Headers", rh)
+	}
+	if ap.realms.maxAge != "" {
+		h.Set("Access-Control-Max-Age", ap.realms.maxAge)
+	}
+	h.Add("Vary", "Access-Control-Request-Method")
+	h.Add("Vary", "Access-Control-Request-Headers")
+	res.WriteHeader(http.StatusNoContent)
+}
@@ -0,0 +1,81 @@
+package apiplexy
+
+import (
+	. "github.com/smartystreets/goconvey/convey"
+	"net/http"
+	"testing"
+)
+
+func TestRealms(t *testing.T) {
+	realms := newRealms(apiplexConfigRealms{})
+	key := &Key{ID: "k", Realm: "https://Example.com, *.example.org:443 com.example.app"}
+
+	from := func(header, value string) *http.Request {
+		req, _ := http.NewRequest("GET", "http://api.example.com/things", nil)
+		if header != "" {
+			req.Header.Set(header, value)
+		}
+		return req
+	}
+
+	Convey("Realms should be split into their hosts and app identifiers", t, func() {
+		So(realmEntries(key.Realm), ShouldResemble, []string{"example.com", "*.example.org", "com.example.app"})
+		So(realmEntries(""), ShouldBeEmpty)
+	})
+
+	Convey("Wildcards should match subdomains only", t, func() {
+		So(matchesRealm("*.example.org", "www.example.org"), ShouldBeTrue)
+		So(matchesRealm("*.example.org", "a.b.example.org"), ShouldBeTrue)
+		So(matchesRealm("*.example.org", "example.org"), ShouldBeFalse)
+		So(matchesRealm("*.example.org", "evilexample.org"), ShouldBeFalse)
+		So(matchesRealm("example.com", "www.example.com"), ShouldBeFalse)
+	})
+
+	Convey("Web apps in the realm should be allowed", t, func() {
+		So(realms.check(from("Origin", "https://example.com"), key), ShouldBeNil)
+		So(realms.check(from("Origin", "https://app.example.org:8443"), key), ShouldBeNil)
+		So(realms.check(from("Referer", "https://www.example.org/page?x=1"), key), ShouldBeNil)
+	})
+
+	Convey("Web apps outside the realm should be rejected", t, func() {
+		err := realms.check(from("Origin", "https://evil.com"), key)
+		So(err, ShouldNotBeNil)
+		So(err.(AbortRequest).Status, ShouldEqual, 403)
+		So(err.Error(), ShouldContainSubstring, "evil.com")
+		So(realms.check(from("Referer", "https://example.com.evil.com/"), key), ShouldNotBeNil)
+		So(realms.check(from("Origin", "null"), key), ShouldNotBeNil)
+	})
+
+	Convey("Native apps should be checked by their identifier", t, func() {
+		So(realms.check(from("X-App-ID", "com.example.app"), key), ShouldBeNil)
+		err := realms.check(from("X-App-ID", "com.other.app"), key)
+		So(err, ShouldNotBeNil)
+		So(err.Error(), ShouldContainSubstring, "app 'com.other.app'")
+
+		custom := newRealms(apiplexConfigRealms{AppHeader: "X-Bundle"})
+		So(custom.check(from("X-Bundle", "com.example.app"), key), ShouldBeNil)
+	})
+
+	Convey("Requests from neither should only be rejected if a realm is required", t, func() {
+		So(realms.check(from("", ""), key), ShouldBeNil)
+		strict := newRealms(apiplexConfigRealms{Require: true})
+		So(strict.check(from("", ""), key), ShouldNotBeNil)
+		So(strict.check(from("", ""), &Key{ID: "k"}), ShouldBeNil)
+	})
+
+	Convey("Keys without a realm should work from anywhere", t, func() {
+		So(realms.check(from("Origin", "https://evil.com"), &Key{ID: "k"}), ShouldBeNil)
+	})
+
+	Convey("Web apps should only read responses from within a realm", t, func() {
+		cors := newRealms(apiplexConfigRealms{CORS: true, Origins: []string{"portal.example.net"}})
+		So(cors.originAllowed("https://app.example.org", key), ShouldBeTrue)
+		So(cors.originAllowed("https://portal.example.net", key), ShouldBeFalse)
+		So(cors.originAllowed("https://portal.example.net", &Key{ID: "k"}), ShouldBeTrue)
+		So(cors.originAllowed("https://portal.example.net", nil), ShouldBeTrue)
+		So(cors.originAllowed("https://evil.com", &Key{ID: "k"}), ShouldBeFalse)
+		So(cors.originAllowed("https://evil.com", nil), ShouldBeFalse)
+		So(cors.originAllowed("null", nil), ShouldBeFalse)
+		So(realms.originAllowed("https://evil.com", nil), ShouldBeFalse)
+	})
+}
@@ -0,0 +1,107 @@
+package apiplexy
+
+import (
+	"fmt"
+	"sort"
+	"strings"
+)
+
+// apiplexScopes authorizes requests: it checks that the key carries all the
+// scopes the requested route requires.
+type apiplexScopes struct {
+	catalog map[string]string
+	routes  []apiplexScopeRoute
+}
+
+// A ScopeInfo describes a scope from the catalog, for developers picking the
+// scopes of a new key.
+type ScopeInfo struct {
+	Name        string `json:"name"`
+	Description string `json:"description"`
+}
+
+func newScopes(config apiplexConfigScopes) (*apiplexScopes, error) {
+	s := apiplexScopes{
+		catalog: config.Catalog,
+		routes:  config.Routes,
+	}
+	if s.catalog == nil {
+		s.catalog = make(map[string]string)
+	}
+	for name := range s.catalog {
+		if name == "" || strings.ContainsAny(name, " \t\n") {
+			return nil, fmt.Errorf("Invalid scope name '%s'. Scope names can't contain spaces.", name)
+		}
+	}
+	for i := range s.routes {
+		route := &s.routes[i]
+		if len(route.Paths) == 0 {
+			return nil, fmt.Errorf("Every scope route needs at least one path.")
+		}
+		for _, p := range route.Paths {
+			if err := ValidatePathPattern(p); err != nil {
+				return nil, err
+			}
+		}
+		for j, m := range route.Methods {
+			route.Methods[j] = strings.ToUpper(m)
+		}
+		for _, scope := range route.Scopes {
+			if _, ok := s.catalog[scope]; !ok {
+				return nil, fmt.Errorf("Scope '%s' is required by a route, but not in the catalog.", scope)
+			}
+		}
+	}
+	return &s, nil
+}
+
+// list returns the catalog, sorted by scope name.
+func (s *apiplexScopes) list() []ScopeInfo {
+	infos := make([]ScopeInfo, 0, len(s.catalog))
+	for name, desc := range s.catalog {
+		infos = append(infos, ScopeInfo{Name: name, Description: desc})
+	}
+	sort.Slice(infos, func(i, j int) bool { return infos[i].Name < infos[j].Name })
+	return infos
+}
+
+// checkCatalog makes sure that all scopes are in the catalog.
+func (s *apiplexScopes) checkCatalog(scopes []string) error {
+	for _, scope := range scopes {
+		if _, ok := s.catalog[scope]; !ok {
+			return fmt.Errorf("Unknown scope '%s'.", scope)
+		}
+	}
+	return nil
+}
+
+// required returns the scopes a request needs.
+func (s *apiplexScopes) required(method, path string) []string {
+	required := []string{}
+	for _, route := range s.routes {
+		if len(route.Methods) > 0 && !containsString(route.Methods, method) {
+			continue
+		}
+		for _, p := range route.Paths {
+			if MatchPath(p, path) {
+				required = append(required, route.Scopes...)
+				break
+			}
+		}
+	}
+	return required
+}
+
+// authorize rejects requests whose key lacks a scope the route requires.
+// Keyless requests have no scopes at all.
+func (s *apiplexScopes) authorize(method string, ctx *APIContext) error {
+	for _, scope := range s.required(method, ctx.Path) {
+		if ctx.Keyless || ctx.Key == nil {
+			return Abort(403, fmt.Sprintf("Access denied. %s %s requires a key with the scope '%s'.", method, ctx.Path, scope))
+		}
+		if !ctx.Key.HasScope(scope) {
+			return Abort(403, fmt.Sprintf("Access denied. This key lacks the scope '%s', which %s %s requires.", scope, method, ctx.Path))
+		}
+	}
+	return nil
+}
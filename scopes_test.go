@@ -0,0 +1,73 @@
+package apiplexy
+
+import (
+	. "github.com/smartystreets/goconvey/convey"
+	"testing"
+)
+
+func TestScopes(t *testing.T) {
+	scopes, err := newScopes(apiplexConfigScopes{
+		Catalog: map[string]string{
+			"read":  "Read things.",
+			"write": "Change things.",
+			"admin": "Manage users.",
+		},
+		Routes: []apiplexScopeRoute{
+			{Paths: []string{"/things/**"}, Scopes: []string{"read"}},
+			{Paths: []string{"/things/**"}, Methods: []string{"post", "delete"}, Scopes: []string{"write"}},
+			{Paths: []string{"/users/**"}, Scopes: []string{"admin"}},
+		},
+	})
+
+	Convey("Scopes should be configured from a catalog and routes", t, func() {
+		So(err, ShouldBeNil)
+		So(scopes.list(), ShouldResemble, []ScopeInfo{
+			{Name: "admin", Description: "Manage users."},
+			{Name: "read", Description: "Read things."},
+			{Name: "write", Description: "Change things."},
+		})
+		So(scopes.checkCatalog([]string{"read", "write"}), ShouldBeNil)
+		So(scopes.checkCatalog([]string{"read", "delete"}), ShouldNotBeNil)
+	})
+
+	Convey("Invalid scope configurations should be rejected", t, func() {
+		_, err := newScopes(apiplexConfigScopes{Catalog: map[string]string{"read things": ""}})
+		So(err, ShouldNotBeNil)
+		_, err = newScopes(apiplexConfigScopes{
+			Catalog: map[string]string{"read": ""},
+			Routes:  []apiplexScopeRoute{{Paths: []string{"/things"}, Scopes: []string{"write"}}},
+		})
+		So(err, ShouldNotBeNil)
+		_, err = newScopes(apiplexConfigScopes{
+			Catalog: map[string]string{"read": ""},
+			Routes:  []apiplexScopeRoute{{Scopes: []string{"read"}}},
+		})
+		So(err, ShouldNotBeNil)
+	})
+
+	Convey("Routes should require the scopes of all matching rules", t, func() {
+		So(scopes.required("GET", "/things/42"), ShouldResemble, []string{"read"})
+		So(scopes.required("POST", "/things/42"), ShouldResemble, []string{"read", "write"})
+		So(scopes.required("GET", "/users"), ShouldResemble, []string{"admin"})
+		So(scopes.required("GET", "/status"), ShouldBeEmpty)
+	})
+
+	Convey("Keys should only be authorized with all required scopes", t, func() {
+		ctx := &APIContext{Path: "/things/42", Key: &Key{ID: "k", Scopes: []string{"read"}}}
+		So(scopes.authorize("GET", ctx), ShouldBeNil)
+
+		err := scopes.authorize("DELETE", ctx)
+		So(err, ShouldNotBeNil)
+		So(err.(AbortRequest).Status, ShouldEqual, 403)
+		So(err.Error(), ShouldContainSubstring, "scope 'write'")
+
+		So(scopes.authorize("GET", &APIContext{Path: "/status", Key: &Key{ID: "k"}}), ShouldBeNil)
+	})
+
+	Convey("Keyless requests should be turned away from routes requiring scopes", t, func() {
+		err := scopes.authorize("GET", &APIContext{Path: "/things", Keyless: true})
+		So(err, ShouldNotBeNil)
+		So(err.Error(), ShouldContainSubstring, "requires a key with the scope 'read'")
+		So(scopes.authorize("GET", &APIContext{Path: "/status", Keyless: true}), ShouldBeNil)
+	})
+}
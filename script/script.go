@@ -0,0 +1,402 @@
+package script
+
+import (
+	"context"
+	"fmt"
+	"github.com/12foo/apiplexy"
+	"github.com/yuin/gopher-lua"
+	"github.com/yuin/gopher-lua/parse"
+	"io/ioutil"
+	"log"
+	"math"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Names of the functions a script may define, one per stage.
+const (
+	postAuthFunc     = "post_auth"
+	preUpstreamFunc  = "pre_upstream"
+	postUpstreamFunc = "post_upstream"
+)
+
+// maxUpstreams is how many upstreams chosen by the script are kept at once.
+const maxUpstreams = 100
+
+type scriptConfig struct {
+	Script  string        `config:"script"`
+	File    string        `config:"file"`
+	Timeout time.Duration `config:"timeout" default:"100ms" min:"1ms"`
+}
+
+// ScriptPlugin runs small Lua scripts as request policies, so simple things
+// like setting the cost by path or picking an upstream don't need a Go plugin
+// of their own. Scripts run in a sandbox: only the base, string, table and
+// math libraries are available (no io, os or loading of other files), and
+// every call is cut off after a timeout.
+//
+// A script defines any of the functions post_auth(req, ctx),
+// pre_upstream(req, ctx) and post_upstream(req, res, ctx). See README.md for
+// the tables passed in.
+type ScriptPlugin struct {
+	name      string
+	timeout   time.Duration
+	proto     *lua.FunctionProto
+	stages    map[string]bool
+	states    sync.Pool
+	upstreams *apiplexy.UpstreamCache
+}
+
+// scriptState is a Lua interpreter with the script loaded. States are pooled
+// and reused across requests, but only ever used by one request at a time.
+type scriptState struct {
+	L     *lua.LState
+	abort *apiplexy.AbortRequest
+}
+
+var sandboxLibs = []struct {
+	name string
+	open lua.LGFunction
+}{
+	{lua.BaseLibName, lua.OpenBase},
+	{lua.TabLibName, lua.OpenTable},
+	{lua.StringLibName, lua.OpenString},
+	{lua.MathLibName, lua.OpenMath},
+}
+
+// Functions from the base library that can reach outside the sandbox.
+var unsafeGlobals = []string{"dofile", "loadfile", "load", "loadstring", "require", "module"}
+
+func (p *ScriptPlugin) newState() (*scriptState, error) {
+	L := lua.NewState(lua.Options{SkipOpenLibs: true})
+	for _, lib := range sandboxLibs {
+		L.Push(L.NewFunction(lib.open))
+		L.Push(lua.LString(lib.name))
+		L.Call(1, 0)
+	}
+	for _, name := range unsafeGlobals {
+		L.SetGlobal(name, lua.LNil)
+	}
+	s := &scriptState{L: L}
+	L.SetGlobal("print", L.NewFunction(func(L *lua.LState) int {
+		parts := make([]string, L.GetTop())
+		for i := range parts {
+			parts[i] = L.ToStringMeta(L.Get(i + 1)).String()
+		}
+		log.Printf("[%s] %s", p.name, strings.Join(parts, " "))
+		return 0
+	}))
+	L.SetGlobal("Abort", L.NewFunction(func(L *lua.LState) int {
+		abort := apiplexy.Abort(L.CheckInt(1), L.OptString(2, ""))
+		s.abort = &abort
+		L.RaiseError("request aborted")
+		return 0
+	}))
+
+	// run the script's main chunk once, which defines the stage functions
+	ctx, cancel := context.WithTimeout(context.Background(), p.timeout)
+	defer cancel()
+	L.SetContext(ctx)
+	defer L.RemoveContext()
+	L.Push(L.NewFunctionFromProto(p.proto))
+	if err := L.PCall(0, 0, nil); err != nil {
+		L.Close()
+		return nil, fmt.Errorf("Script %s failed to load: %s", p.name, err.Error())
+	}
+	return s, nil
+}
+
+func (p *ScriptPlugin) getState() (*scriptState, error) {
+	if s, ok := p.states.Get().(*scriptState); ok {
+		return s, nil
+	}
+	return p.newState()
+}
+
+// call runs one of the script's stage functions on a state, with a timeout.
+// States whose call failed are closed rather than reused, since they may have
+// been left in any condition.
+func (p *ScriptPlugin) call(s *scriptState, function string, args ...lua.LValue) error {
+	s.abort = nil
+	ctx, cancel := context.WithTimeout(context.Background(), p.timeout)
+	defer cancel()
+	s.L.SetContext(ctx)
+	err := s.L.CallByParam(lua.P{Fn: s.L.GetGlobal(function), NRet: 0, Protect: true}, args...)
+	s.L.RemoveContext()
+	if s.abort != nil {
+		// a script may have caught the abort with pcall; it still counts
+		abort := *s.abort
+		s.L.Close()
+		return abort
+	}
+	if err != nil {
+		s.L.Close()
+		if ctx.Err() != nil {
+			return fmt.Errorf("Script %s timed out in %s.", p.name, function)
+		}
+		return fmt.Errorf("Script %s failed in %s: %s", p.name, function, err.Error())
+	}
+	return nil
+}
+
+func (p *ScriptPlugin) release(s *scriptState) {
+	s.L.SetTop(0)
+	p.states.Put(s)
+}
+
+// toLua converts plain Go values (as found in Log and Data) to Lua values.
+func toLua(L *lua.LState, v interface{}) lua.LValue {
+	switch v := v.(type) {
+	case nil:
+		return lua.LNil
+	case bool:
+		return lua.LBool(v)
+	case string:
+		return lua.LString(v)
+	case int:
+		return lua.LNumber(v)
+	case int64:
+		return lua.LNumber(v)
+	case float64:
+		return lua.LNumber(v)
+	case map[string]interface{}:
+		t := L.NewTable()
+		for k, item := range v {
+			t.RawSetString(k, toLua(L, item))
+		}
+		return t
+	case []interface{}:
+		t := L.NewTable()
+		for _, item := range v {
+			t.Append(toLua(L, item))
+		}
+		return t
+	case []string:
+		t := L.NewTable()
+		for _, item := range v {
+			t.Append(lua.LString(item))
+		}
+		return t
+	default:
+		return lua.LString(fmt.Sprint(v))
+	}
+}
+
+// fromLua converts Lua values back to plain Go values. Whole numbers become
+// ints, tables with only consecutive integer keys become lists, and functions
+// and other values that can't be serialized are dropped.
+func fromLua(v lua.LValue) interface{} {
+	switch v := v.(type) {
+	case lua.LBool:
+		return bool(v)
+	case lua.LString:
+		return string(v)
+	case lua.LNumber:
+		f := float64(v)
+		if f == math.Trunc(f) && math.Abs(f) < 1<<53 {
+			return int(f)
+		}
+		return f
+	case *lua.LTable:
+		n := v.MaxN()
+		count := 0
+		v.ForEach(func(_, _ lua.LValue) { count++ })
+		if n > 0 && n == count {
+			list := make([]interface{}, 0, n)
+			for i := 1; i <= n; i++ {
+				list = append(list, fromLua(v.RawGetInt(i)))
+			}
+			return list
+		}
+		m := make(map[string]interface{}, count)
+		v.ForEach(func(key, item lua.LValue) {
+			if converted := fromLua(item); converted != nil {
+				m[key.String()] = converted
+			}
+		})
+		return m
+	default:
+		return nil
+	}
+}
+
+func headerTable(L *lua.LState, header http.Header) *lua.LTable {
+	t := L.NewTable()
+	for name, values := range header {
+		t.RawSetString(strings.ToLower(name), lua.LString(strings.Join(values, ", ")))
+	}
+	return t
+}
+
+func requestTable(L *lua.LState, req *http.Request) *lua.LTable {
+	t := L.NewTable()
+	t.RawSetString("method", lua.LString(req.Method))
+	t.RawSetString("url", lua.LString(req.URL.String()))
+	t.RawSetString("path", lua.LString(req.URL.Path))
+	t.RawSetString("host", lua.LString(req.Host))
+	t.RawSetString("remote_addr", lua.LString(req.RemoteAddr))
+	t.RawSetString("header", headerTable(L, req.Header))
+	query := L.NewTable()
+	for name, values := range req.URL.Query() {
+		if len(values) > 0 {
+			query.RawSetString(name, lua.LString(values[0]))
+		}
+	}
+	t.RawSetString("query", query)
+	return t
+}
+
+func responseTable(L *lua.LState, res *http.Response) *lua.LTable {
+	t := L.NewTable()
+	t.RawSetString("status", lua.LNumber(res.StatusCode))
+	t.RawSetString("header", headerTable(L, res.Header))
+	return t
+}
+
+func contextTable(L *lua.LState, ctx *apiplexy.APIContext) *lua.LTable {
+	t := L.NewTable()
+	t.RawSetString("keyless", lua.LBool(ctx.Keyless))
+	t.RawSetString("cost", lua.LNumber(ctx.Cost))
+	t.RawSetString("path", lua.LString(ctx.Path))
+	if ctx.Upstream != nil {
+		t.RawSetString("upstream", lua.LString(ctx.Upstream.Address.String()))
+	}
+	if ctx.Key != nil {
+		key := L.NewTable()
+		key.RawSetString("id", lua.LString(ctx.Key.ID))
+		key.RawSetString("type", lua.LString(ctx.Key.Type))
+		key.RawSetString("realm", lua.LString(ctx.Key.Realm))
+		key.RawSetString("quota", lua.LString(ctx.Key.Quota))
+		t.RawSetString("key", key)
+	}
+	t.RawSetString("log", toLua(L, ctx.Log))
+	t.RawSetString("data", toLua(L, ctx.Data))
+	return t
+}
+
+// applyContext copies the script's changes to the context table back into the
+// request context. The key and keyless status are read-only.
+func (p *ScriptPlugin) applyContext(t *lua.LTable, ctx *apiplexy.APIContext) error {
+	cost, ok := t.RawGetString("cost").(lua.LNumber)
+	if !ok || float64(cost) < 0 {
+		return fmt.Errorf("Script %s set an invalid cost.", p.name)
+	}
+	ctx.Cost = int(cost)
+	if address, ok := t.RawGetString("upstream").(lua.LString); ok {
+		if ctx.Upstream == nil || ctx.Upstream.Address.String() != string(address) {
+			us, err := p.upstreams.Get(string(address))
+			if err != nil {
+				return fmt.Errorf("Script %s chose an invalid upstream: %s", p.name, err.Error())
+			}
+			ctx.Upstream = us
+		}
+	}
+	if m, ok := fromLua(t.RawGetString("log")).(map[string]interface{}); ok {
+		ctx.Log = m
+	}
+	if m, ok := fromLua(t.RawGetString("data")).(map[string]interface{}); ok {
+		ctx.Data = m
+	}
+	return nil
+}
+
+func (p *ScriptPlugin) runStage(function string, req *http.Request, res *http.Response, ctx *apiplexy.APIContext) error {
+	if !p.stages[function] {
+		return nil
+	}
+	s, err := p.getState()
+	if err != nil {
+		return err
+	}
+	args := []lua.LValue{requestTable(s.L, req)}
+	if res != nil {
+		args = append(args, responseTable(s.L, res))
+	}
+	ct := contextTable(s.L, ctx)
+	args = append(args, ct)
+	if err := p.call(s, function, args...); err != nil {
+		return err
+	}
+	defer p.release(s)
+	return p.applyContext(ct, ctx)
+}
+
+func (p *ScriptPlugin) PostAuth(req *http.Request, ctx *apiplexy.APIContext) error {
+	return p.runStage(postAuthFunc, req, nil, ctx)
+}
+
+func (p *ScriptPlugin) PreUpstream(req *http.Request, ctx *apiplexy.APIContext) error {
+	return p.runStage(preUpstreamFunc, req, nil, ctx)
+}
+
+func (p *ScriptPlugin) PostUpstream(req *http.Request, res *http.Response, ctx *apiplexy.APIContext) error {
+	return p.runStage(postUpstreamFunc, req, res, ctx)
+}
+
+func (p *ScriptPlugin) ConfigStruct() interface{} {
+	return &scriptConfig{}
+}
+
+func (p *ScriptPlugin) ConfigureTyped(config interface{}) error {
+	c := config.(*scriptConfig)
+	if (c.Script == "") == (c.File == "") {
+		return fmt.Errorf("Specify either an inline script, or a script file.")
+	}
+	source, name := c.Script, "(inline)"
+	if c.File != "" {
+		b, err := ioutil.ReadFile(c.File)
+		if err != nil {
+			return fmt.Errorf("Couldn't read script file: %s", err.Error())
+		}
+		source, name = string(b), c.File
+	}
+	chunk, err := parse.Parse(strings.NewReader(source), name)
+	if err != nil {
+		return fmt.Errorf("Script %s doesn't parse: %s", name, err.Error())
+	}
+	proto, err := lua.Compile(chunk, name)
+	if err != nil {
+		return fmt.Errorf("Script %s doesn't compile: %s", name, err.Error())
+	}
+	p.name = name
+	p.timeout = c.Timeout
+	p.proto = proto
+	p.upstreams = apiplexy.NewUpstreamCache(maxUpstreams)
+
+	// load the script once to see which stages it handles
+	s, err := p.newState()
+	if err != nil {
+		return err
+	}
+	defer s.L.Close()
+	p.stages = make(map[string]bool)
+	for _, function := range []string{postAuthFunc, preUpstreamFunc, postUpstreamFunc} {
+		p.stages[function] = s.L.GetGlobal(function).Type() == lua.LTFunction
+	}
+	if !p.stages[postAuthFunc] && !p.stages[preUpstreamFunc] && !p.stages[postUpstreamFunc] {
+		return fmt.Errorf("Script %s defines none of %s, %s or %s.", name, postAuthFunc, preUpstreamFunc, postUpstreamFunc)
+	}
+	return nil
+}
+
+func (p *ScriptPlugin) DefaultConfig() map[string]interface{} {
+	d := apiplexy.TypedDefaultConfig(p)
+	d["script"] = "function post_auth(req, ctx)\n  ctx.cost = 1\nend\n"
+	return d
+}
+
+func (p *ScriptPlugin) Configure(config map[string]interface{}) error {
+	return apiplexy.TypedConfigure(p, config)
+}
+
+func init() {
+	// _ = apiplexy.PostAuthPlugin(&ScriptPlugin{})
+	apiplexy.RegisterPlugin(
+		"script",
+		"Run small Lua scripts as request policies (cost, upstream choice, aborts).",
+		"https://github.com/12foo/apiplexy/tree/master/script",
+		ScriptPlugin{},
+	)
+}
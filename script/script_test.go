@@ -0,0 +1,126 @@
+package script
+
+import (
+	"github.com/12foo/apiplexy"
+	. "github.com/smartystreets/goconvey/convey"
+	"net/http"
+	"testing"
+)
+
+func scriptPlugin(source string) (*ScriptPlugin, error) {
+	p := &ScriptPlugin{}
+	err := p.Configure(map[string]interface{}{"script": source, "timeout": "50ms"})
+	return p, err
+}
+
+func newContext(path string) *apiplexy.APIContext {
+	return &apiplexy.APIContext{
+		Cost: 1,
+		Path: path,
+		Key:  &apiplexy.Key{ID: "k", Type: "HMAC", Quota: "default"},
+		Log:  map[string]interface{}{},
+		Data: map[string]interface{}{"tier": "gold"},
+	}
+}
+
+func TestConfigure(t *testing.T) {
+	Convey("Plugin should not panic when configuring with default configuration", t, func() {
+		So(func() {
+			tplugin := apiplexy.PostAuthPlugin(&ScriptPlugin{})
+			_ = tplugin.Configure(tplugin.DefaultConfig())
+		}, ShouldNotPanic)
+	})
+
+	Convey("Scripts that don't parse or define no stage should be refused", t, func() {
+		_, err := scriptPlugin("function post_auth(req, ctx")
+		So(err, ShouldNotBeNil)
+		_, err = scriptPlugin("x = 1")
+		So(err, ShouldNotBeNil)
+	})
+
+	Convey("Scripts should not be able to reach outside the sandbox", t, func() {
+		_, err := scriptPlugin("os.exit(1)\nfunction post_auth(req, ctx) end")
+		So(err, ShouldNotBeNil)
+		_, err = scriptPlugin("dofile('/etc/passwd')\nfunction post_auth(req, ctx) end")
+		So(err, ShouldNotBeNil)
+	})
+}
+
+func TestScriptPlugin(t *testing.T) {
+	p, err := scriptPlugin(`
+function post_auth(req, ctx)
+  if req.header["x-debug"] and req.query.admin then
+    Abort(403, "Not like this.")
+  end
+  if string.find(req.path, "^/export") then
+    ctx.cost = 10
+  end
+  ctx.log.tier = ctx.data.tier
+  ctx.data.seen = true
+end
+
+function pre_upstream(req, ctx)
+  if req.query.region == "eu" then
+    ctx.upstream = "http://eu.backend.local"
+  end
+end
+
+function post_upstream(req, res, ctx)
+  ctx.log.status = res.status
+end
+`)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	Convey("Scripts should read the request and modify the context", t, func() {
+		req, _ := http.NewRequest("GET", "http://dummy-request.com/export/all", nil)
+		ctx := newContext("/export/all")
+		So(p.PostAuth(req, ctx), ShouldBeNil)
+		So(ctx.Cost, ShouldEqual, 10)
+		So(ctx.Log["tier"], ShouldEqual, "gold")
+		So(ctx.Data["seen"], ShouldEqual, true)
+	})
+
+	Convey("Scripts should be able to abort requests", t, func() {
+		req, _ := http.NewRequest("GET", "http://dummy-request.com/items?admin=1", nil)
+		req.Header.Set("X-Debug", "1")
+		err := p.PostAuth(req, newContext("/items"))
+		So(err, ShouldResemble, apiplexy.Abort(403, "Not like this."))
+	})
+
+	Convey("Scripts should be able to pick an upstream", t, func() {
+		req, _ := http.NewRequest("GET", "http://dummy-request.com/items?region=eu", nil)
+		ctx := newContext("/items")
+		So(p.PreUpstream(req, ctx), ShouldBeNil)
+		So(ctx.Upstream, ShouldNotBeNil)
+		So(ctx.Upstream.Address.Host, ShouldEqual, "eu.backend.local")
+	})
+
+	Convey("Scripts should see the upstream response", t, func() {
+		req, _ := http.NewRequest("GET", "http://dummy-request.com/items", nil)
+		ctx := newContext("/items")
+		So(p.PostUpstream(req, &http.Response{StatusCode: 404, Header: http.Header{}}, ctx), ShouldBeNil)
+		So(ctx.Log["status"], ShouldEqual, 404)
+	})
+}
+
+func TestScriptErrors(t *testing.T) {
+	Convey("Runaway scripts should time out", t, func() {
+		p, err := scriptPlugin("function post_auth(req, ctx) while true do end end")
+		So(err, ShouldBeNil)
+		req, _ := http.NewRequest("GET", "http://dummy-request.com/items", nil)
+		err = p.PostAuth(req, newContext("/items"))
+		So(err, ShouldNotBeNil)
+		So(err.Error(), ShouldContainSubstring, "timed out")
+	})
+
+	Convey("Invalid costs and upstreams should be errors", t, func() {
+		p, err := scriptPlugin(`function post_auth(req, ctx) ctx.cost = "lots" end
+function pre_upstream(req, ctx) ctx.upstream = "not a url" end`)
+		So(err, ShouldBeNil)
+		req, _ := http.NewRequest("GET", "http://dummy-request.com/items", nil)
+		So(p.PostAuth(req, newContext("/items")), ShouldNotBeNil)
+		So(p.PreUpstream(req, newContext("/items")), ShouldNotBeNil)
+	})
+}
@@ -2,14 +2,22 @@ package apiplexy
 
 import (
 	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
 	"encoding/json"
 	"fmt"
 	"github.com/garyburd/redigo/redis"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/codes"
+	"go.opentelemetry.io/otel/propagation"
+	"go.opentelemetry.io/otel/trace"
 	"io/ioutil"
+	"log"
 	"math/rand"
 	"net"
 	"net/http"
 	"strings"
+	"time"
 )
 
 // Hop-by-hop headers. These are removed when sent to the backend.
@@ -47,14 +55,22 @@ func (ap *apiplex) error(status int, err error, res http.ResponseWriter) {
 	}
 }
 
+var errMissingCredentials = Abort(403, "Access denied. You or your app must supply valid credentials to access this API.")
+var errLockedOut = Abort(429, "Too many failed authentication attempts. Please wait a few minutes before trying again.")
+var errBackendBusy = Abort(503, "The key store is busy. Please try again shortly.")
+var errDeniedIP = Abort(403, "Access denied. Requests from your network are not accepted.")
+
 // Authenticate a request: first, tries all AuthPlugins in order. The first one that Detect()s
 // an auth scheme in the request extracts the identifying ID and other bits of an auth key.
 // These are then tried in the backends until one responds back with the corresponding full key
 // e.g. from a database. The full key is then passed back once more to the original AuthPlugin
-// for final cryptographic validation.
+// for final cryptographic validation, unless the key has expired. Finally, the request must
+// come from within the key's realm, and from a network the key may be used from.
 //
 // Authenticated keys are cached for some time and only need to perform the validation step
-// on subsequent requests.
+// on subsequent requests, first in memory (if enabled), then in Redis. Keys that don't exist
+// are cached too, for a shorter time. Clients that keep failing to authenticate are locked
+// out for a while.
 //
 // If no key is detected in the request and keyless mode is enabled in the config (i.e. a "keyless"
 // quota is present), the request is marked as keyless and allowed to proceed against the
@@ -64,64 +80,201 @@ func (ap *apiplex) authenticateRequest(req *http.Request, rd redis.Conn, ctx *AP
 	for _, auth := range ap.auth {
 		maybeKey, keyType, bits, err := auth.Detect(req, ctx)
 		if err != nil {
+			ap.metrics.authFailure("error")
 			return err
 		}
+		if maybeKey == "" {
+			continue
+		}
+		if ap.lockedOut(rd, ctx.ClientIP) {
+			ap.metrics.authFailure("locked_out")
+			return errLockedOut
+		}
 
 		// we've found a key (probably)
-		if maybeKey != "" {
-			// quick auth: is key in redis?
-			kjson, _ := redis.String(rd.Do("GET", "auth_cache:"+maybeKey))
+		var key *Key
+		cache := false
+		if resolver, ok := auth.(ResolvingAuthPlugin); ok {
+			// the auth plugin knows the key without asking anyone
+			key, err = ap.resolveKey(rd, resolver, maybeKey, keyType, bits)
+			if err != nil {
+				ap.metrics.authFailure("error")
+				return err
+			}
+			if key == nil {
+				ap.metrics.authFailure("invalid")
+				ap.failedAuth(rd, ctx.ClientIP)
+				return Abort(403, fmt.Sprintf("Access denied. Found a key of type '%s', but it is invalid.", keyType))
+			}
+		} else {
+			// quick auth: is key in memory, or in redis?
+			kjson, local := ap.keyCache.get(maybeKey)
+			if ap.keyCache != nil {
+				ap.metrics.authCacheLookup("local", local)
+			}
+			if !local {
+				kjson, _ = redis.String(rd.Do("GET", "auth_cache:"+maybeKey))
+				ap.metrics.authCacheLookup("redis", kjson != "")
+				if kjson != "" {
+					ap.keyCache.set(maybeKey, kjson, ap.keys.LocalCacheTTL)
+				}
+			}
 			if kjson != "" {
-				// yes-- proceed immediately
-				key := Key{}
+				// yes-- proceed immediately (unknown keys are cached as null)
 				json.Unmarshal([]byte(kjson), &key)
-				ok, err := auth.Validate(&key, req, ctx, bits)
-				if err != nil {
+			} else {
+				// no-- try the backends
+				key, err = ap.findKey(maybeKey, keyType)
+				if err == errBackendBusy {
+					ap.metrics.authFailure("backend_busy")
 					return err
 				}
-				if ok {
-					ctx.Key = &key
-					found = true
-					break
-				} else {
-					return Abort(403, fmt.Sprintf("Access denied. Found a key of type '%s', but it is invalid.", key.Type))
+				if err != nil {
+					ap.metrics.authFailure("error")
+					return err
 				}
-			} else {
-				// no-- try the backends
-				for _, bend := range ap.backends {
-					key, err := bend.GetKey(maybeKey, keyType)
-					if err != nil {
-						return err
-					}
-					ok, err := auth.Validate(key, req, ctx, bits)
-					if err != nil {
-						return err
-					}
-					if ok {
-						kjson, _ := json.Marshal(&key)
-						// TODO error handling if things go wrong in redis?
-						rd.Do("SETEX", "auth_cache:"+maybeKey, ap.authCacheMins*60, string(kjson))
-						ctx.Key = key
-						found = true
-						break
-					} else {
-						return Abort(403, fmt.Sprintf("Access denied. Found a key of type '%s', but it is invalid.", key.Type))
+				if key == nil {
+					if ap.keys.NegativeCacheTTL > 0 {
+						rd.Do("SET", "auth_cache:"+maybeKey, "null", "PX", int64(ap.keys.NegativeCacheTTL/time.Millisecond))
+						ap.keyCache.set(maybeKey, "null", ap.keys.NegativeCacheTTL)
 					}
+				} else {
+					cache = true
 				}
 			}
+			if key == nil {
+				ap.metrics.authFailure("unknown_key")
+				ap.failedAuth(rd, ctx.ClientIP)
+				return Abort(403, fmt.Sprintf("Access denied. The supplied key of type '%s' does not exist.", keyType))
+			}
+		}
+		if key.Expired(time.Now()) {
+			ap.metrics.authFailure("expired")
+			return Abort(403, fmt.Sprintf("Access denied. This key expired on %s.", key.ExpiresAt.UTC().Format(time.RFC1123)))
+		}
+		ok, err := auth.Validate(key, req, ctx, bits)
+		if err != nil {
+			ap.metrics.authFailure("error")
+			return err
+		}
+		if !ok {
+			ap.metrics.authFailure("invalid")
+			ap.failedAuth(rd, ctx.ClientIP)
+			return Abort(403, fmt.Sprintf("Access denied. Found a key of type '%s', but it is invalid.", key.Type))
 		}
+		if err := ap.realms.check(req, key); err != nil {
+			ap.metrics.authFailure("realm")
+			return err
+		}
+		if err := ap.network.check(ctx.ClientIP, key); err != nil {
+			ap.metrics.authFailure("ip")
+			return err
+		}
+		if su, ok := auth.(SingleUseAuthPlugin); ok {
+			if err := ap.checkReplay(rd, su, key, req, bits); err != nil {
+				return err
+			}
+		}
+		if cache {
+			kjson, _ := json.Marshal(key)
+			// TODO error handling if things go wrong in redis?
+			rd.Do("SET", "auth_cache:"+maybeKey, string(kjson), "PX", int64(ap.keys.CacheTTL/time.Millisecond))
+			ap.keyCache.set(maybeKey, string(kjson), ap.keys.LocalCacheTTL)
+		}
+		ctx.Key = key
+		found = true
+		break
 	}
 	if !found {
 		if ap.allowKeyless {
 			ctx.Keyless = true
 			ctx.Key = nil
 		} else {
-			return Abort(403, "Access denied. You or your app must supply valid credentials to access this API.")
+			ap.metrics.authFailure("missing_credentials")
+			return errMissingCredentials
 		}
 	}
 	return nil
 }
 
+// findKey asks the backends for a key, in order. If backend lookups are
+// limited, it waits for a free slot for a while, then gives up.
+func (ap *apiplex) findKey(maybeKey, keyType string) (*Key, error) {
+	if ap.backendSlots != nil {
+		timer := time.NewTimer(ap.keys.BackendWait)
+		select {
+		case ap.backendSlots <- struct{}{}:
+			timer.Stop()
+			defer func() { <-ap.backendSlots }()
+		case <-timer.C:
+			return nil, errBackendBusy
+		}
+	}
+	for _, bend := range ap.backends {
+		key, err := bend.GetKey(maybeKey, keyType)
+		if err != nil || key != nil {
+			return key, err
+		}
+	}
+	return nil, nil
+}
+
+// lockedOut tells whether the client has failed to authenticate too often.
+func (ap *apiplex) lockedOut(rd redis.Conn, clientIP string) bool {
+	if ap.lockout.MaxFailures <= 0 {
+		return false
+	}
+	failures, _ := redis.Int(rd.Do("GET", "auth_failures:"+clientIP))
+	return failures >= ap.lockout.MaxFailures
+}
+
+// failedAuth counts a failed authentication attempt against the client's IP,
+// within the lockout window that started with the first failure.
+func (ap *apiplex) failedAuth(rd redis.Conn, clientIP string) {
+	if ap.lockout.MaxFailures <= 0 {
+		return
+	}
+	key := "auth_failures:" + clientIP
+	rd.Do("SET", key, 0, "NX", "PX", int64(ap.lockout.Window/time.Millisecond))
+	failures, err := redis.Int(rd.Do("INCR", key))
+	if err == nil && failures == ap.lockout.MaxFailures {
+		ap.metrics.lockout()
+		log.Printf("Locked out %s after %d failed authentication attempts.\n", clientIP, failures)
+	}
+}
+
+// resolveKey asks a ResolvingAuthPlugin for a key. Answers of CachingAuthPlugins
+// are cached under a hash of the credentials, since those may be bearer tokens.
+func (ap *apiplex) resolveKey(rd redis.Conn, resolver ResolvingAuthPlugin, maybeKey, keyType string, bits map[string]interface{}) (*Key, error) {
+	caching, ok := resolver.(CachingAuthPlugin)
+	if !ok {
+		return resolver.Resolve(maybeKey, keyType, bits)
+	}
+	h := sha256.Sum256([]byte(maybeKey))
+	cacheKey := "resolve_cache:" + keyType + ":" + hex.EncodeToString(h[:])
+	kjson, _ := redis.String(rd.Do("GET", cacheKey))
+	ap.metrics.authCacheLookup("resolve", kjson != "")
+	if kjson != "" {
+		// invalid keys are cached as null
+		var key *Key
+		json.Unmarshal([]byte(kjson), &key)
+		return key, nil
+	}
+	key, err := resolver.Resolve(maybeKey, keyType, bits)
+	if err != nil {
+		return nil, err
+	}
+	if ttl := caching.CacheTTL(key, bits); ttl > 0 {
+		kjson, _ := json.Marshal(key)
+		ms := int64(ttl / time.Millisecond)
+		if ms < 1 {
+			ms = 1
+		}
+		rd.Do("SET", cacheKey, string(kjson), "PX", ms)
+	}
+	return key, nil
+}
+
 // checks a single quota (e.g. per_ip or per_key).
 func (ap *apiplex) overQuota(rd redis.Conn, key string, cost, max, minutes int) bool {
 	current, err := redis.Int(rd.Do("GET", key))
@@ -136,39 +289,100 @@ func (ap *apiplex) overQuota(rd redis.Conn, key string, cost, max, minutes int)
 	return false
 }
 
-// checks a request's quota by its context.
-func (ap *apiplex) checkQuota(rd redis.Conn, req *http.Request, ctx *APIContext) error {
-	var quotaName string
-	var keyID string
+// checkReplay records a single-use request's nonce, and rejects the request
+// if the nonce has been seen before.
+func (ap *apiplex) checkReplay(rd redis.Conn, auth SingleUseAuthPlugin, key *Key, req *http.Request, bits map[string]interface{}) error {
+	nonce, ttl := auth.Nonce(req, bits)
+	if nonce == "" || ttl <= 0 {
+		return nil
+	}
+	// nonces can be long (whole signatures), so store a hash
+	h := sha256.Sum256([]byte(nonce))
+	ms := int64(ttl / time.Millisecond)
+	if ms < 1 {
+		ms = 1
+	}
+	_, err := redis.String(rd.Do("SET", "replay:"+key.ID+":"+hex.EncodeToString(h[:]), 1, "NX", "PX", ms))
+	if err == redis.ErrNil {
+		ap.metrics.authFailure("replay")
+		log.Printf("Rejected replayed request for key %s.\n", key.ID)
+		return Abort(401, "Access denied. This request has already been made once and cannot be replayed.")
+	}
+	return err
+}
+
+// quotaFor returns the quota that applies to a request, its name, and the ID
+// its usage is counted under.
+func (ap *apiplex) quotaFor(ctx *APIContext) (apiplexQuota, string, string) {
 	if ctx.Keyless {
-		quotaName = "keyless"
-		keyID = "keyless"
-	} else {
-		quotaName = ctx.Key.Quota
-		keyID = ctx.Key.ID
+		return ap.quotas["keyless"], "keyless", "keyless"
 	}
-	quota, ok := ap.quotas[quotaName]
+	quota, ok := ap.quotas[ctx.Key.Quota]
 	if !ok {
 		// TODO nonexistant quota requested-- this should be reported
-		quota = ap.quotas["default"]
+		return ap.quotas["default"], "default", ctx.Key.ID
 	}
+	return quota, ctx.Key.Quota, ctx.Key.ID
+}
+
+// checks a request's quota by its context.
+func (ap *apiplex) checkQuota(rd redis.Conn, ctx *APIContext) error {
+	quota, quotaName, keyID := ap.quotaFor(ctx)
 	if quota.Minutes <= 0 {
 		return nil
 	}
 	if quota.MaxIP > 0 {
-		clientIP, _, _ := net.SplitHostPort(req.RemoteAddr)
-		if ap.overQuota(rd, "quota:ip:"+keyID+":"+clientIP, ctx.Cost, quota.MaxIP, quota.Minutes) {
+		if ap.overQuota(rd, "quota:ip:"+keyID+":"+ctx.ClientIP, ctx.Cost, quota.MaxIP, quota.Minutes) {
+			ap.metrics.quotaRejected(quotaName, "ip")
 			return Abort(403, fmt.Sprintf("Request quota per IP exceeded (%d reqs / %d mins). Please wait before making new requests.", quota.MaxIP, quota.Minutes))
 		}
 	}
 	if quota.MaxKey > 0 {
 		if ap.overQuota(rd, "quota:key:"+keyID, ctx.Cost, quota.MaxKey, quota.Minutes) {
+			ap.metrics.quotaRejected(quotaName, "key")
 			return Abort(403, fmt.Sprintf("Request quota per key exceeded (%d reqs / %d mins). Please wait before making new requests.", quota.MaxKey, quota.Minutes))
 		}
 	}
 	return nil
 }
 
+// adjustQuota charges (or, if negative, refunds) a cost difference that came up
+// after the quota was checked, i.e. in PostUpstream plugins. The request has
+// already been served at that point, so it is never rejected; going over the
+// quota only affects subsequent requests. Refunds never take a quota below
+// zero, and quota windows that have expired in the meantime are left alone.
+func (ap *apiplex) adjustQuota(rd redis.Conn, ctx *APIContext, delta int) {
+	quota, _, keyID := ap.quotaFor(ctx)
+	if quota.Minutes <= 0 || delta == 0 {
+		return
+	}
+	keys := []string{}
+	if quota.MaxIP > 0 {
+		keys = append(keys, "quota:ip:"+keyID+":"+ctx.ClientIP)
+	}
+	if quota.MaxKey > 0 {
+		keys = append(keys, "quota:key:"+keyID)
+	}
+	for _, key := range keys {
+		if exists, _ := redis.Bool(rd.Do("EXISTS", key)); exists {
+			if n, err := redis.Int(rd.Do("INCRBY", key, delta)); err == nil && n < 0 {
+				rd.Do("INCRBY", key, -n)
+			}
+		}
+	}
+}
+
+// runPlugin runs a plugin's stage function in its own span, and times it.
+func (ap *apiplex) runPlugin(req *http.Request, plugin interface{}, run func() error) error {
+	name := ap.pluginNames[plugin]
+	_, span := ap.tracing.start(req, name)
+	t := time.Now()
+	err := run()
+	ap.metrics.observePlugin(name, time.Since(t))
+	endSpan(span, err)
+	return err
+}
+
 // HandleAPI is the main processing function. It receives a request, checks for authentication,
 // calculates quota, runs plugins and then passes the request to an upstream backend. On the
 // returned response, it again runs plugins, and then sends the (possibly modified) result
@@ -183,29 +397,79 @@ func (ap *apiplex) HandleAPI(res http.ResponseWriter, req *http.Request) {
 		Data:    make(map[string]interface{}),
 	}
 
-	// TODO determine actual(!) client IP address and add to ctx.Log
+	ctx.ClientIP = ap.network.clientIP(req)
+	ctx.Log["client_ip"] = ctx.ClientIP
+
+	start := time.Now()
+	sw := &statusWriter{ResponseWriter: res, status: 200}
+	res = sw
+	req, span := ap.tracing.startRequest(req, req.Method+" "+ap.apipath)
+	defer func() {
+		ap.metrics.observeRequest(req, &ctx, sw.status, time.Since(start))
+		span.SetAttributes(attribute.Int("http.response.status_code", sw.status))
+		if sw.status >= 500 {
+			span.SetStatus(codes.Error, http.StatusText(sw.status))
+		}
+		span.End()
+	}()
+
+	if ap.realms.cors && isPreflight(req) {
+		ap.handlePreflight(res, req, &ctx)
+		return
+	}
 
 	rd := ap.redis.Get()
+	defer rd.Close()
 
-	if err := ap.authenticateRequest(req, rd, &ctx); err != nil {
+	_, authSpan := ap.tracing.start(req, "auth")
+	err := ap.authenticateRequest(req, rd, &ctx)
+	endSpan(authSpan, err)
+	if err != nil {
 		ap.error(500, err, res)
 		return
 	}
+	if ap.realms.cors {
+		ap.realms.allowOrigin(res, req, ctx.Key)
+	}
+	if err := ap.scopes.authorize(req.Method, &ctx); err != nil {
+		ap.metrics.authFailure("missing_scope")
+		ap.error(500, err, res)
+		return
+	}
+	_, quotaName, _ := ap.quotaFor(&ctx)
+	span.SetAttributes(attribute.String("apiplexy.quota", quotaName))
+	if ctx.Key != nil {
+		span.SetAttributes(attribute.String("apiplexy.key_id", ctx.Key.ID))
+	}
 
 	for _, postauth := range ap.postauth {
-		if err := postauth.PostAuth(req, &ctx); err != nil {
+		if !ap.applies(postauth, req, &ctx) {
+			continue
+		}
+		if err := ap.runPlugin(req, postauth, func() error {
+			return postauth.PostAuth(req, &ctx)
+		}); err != nil {
 			ap.error(500, err, res)
 			return
 		}
 	}
 
-	if err := ap.checkQuota(rd, req, &ctx); err != nil {
+	_, quotaSpan := ap.tracing.start(req, "quota")
+	err = ap.checkQuota(rd, &ctx)
+	endSpan(quotaSpan, err)
+	if err != nil {
 		ap.error(500, err, res)
 		return
 	}
+	charged := ctx.Cost
 
 	for _, preupstream := range ap.preupstream {
-		if err := preupstream.PreUpstream(req, &ctx); err != nil {
+		if !ap.applies(preupstream, req, &ctx) {
+			continue
+		}
+		if err := ap.runPlugin(req, preupstream, func() error {
+			return preupstream.PreUpstream(req, &ctx)
+		}); err != nil {
 			ap.error(500, err, res)
 			return
 		}
@@ -218,6 +482,7 @@ func (ap *apiplex) HandleAPI(res http.ResponseWriter, req *http.Request) {
 	// prepare request for backend
 	outreq := new(http.Request)
 	*outreq = *req
+	outreq.Header = req.Header.Clone()
 
 	outreq.URL.Scheme = ctx.Upstream.Address.Scheme
 	outreq.URL.Host = ctx.Upstream.Address.Host
@@ -236,7 +501,17 @@ func (ap *apiplex) HandleAPI(res http.ResponseWriter, req *http.Request) {
 		outreq.Header.Set("X-Forwarded-For", clientIP)
 	}
 
+	upstreamCtx, upstreamSpan := ap.tracing.start(req, "upstream", trace.WithSpanKind(trace.SpanKindClient),
+		trace.WithAttributes(attribute.String("server.address", ctx.Upstream.Address.Host)))
+	outreq = outreq.WithContext(upstreamCtx)
+	tracePropagator.Inject(upstreamCtx, propagation.HeaderCarrier(outreq.Header))
+
 	urs, err := ctx.Upstream.Client.Do(outreq)
+	ap.metrics.upstreamResult(ctx.Upstream, err)
+	if err == nil {
+		upstreamSpan.SetAttributes(attribute.Int("http.response.status_code", urs.StatusCode))
+	}
+	endSpan(upstreamSpan, err)
 	if err != nil {
 		ap.error(500, err, res)
 		return
@@ -254,13 +529,22 @@ func (ap *apiplex) HandleAPI(res http.ResponseWriter, req *http.Request) {
 		urs.Header.Del(h)
 	}
 	for k, vv := range urs.Header {
+		if ap.realms.cors && strings.HasPrefix(k, "Access-Control-") {
+			// we decide on CORS, not the upstream
+			continue
+		}
 		for _, v := range vv {
 			res.Header().Add(k, v)
 		}
 	}
 
 	for _, postupstream := range ap.postupstream {
-		if err := postupstream.PostUpstream(req, urs, &ctx); err != nil {
+		if !ap.applies(postupstream, req, &ctx) {
+			continue
+		}
+		if err := ap.runPlugin(req, postupstream, func() error {
+			return postupstream.PostUpstream(req, urs, &ctx)
+		}); err != nil {
 			ap.error(500, err, res)
 			return
 		}
@@ -272,10 +556,23 @@ func (ap *apiplex) HandleAPI(res http.ResponseWriter, req *http.Request) {
 	res.WriteHeader(urs.StatusCode)
 	res.Write(body)
 
-	// do logging in a goroutine so the request can finish as fast as possible
+	// plugins may count the cost as the body goes out, so charge it only now
+	if ctx.Cost != charged {
+		ap.adjustQuota(rd, &ctx, ctx.Cost-charged)
+	}
+
+	// do logging in a goroutine so the request can finish as fast as possible,
+	// but keep the plugins from being closed underneath it
+	ap.inflight.Add(1)
 	go func() {
+		defer ap.inflight.Done()
 		for _, logging := range ap.logging {
-			if err := logging.Log(req, urs, &ctx); err != nil {
+			if !ap.applies(logging, req, &ctx) {
+				continue
+			}
+			if err := ap.runPlugin(req, logging, func() error {
+				return logging.Log(req, urs, &ctx)
+			}); err != nil {
 				ap.error(500, err, res)
 				return
 			}
@@ -0,0 +1,79 @@
+package apiplexy
+
+import (
+	"github.com/garyburd/redigo/redis"
+	. "github.com/smartystreets/goconvey/convey"
+	"testing"
+	"time"
+)
+
+// slowBackend knows every key, but only answers once released.
+type slowBackend struct {
+	release chan struct{}
+}
+
+func (b *slowBackend) GetKey(keyID string, keyType string) (*Key, error) {
+	<-b.release
+	return &Key{ID: keyID, Type: keyType}, nil
+}
+
+func (b *slowBackend) Configure(config map[string]interface{}) error {
+	return nil
+}
+
+func (b *slowBackend) DefaultConfig() map[string]interface{} {
+	return map[string]interface{}{}
+}
+
+func TestFindKey(t *testing.T) {
+	Convey("Backend lookups should wait for a free slot, then give up", t, func() {
+		backend := &slowBackend{release: make(chan struct{})}
+		ap := &apiplex{
+			backends:     []BackendPlugin{backend},
+			keys:         apiplexConfigKeys{BackendWait: 20 * time.Millisecond},
+			backendSlots: make(chan struct{}, 1),
+		}
+
+		found := make(chan *Key)
+		go func() {
+			key, _ := ap.findKey("first", "Test")
+			found <- key
+		}()
+		// wait for the first lookup to take the only slot
+		for len(ap.backendSlots) == 0 {
+			time.Sleep(time.Millisecond)
+		}
+
+		_, err := ap.findKey("second", "Test")
+		So(err, ShouldResemble, errBackendBusy)
+
+		close(backend.release)
+		So((<-found).ID, ShouldEqual, "first")
+		key, err := ap.findKey("third", "Test")
+		So(err, ShouldBeNil)
+		So(key.ID, ShouldEqual, "third")
+	})
+}
+
+func TestAdjustQuota(t *testing.T) {
+	rd, err := redis.Dial("tcp", "127.0.0.1:6379", redis.DialDatabase(1))
+	if err != nil {
+		t.Skip("Needs Redis on 127.0.0.1:6379.")
+	}
+	defer rd.Close()
+	ap := &apiplex{quotas: map[string]apiplexQuota{"default": {Minutes: 5, MaxKey: 10}}}
+	ctx := &APIContext{Key: &Key{ID: "adjust-test"}, ClientIP: "192.0.2.1"}
+
+	Convey("Refunds should never take a quota below zero", t, func() {
+		rd.Do("SET", "quota:key:adjust-test", 1, "EX", 60)
+		defer rd.Do("DEL", "quota:key:adjust-test")
+		ap.adjustQuota(rd, ctx, -5)
+		used, _ := redis.Int(rd.Do("GET", "quota:key:adjust-test"))
+		So(used, ShouldEqual, 0)
+		ap.adjustQuota(rd, ctx, 3)
+		used, _ = redis.Int(rd.Do("GET", "quota:key:adjust-test"))
+		So(used, ShouldEqual, 3)
+		ttl, _ := redis.Int(rd.Do("TTL", "quota:key:adjust-test"))
+		So(ttl, ShouldBeGreaterThan, 0)
+	})
+}
@@ -0,0 +1,93 @@
+package apiplexy
+
+import (
+	"context"
+	"fmt"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/codes"
+	"go.opentelemetry.io/otel/exporters/otlp/otlptrace/otlptracehttp"
+	"go.opentelemetry.io/otel/propagation"
+	"go.opentelemetry.io/otel/sdk/resource"
+	sdktrace "go.opentelemetry.io/otel/sdk/trace"
+	"go.opentelemetry.io/otel/trace"
+	"go.opentelemetry.io/otel/trace/noop"
+	"net/http"
+	"time"
+)
+
+// W3C Trace Context (traceparent/tracestate headers).
+var tracePropagator = propagation.TraceContext{}
+
+// apiplexTracing creates spans for one apiplex. If no OTLP endpoint is
+// configured, spans are not recorded, but an incoming traceparent is still
+// passed on to the upstream.
+type apiplexTracing struct {
+	provider *sdktrace.TracerProvider
+	tracer   trace.Tracer
+}
+
+func newTracing(config apiplexConfigTracing) (*apiplexTracing, error) {
+	if config.Endpoint == "" {
+		return &apiplexTracing{tracer: noop.NewTracerProvider().Tracer("apiplexy")}, nil
+	}
+	opts := []otlptracehttp.Option{otlptracehttp.WithEndpointURL(config.Endpoint)}
+	if len(config.Headers) > 0 {
+		opts = append(opts, otlptracehttp.WithHeaders(config.Headers))
+	}
+	exporter, err := otlptracehttp.New(context.Background(), opts...)
+	if err != nil {
+		return nil, err
+	}
+	service := config.ServiceName
+	if service == "" {
+		service = "apiplexy"
+	}
+	provider := sdktrace.NewTracerProvider(
+		sdktrace.WithBatcher(exporter),
+		sdktrace.WithResource(resource.NewSchemaless(attribute.String("service.name", service))),
+	)
+	return &apiplexTracing{
+		provider: provider,
+		tracer:   provider.Tracer("github.com/12foo/apiplexy"),
+	}, nil
+}
+
+// startRequest continues the trace from the request's traceparent header (or
+// starts a new one) and returns the request with the server span in its
+// context.
+func (t *apiplexTracing) startRequest(req *http.Request, name string) (*http.Request, trace.Span) {
+	ctx := tracePropagator.Extract(req.Context(), propagation.HeaderCarrier(req.Header))
+	ctx, span := t.tracer.Start(ctx, name, trace.WithSpanKind(trace.SpanKindServer),
+		trace.WithAttributes(
+			attribute.String("http.request.method", req.Method),
+			attribute.String("url.path", req.URL.Path),
+		))
+	return req.WithContext(ctx), span
+}
+
+// start starts a child span of the request's span.
+func (t *apiplexTracing) start(req *http.Request, name string, opts ...trace.SpanStartOption) (context.Context, trace.Span) {
+	return t.tracer.Start(req.Context(), name, opts...)
+}
+
+// endSpan ends a span, marking it as failed if err is set.
+func endSpan(span trace.Span, err error) {
+	if err != nil {
+		span.RecordError(err)
+		span.SetStatus(codes.Error, err.Error())
+	}
+	span.End()
+}
+
+// close flushes spans that haven't been exported yet.
+func (t *apiplexTracing) close() error {
+	if t == nil || t.provider == nil {
+		return nil
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	if err := t.provider.Shutdown(ctx); err != nil {
+		return fmt.Errorf("While flushing traces: %s", err.Error())
+	}
+	return nil
+}
@@ -0,0 +1,53 @@
+package apiplexy
+
+import (
+	"fmt"
+	"net/http"
+	"net/url"
+	"sync"
+)
+
+// An UpstreamCache hands out upstreams for addresses that plugins pick while
+// serving requests (see APIContext.Upstream), so each address is only parsed
+// once. It holds at most as many upstreams as it was created for, so plugins
+// that build addresses from request data can't make it grow without bounds.
+// It is safe for concurrent use.
+type UpstreamCache struct {
+	mu        sync.Mutex
+	size      int
+	upstreams map[string]*APIUpstream
+}
+
+// NewUpstreamCache creates an UpstreamCache holding up to size upstreams.
+func NewUpstreamCache(size int) *UpstreamCache {
+	return &UpstreamCache{size: size, upstreams: make(map[string]*APIUpstream)}
+}
+
+// Get returns the upstream for an absolute URL. Once the cache is full, an
+// arbitrary upstream is dropped to make room for a new one.
+func (c *UpstreamCache) Get(address string) (*APIUpstream, error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if us, ok := c.upstreams[address]; ok {
+		return us, nil
+	}
+	u, err := url.Parse(address)
+	if err != nil || u.Scheme == "" || u.Host == "" {
+		return nil, fmt.Errorf("'%s' is not a valid upstream address.", address)
+	}
+	for a := range c.upstreams {
+		if len(c.upstreams) < c.size {
+			break
+		}
+		delete(c.upstreams, a)
+	}
+	us := &APIUpstream{Client: &http.Client{}, Address: u}
+	c.upstreams[address] = us
+	return us, nil
+}
+
+func (c *UpstreamCache) len() int {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return len(c.upstreams)
+}
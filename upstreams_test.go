@@ -0,0 +1,32 @@
+package apiplexy
+
+import (
+	"fmt"
+	. "github.com/smartystreets/goconvey/convey"
+	"testing"
+)
+
+func TestUpstreamCache(t *testing.T) {
+	Convey("Upstreams should be parsed once and kept", t, func() {
+		c := NewUpstreamCache(10)
+		us, err := c.Get("http://tenant-a.internal:8000/v1/")
+		So(err, ShouldBeNil)
+		So(us.Address.Host, ShouldEqual, "tenant-a.internal:8000")
+		again, _ := c.Get("http://tenant-a.internal:8000/v1/")
+		So(again, ShouldEqual, us)
+
+		_, err = c.Get("tenant-a.internal")
+		So(err, ShouldNotBeNil)
+		_, err = c.Get("http://%zz")
+		So(err, ShouldNotBeNil)
+	})
+
+	Convey("The cache should never hold more upstreams than it was made for", t, func() {
+		c := NewUpstreamCache(3)
+		for i := 0; i < 20; i++ {
+			_, err := c.Get(fmt.Sprintf("http://tenant-%d.internal/", i))
+			So(err, ShouldBeNil)
+			So(c.len(), ShouldBeLessThanOrEqualTo, 3)
+		}
+	})
+}